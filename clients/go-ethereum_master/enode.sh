@@ -14,4 +14,7 @@ TARGET_RESPONSE=$(curl -s -X POST  -H "Content-Type: application/json"  --data '
 
 echo "Got admin enode info response: $TARGET_RESPONSE"
 TARGET_ENODE=$(echo ${TARGET_RESPONSE}| jq -r '.result.enode')
-echo "Target enode identified as $TARGET_ENODE"
\ No newline at end of file
+echo "Target enode identified as $TARGET_ENODE"
+
+# Node key file, deleted by the key rotation test to restart the client with a new key
+TARGET_NODEKEY=/root/.ethereum/geth/nodekey
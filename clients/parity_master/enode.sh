@@ -17,4 +17,7 @@ TARGET_RESPONSE=$(curl --data '{"method":"parity_enode","params":[],"id":1,"json
 echo "Got admin enode info response: $TARGET_RESPONSE"
 TARGET_ENODE=$(echo ${TARGET_RESPONSE}| jq -r '.result')
 
-echo "Target enode identified as $TARGET_ENODE"
\ No newline at end of file
+echo "Target enode identified as $TARGET_ENODE"
+
+# Node key file, deleted by the key rotation test to restart the client with a new key
+TARGET_NODEKEY=/root/.local/share/io.parity.ethereum/network/key
@@ -1,18 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/ethereum/go-ethereum/p2p/netutil"
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/karalabe/hive/validators/devp2p/discv4test"
 )
 
 var (
@@ -26,30 +42,124 @@ var (
 	nodeKey      *ecdsa.PrivateKey
 	err          error
 	restrictList *netutil.Netlist
-	v4udp        V4Udp
+	v4udp        *discv4test.V4Udp
+	seed         *int64         // seed of all test randomness
+	repeat       *int           // number of runs of the suite
+	forkID       *string        // fork ID the target is expected to advertise in its node record
+	loss         *float64       // fraction of packets dropped, for resilience testing
+	jitter       *time.Duration // maximum delay added to sent packets, for resilience testing
+	keepGoing    *bool          // report failures without stopping the failing test
+	dnsTargets   []*enode.Node  // targets resolved from an EIP-1459 node list
+	protocol     *string        // discovery protocols to test: v4, v5 or all
+	targetIPs    []net.IP       // addresses the target's hostname resolved to
+	reportFile   *string        // file the JSON report of the suite is written to
+	reports      []targetReport // outcome of the suite against each target, for the report file
+	webhook      *string        // URL the result summary is posted to when the suite ends
+	readBuffer   *int           // size of the UDP read buffer, 1280 if zero; above 1280 to read oversized packets whole
+
+	// targetNodeKey is the path of the node key file in the target's container, from
+	// -targetNodeKey. v4055 deletes it to restart the target with a new key.
+	targetNodeKey *string
+
+	// expected holds the IDs of the tests listed in -expectedFailures, such as v4004.
+	expected map[string]bool
+
+	// runningIn maps each test running under testResults.run to a runningTest, so that fail
+	// can record an expected failure in its results.
+	runningIn sync.Map
+
+	// pinned is the public key the target must sign its pongs with, from -pinnedPubkey.
+	pinned *discv4test.EncPubkey
+
+	// maxPongExpiration bounds how far ahead pongs may expire, unbounded if zero.
+	maxPongExpiration *time.Duration
+
+	// stream carries a result line for each test as it finishes, printed as they come by
+	// drainResults. It is nil unless -stream is set.
+	stream chan resultLine
+
+	// staticNodesOut is the file the live neighbours of the targets are written to, from
+	// -staticNodesOut, and staticNodes holds them, without duplicates.
+	staticNodesOut *string
+	staticNodes    []*enode.Node
+
+	// shutdown is closed on SIGINT or SIGTERM. The test in progress is cut short by closing
+	// the socket under it and the rest are skipped, so the results so far are still reported.
+	shutdown = make(chan struct{})
+
+	// newConn opens the sockets the suite runs on. Replace it to reach targets only
+	// reachable through a relay, a tunnel or another network namespace.
+	newConn discv4test.ConnFactory = discv4test.ListenConn
 )
 
 func TestMain(m *testing.M) {
 
 	testTarget := flag.String("enodeTarget", "", "Enode address of target")
-	testTargetIP := flag.String("targetIP", "", "IP Address of hive container client")
-	listenPort = flag.String("listenPort", ":30303", "")
+	testTargetIP := flag.String("targetIP", "", "IP address or hostname of hive container client")
+	listenPort = flag.String("listenPort", ":0", "udp listen address (default: an ephemeral port)")
 	natdesc = flag.String("nat", "none", "port mapping mechanism (any|none|upnp|pmp|extip:<IP>)")
 	dockerHost = flag.String("dockerHost", "", "docker host api endpoint")
 	targetID = flag.String("targetID", "", "the hive client container id")
+	seed = flag.Int64("seed", 0, "seed for reproducible test randomness (default: current time)")
+	repeat = flag.Int("repeat", 1, "number of times to run the suite, reporting per-test stability")
+	forkID = flag.String("forkID", "", "expected fork ID of the target's chain, as hash[:next] (default: not checked)")
+	loss = flag.Float64("loss", 0, "fraction of packets to drop in each direction, for resilience testing")
+	jitter = flag.Duration("jitter", 0, "maximum random delay added to each sent packet, for resilience testing")
+	keepGoing = flag.Bool("continueOnFailure", false, "report test failures without stopping the failing test, so every check runs")
+	dnsDiscovery := flag.String("dnsDiscovery", "", "enrtree:// URL of an EIP-1459 node list; the suite is run against each node")
+	protocol = flag.String("protocol", "all", "discovery protocols to test (v4|v5|all)")
+	describe := flag.String("describe", "", "print everything discovery reveals about the target, as text or json, instead of running the suite")
+	reportFile = flag.String("report", "", "write the outcome of every discovery v4 test to this file as JSON, including panics")
+	webhook = flag.String("webhook", "", "URL to POST the JSON result summary to when the suite ends; failures are logged, not fatal")
+	expectedFailures := flag.String("expectedFailures", "", "comma-separated IDs of tests expected to fail, such as v4004,v4010; their failures do not fail the run")
+	pinnedPubkey := flag.String("pinnedPubkey", "", "128 hex digit public key the target must sign its pongs with, to catch a different node answering at its address")
+	maxPongExpiration = flag.Duration("maxPongExpiration", 0, "reject pongs expiring further ahead than this, as a sign of a broken clock (default: unbounded, as the spec allows)")
+	streamResults := flag.Bool("stream", false, "print a line such as 'RESULT v4002 PASS 12ms' as each test finishes, for live CI output")
+	staticNodesOut = flag.String("staticNodesOut", "", "write the target's neighbours that answer a ping to this file, as a go-ethereum static-nodes.json")
+	replayPcap := flag.String("replayPcap", "", "resend the packets a pcap capture shows sent to its first destination to the -enodeTarget, reporting the replies, instead of running the suite")
+	readBuffer = flag.Int("readBufferSize", 0, "UDP read buffer size, 1280 if zero; packets over the 1280 byte limit are only reported with their true size if it is larger, such as 65535")
+	targetNodeKey = flag.String("targetNodeKey", "", "path of the node key file in the target's container, deleted to restart it with a new key (default: key rotation not tested)")
+	logLevel := flag.String("logLevel", "info", "log verbosity of this binary (trace|debug|info|warn|error|crit)")
 	flag.Parse()
 
-	//If an enode was supplied, use that
-	if *testTarget != "" {
-		targetnode, err = enode.ParseV4(*testTarget)
-		if err != nil {
-			panic(err)
-		}
+	lvl, err := log.LvlFromString(*logLevel)
+	if err != nil {
+		panic(err)
 	}
+	log.Root().SetHandler(log.LvlFilterHandler(lvl, log.StreamHandler(os.Stderr, log.TerminalFormat(false))))
 
-	//If a target ip was supplied, parse it and use it
+	if *protocol != "v4" && *protocol != "v5" && *protocol != "all" {
+		panic(fmt.Sprintf("invalid -protocol %q, want v4, v5 or all", *protocol))
+	}
+	if *describe != "" && *describe != "text" && *describe != "json" {
+		panic(fmt.Sprintf("invalid -describe %q, want text or json", *describe))
+	}
+
+	if expected, err = parseExpectedFailures(*expectedFailures); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	fmt.Printf("Using random seed %d\n", *seed)
+
+	//Hostnames resolve to addresses of our socket's family first
+	preferIPv6 := false
+	if laddr, err := net.ResolveUDPAddr("udp", *listenPort); err == nil && laddr.IP != nil {
+		preferIPv6 = laddr.IP.To4() == nil
+	}
+
+	//Use the enode and the target ip or hostname, if supplied. The enode's host may also be a
+	//hostname, and a typo in either exits with a description of the expected format.
+	targetnode, targetIPs, err = parseTarget(*testTarget, *testTargetIP, net.LookupIP, preferIPv6)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	if *testTargetIP != "" {
-		targetIP = net.ParseIP(*testTargetIP)
+		targetIP = targetIPs[0]
 		//if the target enode was supplied, override the ip address with the target ip supplied, which
 		//seems to be useful when the supplied enode ip address is incorrect in some way when reported
 		//from a docker container
@@ -58,15 +168,397 @@ func TestMain(m *testing.M) {
 		}
 	}
 
-	//Exit if no args supplied
-	if *testTargetIP == "" && targetnode == nil {
-		panic("No target enode or ip supplied")
+	if len(targetIPs) > 0 {
+		fmt.Printf("Target addresses: %v\n", targetIPs)
+	}
+
+	if pinned, err = parsePinnedPubkey(*pinnedPubkey); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if pinned != nil && targetnode == nil {
+		fmt.Fprintln(os.Stderr, "-pinnedPubkey needs an -enodeTarget to pin it to")
+		os.Exit(2)
+	}
+
+	//If a DNS node list was supplied, run against each of its nodes
+	if *dnsDiscovery != "" {
+		dnsTargets, err = discv4test.ResolveTree(*dnsDiscovery, net.LookupTXT)
+		if err != nil {
+			panic(err)
+		}
+		log.Info("Resolved nodes from DNS discovery", "count", len(dnsTargets), "tree", *dnsDiscovery)
+	}
+
+	if *describe != "" {
+		os.Exit(describeTargets(*describe))
+	}
+	if *replayPcap != "" {
+		os.Exit(replayCapture(*replayPcap))
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go interruptOn(sigs, shutdown)
+
+	drained := make(chan struct{})
+	if *streamResults {
+		stream = make(chan resultLine, 16)
+		go func() {
+			drainResults(os.Stdout, stream)
+			close(drained)
+		}()
+	}
+	code := m.Run()
+	//release the port before the results are written out
+	if v4udp != nil {
+		v4udp.Close()
+	}
+	if stream != nil {
+		close(stream)
+		<-drained
+	}
+	select {
+	case <-shutdown:
+		fmt.Fprintln(os.Stderr, "Interrupted, reporting the tests run so far")
+		if code == 0 {
+			code = 1
+		}
+	default:
+	}
+	if *reportFile != "" {
+		if err := writeReport(*reportFile); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write report: %v\n", err)
+			code = 1
+		}
+	}
+	if *staticNodesOut != "" {
+		if err := writeStaticNodesFile(*staticNodesOut); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write static nodes: %v\n", err)
+			code = 1
+		}
+	}
+	if *webhook != "" {
+		//the results stand whether or not the dashboard got them
+		if err := postWebhook(*webhook, newSummary(reports), webhookAttempts, webhookBackoff); err != nil {
+			fmt.Fprintf(os.Stderr, "could not post results to webhook: %v\n", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// interruptOn closes shutdown on the first signal received on sigs, and stops catching signals
+// so that a second one kills the suite at once.
+func interruptOn(sigs chan os.Signal, shutdown chan<- struct{}) {
+	<-sigs
+	signal.Stop(sigs)
+	close(shutdown)
+}
+
+const (
+	webhookTimeout  = 10 * time.Second // bound on each webhook request
+	webhookAttempts = 3
+	webhookBackoff  = time.Second // delay before the first retry, doubled for each one after
+)
+
+// summary is the result summary posted to the webhook.
+type summary struct {
+	HarnessID string         `json:"harnessID,omitempty"` // node ID the suite ran as
+	Counts    map[string]int `json:"counts"`              // number of tests with each verdict
+	Targets   []targetReport `json:"targets"`
+}
+
+func newSummary(reports []targetReport) summary {
+	s := summary{Counts: make(map[string]int), Targets: reports}
+	if nodeKey != nil {
+		s.HarnessID = enode.PubkeyToIDV4(&nodeKey.PublicKey).String()
+	}
+	for _, r := range reports {
+		for _, e := range r.Tests {
+			s.Counts[e.Verdict]++
+		}
+	}
+	return s
+}
+
+// postWebhook posts s as JSON to url, making up to attempts tries with exponential backoff.
+// Any response outside 2xx is a failed attempt.
+func postWebhook(url string, s summary, attempts int, backoff time.Duration) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for i := 0; ; i++ {
+		var resp *http.Response
+		resp, err = client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		if i+1 >= attempts {
+			return err
+		}
+		time.Sleep(backoff << uint(i))
+	}
+}
+
+// writeReport writes the reports of every target the suite ran against to path.
+func writeReport(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONReport(f, reports); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJSONReport(w io.Writer, reports []targetReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reports)
+}
+
+// writeStaticNodesFile writes the live neighbours found to path.
+func writeStaticNodesFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeStaticNodes(f, staticNodes); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeStaticNodes writes nodes as a JSON array of enode URLs, the format of the
+// static-nodes.json file read from a go-ethereum data directory.
+func writeStaticNodes(w io.Writer, nodes []*enode.Node) error {
+	urls := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		urls = append(urls, n.URLv4())
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(urls)
+}
+
+// collectStaticNodes adds the target's neighbours that answer a ping to staticNodes.
+func collectStaticNodes(t *testing.T) {
+	live, err := v4udp.LiveNeighbours(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, discv4test.EncodePubkey(targetnode.Pubkey()))
+	if err != nil {
+		t.Logf("No static nodes from %v: %v", targetnode.ID().TerminalString(), err)
+		return
+	}
+	for _, n := range live {
+		if !containsNode(staticNodes, n.ID()) {
+			staticNodes = append(staticNodes, n)
+		}
+	}
+	t.Logf("%d live neighbours of %v for the static nodes", len(live), targetnode.ID().TerminalString())
+}
+
+func containsNode(nodes []*enode.Node, id enode.ID) bool {
+	for _, n := range nodes {
+		if n.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpectedFailures parses the -expectedFailures list of test IDs. An ID that names no
+// discovery v4 test is an error, so that a typo does not silently expect nothing.
+func parseExpectedFailures(list string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	if list == "" {
+		return ids, nil
+	}
+	known := make(map[string]bool)
+	for _, test := range discoveryv4Tests() {
+		known[testID(test.name)] = true
+	}
+	for _, id := range strings.Split(list, ",") {
+		id = strings.TrimSpace(id)
+		if !known[id] {
+			return nil, fmt.Errorf("invalid -expectedFailures: no test %q, expected test IDs such as v4004", id)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// testID returns the ID in parentheses at the end of a test name, v4004 for
+// "SourceUnknownPingExtraData(v4004)", or "" if it has none.
+func testID(name string) string {
+	i := strings.LastIndexByte(name, '(')
+	if i < 0 || !strings.HasSuffix(name, ")") {
+		return ""
+	}
+	return name[i+1 : len(name)-1]
+}
+
+// parseTarget parses the -enodeTarget and -targetIP flags, either of which may be empty. It
+// returns the target node, if an enode was given, and the addresses to test it at. The errors
+// say which flag was wrong and what it should look like, as a typo is the usual cause.
+func parseTarget(enodeURL, ip string, lookup discv4test.LookupIP, preferIPv6 bool) (*enode.Node, []net.IP, error) {
+	const enodeFormat = "expected enode://<128 hex digit node ID>@<IP or hostname>:<TCP port>[?discport=<UDP port>]"
+	var (
+		n   *enode.Node
+		ips []net.IP
+	)
+	if enodeURL != "" {
+		if err := checkEnodeURL(enodeURL); err != nil {
+			return nil, nil, fmt.Errorf("invalid -enodeTarget %q: %v\n%s", enodeURL, err, enodeFormat)
+		}
+		var err error
+		if n, ips, err = discv4test.ParseV4Host(enodeURL, lookup, preferIPv6); err != nil {
+			return nil, nil, fmt.Errorf("invalid -enodeTarget %q: %v\n%s", enodeURL, err, enodeFormat)
+		}
+	}
+	if ip != "" {
+		var err error
+		if ips, err = discv4test.ResolveHost(ip, lookup, preferIPv6); err != nil {
+			return nil, nil, fmt.Errorf("invalid -targetIP %q: %v\nexpected an IPv4 or IPv6 address, or a hostname that resolves", ip, err)
+		}
+	}
+	return n, ips, nil
+}
+
+// parsePinnedPubkey parses the -pinnedPubkey flag, the uncompressed public key in hex as it
+// appears in an enode URL, with or without a 0x prefix. It returns nil if the flag is empty.
+func parsePinnedPubkey(s string) (*discv4test.EncPubkey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid -pinnedPubkey %q: %v", s, err)
+	}
+	var key discv4test.EncPubkey
+	if len(b) != len(key) {
+		return nil, fmt.Errorf("invalid -pinnedPubkey %q: %d bytes, expected %d (128 hex digits)", s, len(b), len(key))
 	}
+	copy(key[:], b)
+	return &key, nil
+}
 
-	os.Exit(m.Run())
+// checkEnodeURL catches the common mistakes in an enode URL, so they can be named rather than
+// left to the parser's error.
+func checkEnodeURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "enode":
+		return fmt.Errorf("scheme is %q, not enode", u.Scheme)
+	case u.Host == "":
+		return errors.New("no // after enode:")
+	case u.User == nil:
+		return errors.New("no node ID before the @")
+	case u.Hostname() == "":
+		return errors.New("no host after the @")
+	case u.Port() == "":
+		return errors.New("no TCP port")
+	}
+	id := u.User.String()
+	if len(id) != 128 {
+		return fmt.Errorf("node ID has %d hex digits, want 128", len(id))
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return fmt.Errorf("node ID is not hex: %v", err)
+	}
+	return nil
 }
 
-//not currently necessary:
+// describeTargets prints what discovery reveals about each target in the given format, text
+// or json, and returns the exit code.
+func describeTargets(format string) int {
+	targets := dnsTargets
+	if targetnode != nil {
+		targets = []*enode.Node{targetnode}
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "-describe needs an -enodeTarget or a -dnsDiscovery node list")
+		return 1
+	}
+	v4udp = setupv4UDP()
+	for _, n := range targets {
+		d := v4udp.Describe(n.ID(), &net.UDPAddr{IP: n.IP(), Port: n.UDP()})
+		if format == "json" {
+			enc, err := json.MarshalIndent(d, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not encode description: %v\n", err)
+				return 1
+			}
+			fmt.Println(string(enc))
+		} else {
+			fmt.Println(d)
+		}
+	}
+	return 0
+}
+
+// replayCapture resends to the target the discovery packets sent in a capture, to reproduce
+// the packet sequence of a bug report, and prints what the target sent back for each. The
+// packets sent are those to the destination of the first packet in the capture, which is the
+// target the capture was taken against. It returns the exit code.
+func replayCapture(path string) int {
+	if targetnode == nil {
+		fmt.Fprintln(os.Stderr, "-replayPcap needs an -enodeTarget to replay against")
+		return 2
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	captured, err := discv4test.ReadPcap(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read %s: %v\n", path, err)
+		return 1
+	}
+	payloads := sentPayloads(captured)
+	if len(payloads) == 0 {
+		fmt.Fprintf(os.Stderr, "no UDP packets in %s\n", path)
+		return 1
+	}
+	fmt.Printf("Replaying %d packets sent to %v\n", len(payloads), captured[0].Dst)
+	v4udp = setupv4UDP()
+	results := v4udp.ReplayCapture(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, payloads)
+	expired := 0
+	for i, res := range results {
+		fmt.Printf("%d: %v\n", i+1, res)
+		if res.Expired {
+			expired++
+		}
+	}
+	if expired > 0 {
+		fmt.Printf("%d of %d packets had expired, so a conforming target ignores them\n", expired, len(results))
+	}
+	return 0
+}
+
+// sentPayloads returns the payloads of the captured packets sent to the destination of the
+// first one, in order.
+func sentPayloads(captured []discv4test.CapturedPacket) [][]byte {
+	var payloads [][]byte
+	for _, p := range captured {
+		if p.Dst.IP.Equal(captured[0].Dst.IP) && p.Dst.Port == captured[0].Dst.Port {
+			payloads = append(payloads, p.Payload)
+		}
+	}
+	return payloads
+}
+
+// connectToDockerDaemon connects to the docker daemon that controls the target container.
 func connectToDockerDaemon(t *testing.T) {
 	// this test suite needs to be able to control the client container to:
 	// - Reset the container so that nodes are known/unknown
@@ -86,72 +578,486 @@ func connectToDockerDaemon(t *testing.T) {
 
 // TestDiscovery tests the set of discovery protocols
 func TestDiscovery(t *testing.T) {
+	//Skip if no target supplied
+	if targetIP == nil && targetnode == nil && len(dnsTargets) == 0 {
+		t.Skip("No target enode, ip or DNS node list supplied")
+	}
+
+	var tested []string
+	defer func() {
+		t.Logf("Tested discovery protocols: %s", strings.Join(tested, ", "))
+	}()
+
 	// discovery v4 test suites
+	if testProtocol("v4") {
+		tested = append(tested, "v4")
+		t.Run("discoveryv4", testDiscoveryv4)
+	}
+	if testProtocol("v5") {
+		t.Run("discoveryv5", testDiscoveryv5)
+	}
+}
 
-	t.Run("discoveryv4", func(t *testing.T) {
-		//setup
-		v4udp = setupv4UDP()
+// testProtocol reports whether the -protocol flag selects the given discovery protocol.
+func testProtocol(name string) bool {
+	return *protocol == "all" || *protocol == name
+}
 
-		//If the client has a known enode, obtained from an admin API, then run a standard ping
-		//Otherwise, run a different ping where we override any enode validation checks
-		//The recovered id can be used to set the target node id for any further tests that might want to verify that.
-		var pingTest func(t *testing.T)
+// testDiscoveryv4 runs the discovery v4 suite, once per node if a DNS node list was supplied.
+func testDiscoveryv4(t *testing.T) {
+	//setup
+	v4udp = setupv4UDP()
 
-		if targetnode == nil {
-			pingTest = SourceUnknownPingUnknownEnode
+	//A hostname with several addresses is tested at the first one the target answers on
+	if len(targetIPs) > 1 && targetnode != nil {
+		ip, err := v4udp.FirstReachable(targetnode.ID(), targetIPs, targetnode.UDP())
+		if err != nil {
+			t.Logf("Target answered on none of %v, testing %v: %v", targetIPs, targetnode.IP(), err)
 		} else {
-			pingTest = SourceUnknownPingKnownEnode
+			targetnode = enode.NewV4(targetnode.Pubkey(), ip, targetnode.TCP(), targetnode.UDP())
+			targetIP = ip
+			t.Logf("Testing target at %v", ip)
 		}
+	}
 
-		t.Run("pingTest(v4001)", pingTest)
-		t.Run("SourceUnknownPingWrongTo(v4002)", SourceUnknownPingWrongTo)
-		t.Run("SourceUnknownPingWrongFrom(v4003)", SourceUnknownPingWrongFrom)
-		t.Run("SourceUnknownPingExtraData(v4004)", SourceUnknownPingExtraData)
-		t.Run("SourceUnknownPingExtraDataWrongFrom(v4005)", SourceUnknownPingExtraDataWrongFrom)
-		t.Run("SourceUnknownWrongPacketType(v4006)", SourceUnknownWrongPacketType)
-		t.Run("SourceUnknownFindNeighbours(v4007)", SourceUnknownFindNeighbours)
+	if len(dnsTargets) == 0 {
+		runDiscoveryv4(t)
+		return
+	}
+	for _, n := range dnsTargets {
+		targetnode, targetIP = n, n.IP()
+		t.Run(n.ID().TerminalString(), runDiscoveryv4)
+	}
+}
 
-		t.Run("SourceKnownPingFromSignatureMismatch(v4009)", SourceKnownPingFromSignatureMismatch)
-		t.Run("FindNeighboursOnRecentlyBondedTarget(v4010)", FindNeighboursOnRecentlyBondedTarget)
-		t.Run("PingPastExpiration(v4011)", PingPastExpiration)
-		t.Run("FindNeighboursPastExpiration(v4012)", FindNeighboursPastExpiration)
+// testDiscoveryv5 runs the discovery v5 suite. There is no v5 transport yet, so it is skipped
+// and v5 is not reported as tested.
+func testDiscoveryv5(t *testing.T) {
+	t.Skip("no discovery v5 transport")
 
-	})
+	//TODO: once there is a V5Udp transport, ping the target, and send FINDNODE with a list of
+	//log2 distances and check every returned node lies at one of the requested distances from
+	//the target's ID, reporting any node at an unrequested distance.
+}
 
-	t.Run("discoveryv5", func(t *testing.T) {
+// runDiscoveryv4 runs the discovery v4 suite against the current target.
+func runDiscoveryv4(t *testing.T) {
+	results := newTestResults()
+	results.expected = expected
+	results.stream = stream
+	results.shutdown = shutdown
+	for run := 0; run < *repeat; run++ {
+		for i, test := range discoveryv4Tests() {
+			fn := isolate(test.fn)
+			//every test after the first needs the target enode, which the first
+			//test discovers if it was not supplied
+			if i > 0 {
+				fn = requireTarget(fn)
+			}
+			results.run(t, test.name, fn)
+		}
+	}
+	if *repeat > 1 {
+		results.report(t)
+	}
+	target := targetIP.String()
+	if targetnode != nil {
+		target = targetnode.String()
+	}
+	reports = append(reports, targetReport{Target: target, Tests: results.entries()})
+	select {
+	case <-shutdown:
+	default:
+		if *staticNodesOut != "" && targetnode != nil {
+			collectStaticNodes(t)
+		}
+	}
+}
 
-		t.Run("ping", func(t *testing.T) {
-			//TODO
-		})
+type namedTest struct {
+	name string
+	fn   func(t *testing.T)
+}
+
+// discoveryv4Tests returns the discovery v4 test cases in the order they are run.
+func discoveryv4Tests() []namedTest {
+	//If the client has a known enode, obtained from an admin API, then run a standard ping
+	//Otherwise, run a different ping where we override any enode validation checks
+	//The recovered id can be used to set the target node id for any further tests that might want to verify that.
+	var pingTest func(t *testing.T)
+
+	if targetnode == nil {
+		pingTest = SourceUnknownPingUnknownEnode
+	} else {
+		pingTest = SourceUnknownPingKnownEnode
+	}
+
+	return []namedTest{
+		{"pingTest(v4001)", pingTest},
+		{"SourceUnknownPingWrongTo(v4002)", SourceUnknownPingWrongTo},
+		{"SourceUnknownPingWrongFrom(v4003)", SourceUnknownPingWrongFrom},
+		{"SourceUnknownPingExtraData(v4004)", SourceUnknownPingExtraData},
+		{"SourceUnknownPingExtraDataWrongFrom(v4005)", SourceUnknownPingExtraDataWrongFrom},
+		{"SourceUnknownWrongPacketType(v4006)", SourceUnknownWrongPacketType},
+		{"SourceUnknownFindNeighbours(v4007)", SourceUnknownFindNeighbours},
+
+		{"SourceKnownPingFromSignatureMismatch(v4009)", SourceKnownPingFromSignatureMismatch},
+		{"FindNeighboursOnRecentlyBondedTarget(v4010)", FindNeighboursOnRecentlyBondedTarget},
+		{"PingPastExpiration(v4011)", PingPastExpiration},
+		{"FindNeighboursPastExpiration(v4012)", FindNeighboursPastExpiration},
+		{"PingBadToLength(v4013)", PingBadToLength},
+		{"NATEchoAccuracy(v4014)", NATEchoAccuracy},
+		{"SendUnsolicitedNeighboursUnbonded(v4015)", SendUnsolicitedNeighboursUnbonded},
+		{"PingWrongSigScope(v4016)", PingWrongSigScope},
+		{"UnsolicitedPongNoBond(v4017)", UnsolicitedPongNoBond},
+		{"PingFromSpoofedAsTarget(v4018)", PingFromSpoofedAsTarget},
+		{"FindnodeChunking(v4019)", FindnodeChunking},
+		{"AssertNetworkMatch(v4020)", AssertNetworkMatch},
+		{"FindnodeForKnownNeighbour(v4021)", FindnodeForKnownNeighbour},
+		{"SendEmptyPacket(v4022)", SendEmptyPacket},
+		{"ReversePingHonorsFromPort(v4023)", ReversePingHonorsFromPort},
+		{"ENRLargeResponse(v4024)", ENRLargeResponse},
+		{"PingMaxExpiration(v4025)", PingMaxExpiration},
+		{"ProtocolReport(v4026)", ProtocolReport},
+		{"FindnodeSignedByUnbondedKey(v4027)", FindnodeSignedByUnbondedKey},
+		{"FindnodeNoPrivateLeak(v4028)", FindnodeNoPrivateLeak},
+		{"SendType0Packet(v4029)", SendType0Packet},
+		{"FindnodeZeroTarget(v4030)", FindnodeZeroTarget},
+		{"BondLatency(v4031)", BondLatency},
+		{"PingCheckPongENRSeq(v4032)", PingCheckPongENRSeq},
+		{"PingNonCanonicalRLP(v4033)", PingNonCanonicalRLP},
+		{"PingVerifyTransport(v4034)", PingVerifyTransport},
+		{"FindnodeExpiredAfterBond(v4035)", FindnodeExpiredAfterBond},
+		{"PingDuplicateSuppression(v4036)", PingDuplicateSuppression},
+		{"FindnodeIPv6Chunking(v4037)", FindnodeIPv6Chunking},
+		{"PingLargeTail(v4038)", PingLargeTail},
+		{"DoubleFindnode(v4039)", DoubleFindnode},
+		{"PingToPortZero(v4040)", PingToPortZero},
+		{"PoisonSelfNeighbour(v4041)", PoisonSelfNeighbour},
+		{"RePingUpdatesEndpoint(v4042)", RePingUpdatesEndpoint},
+		{"DualIdentityPing(v4043)", DualIdentityPing},
+		{"LatencyProfile(v4044)", LatencyProfile},
+		{"FindnodeNeighbourLiveness(v4045)", FindnodeNeighbourLiveness},
+		{"FindnodeMixedFamilyChunking(v4046)", FindnodeMixedFamilyChunking},
+		{"PingWeirdTail(v4047)", PingWeirdTail},
+		{"DetectOneWayBonding(v4048)", DetectOneWayBonding},
+		{"PongExpiration(v4049)", PongExpiration},
+		{"KeyspaceCoverage(v4050)", KeyspaceCoverage},
+		{"ReplayFindnode(v4051)", ReplayFindnode},
+		{"PongExpirationFreshness(v4052)", PongExpirationFreshness},
+		{"FindnodeForRequesterSelf(v4053)", FindnodeForRequesterSelf},
+		{"PingIdenticalFromTo(v4054)", PingIdenticalFromTo},
+		{"TargetKeyRotation(v4055)", TargetKeyRotation},
+		{"FindnodeAfterInboundPingOnly(v4056)", FindnodeAfterInboundPingOnly},
+	}
+}
+
+// testResult tallies the outcomes of a single test across repeated runs of the suite. Runs
+// that panicked are counted as failed, and errored too. Skipped runs count as neither passed
+// nor failed.
+type testResult struct {
+	passed, failed int
+	skipped        int
+	errored        int
+	xfailed        int      // runs of an expected failure that failed, counted as neither passed nor failed
+	xpassed        int      // runs of an expected failure that passed, also counted as passed
+	panics         []string // panic value and stack of each errored run
+}
+
+// stability returns the percentage of runs that passed.
+func (r *testResult) stability() float64 {
+	if r.passed+r.failed == 0 {
+		return 0
+	}
+	return 100 * float64(r.passed) / float64(r.passed+r.failed)
+}
+
+// verdict classifies a test as passing, failing, or flaky if it passed only some of its runs.
+// A test that panicked in any run is an error, whatever its other runs did, and one skipped in
+// every run is a skip. A test listed in -expectedFailures is an expected failure if it failed,
+// and unexpectedly passed if it passed in any run, which is worth taking off the list.
+func (r *testResult) verdict() string {
+	switch {
+	case r.errored > 0:
+		return "error"
+	case r.xpassed > 0:
+		return "unexpectedly passed"
+	case r.xfailed > 0:
+		return "expected failure"
+	case r.passed+r.failed == 0:
+		return "skip"
+	case r.failed == 0:
+		return "pass"
+	case r.passed == 0:
+		return "fail"
+	default:
+		return "flaky"
+	}
+}
+
+// testResults aggregates per-test outcomes, keyed by test name, in the order tests first ran.
+type testResults struct {
+	names    []string
+	results  map[string]*testResult
+	expected map[string]bool   // IDs of tests whose failures are expected
+	stream   chan<- resultLine // receives each outcome as it is recorded, if not nil
+	shutdown <-chan struct{}   // once closed, the remaining tests are skipped
+
+	// xfailed holds the IDs of the expected failures that failed through fail in their
+	// current run. fail stops them as skipped, so that they do not fail the suite.
+	xfailed map[string]bool
+}
+
+// runOutcome is how a single run of a test ended.
+type runOutcome struct {
+	passed, skipped  bool
+	failedAsExpected bool   // failed, and is listed in -expectedFailures
+	panicked         string // panic value and stack, if it panicked
+}
+
+// result labels the outcome for a result line. expectedFailure is whether the test is listed
+// in -expectedFailures.
+func (o runOutcome) result(expectedFailure bool) string {
+	switch {
+	case o.panicked != "":
+		return "ERROR"
+	case o.failedAsExpected:
+		return "XFAIL"
+	case o.skipped:
+		return "SKIP"
+	case o.passed && expectedFailure:
+		return "XPASS"
+	case o.passed:
+		return "PASS"
+	default:
+		return "FAIL"
+	}
+}
+
+// resultLine is the outcome of one run of a test, streamed as it finishes.
+type resultLine struct {
+	test    string // test ID, or the test name if it has none
+	result  string
+	elapsed time.Duration
+}
+
+func (l resultLine) String() string {
+	return fmt.Sprintf("RESULT %s %s %v", l.test, l.result, l.elapsed.Round(time.Millisecond))
+}
+
+// drainResults prints each line received on lines to w until the channel is closed.
+func drainResults(w io.Writer, lines <-chan resultLine) {
+	for l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+func newTestResults() *testResults {
+	return &testResults{results: make(map[string]*testResult), xfailed: make(map[string]bool)}
+}
+
+// run runs fn as a subtest of t and records its outcome. A panic in fn fails the subtest and
+// is recorded with its stack, rather than taking down the suite. Subtests excluded by
+// -test.run are not recorded. Once the suite is interrupted, fn is not run and the subtest is
+// recorded as skipped. A test listed in -expectedFailures that fails, whether through fail or
+// by failing t directly, is recorded as an expected failure.
+func (r *testResults) run(t *testing.T, name string, fn func(t *testing.T)) {
+	select {
+	case <-r.shutdown:
+		fn = func(t *testing.T) { t.Skip("Suite interrupted") }
+	default:
+	}
+	ran := false
+	var o runOutcome
+	id := testID(name)
+	delete(r.xfailed, id)
+	start := time.Now()
+	o.passed = t.Run(name, func(t *testing.T) {
+		ran = true
+		runningIn.Store(t, runningTest{r, id})
+		//deferred, as t.Skip does not return
+		defer func() {
+			runningIn.Delete(t)
+			o.skipped = t.Skipped()
+			o.failedAsExpected = r.expected[id] && (t.Failed() || r.xfailed[id])
+		}()
+		o.panicked = catchPanic(func() { fn(t) })
+		if o.panicked != "" {
+			t.Errorf("Test panicked: %s", o.panicked)
+		}
 	})
+	if !ran {
+		return
+	}
+	r.record(name, o)
+	if r.stream != nil {
+		if id == "" {
+			id = name
+		}
+		r.stream <- resultLine{id, o.result(r.expected[testID(name)]), time.Since(start)}
+	}
+}
+
+// runningTest is a test running under testResults.run. Its ID is taken from the name it was
+// run under, as the testing package suffixes the names of repeated runs, such as
+// Foo(v4004)#01.
+type runningTest struct {
+	results *testResults
+	id      string
+}
+
+// catchPanic runs fn and returns the value and stack of a panic in it, or "" if it returned.
+// A test stopped by t.FailNow is not a panic and is left to unwind.
+func catchPanic(fn func()) (panicked string) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			panicked = fmt.Sprintf("%v\n%s", rec, debug.Stack())
+		}
+	}()
+	fn()
+	return ""
+}
 
+// record adds the outcome of one run of the named test.
+func (r *testResults) record(name string, o runOutcome) {
+	res, ok := r.results[name]
+	if !ok {
+		res = new(testResult)
+		r.results[name] = res
+		r.names = append(r.names, name)
+	}
+	switch o.result(r.expected[testID(name)]) {
+	case "ERROR":
+		res.failed++
+		res.errored++
+		res.panics = append(res.panics, o.panicked)
+	case "XFAIL":
+		res.xfailed++
+	case "SKIP":
+		res.skipped++
+	case "XPASS":
+		res.passed++
+		res.xpassed++
+	case "PASS":
+		res.passed++
+	default:
+		res.failed++
+	}
+}
+
+// targetReport is the outcome of the suite against one target, as written to the report file.
+type targetReport struct {
+	Target string        `json:"target"`
+	Tests  []reportEntry `json:"tests"`
+}
+
+type reportEntry struct {
+	Name    string   `json:"name"`
+	Verdict string   `json:"verdict"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped,omitempty"`
+	Errored int      `json:"errored,omitempty"`
+	XFailed int      `json:"expectedFailures,omitempty"`
+	Panics  []string `json:"panics,omitempty"`
+}
+
+// entries returns the outcome of each test, in the order they first ran.
+func (r *testResults) entries() []reportEntry {
+	entries := make([]reportEntry, 0, len(r.names))
+	for _, name := range r.names {
+		res := r.results[name]
+		entries = append(entries, reportEntry{name, res.verdict(), res.passed, res.failed, res.skipped, res.errored, res.xfailed, res.panics})
+	}
+	return entries
+}
+
+// report logs the stability of each test across all runs.
+func (r *testResults) report(t *testing.T) {
+	for _, name := range r.names {
+		res := r.results[name]
+		t.Logf("%s: %s, %d/%d runs passed (%.1f%% stable)", name, res.verdict(), res.passed, res.passed+res.failed, res.stability())
+	}
+}
+
+// isolate wraps a test so that replies it leaves pending are cancelled when it ends, and can't
+// match replies meant for a later test.
+func isolate(fn func(t *testing.T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer v4udp.CancelPendings()
+		fn(t)
+	}
+}
+
+// requireTarget wraps a test that needs the target enode, skipping it if the enode is unknown.
+func requireTarget(fn func(t *testing.T)) func(t *testing.T) {
+	return func(t *testing.T) {
+		if targetnode == nil {
+			t.Skip("Target enode unknown")
+		}
+		fn(t)
+	}
+}
+
+// fail reports a test failure. It stops the test unless -continueOnFailure is set, in which
+// case the test carries on with its remaining checks. The failure of a test listed in
+// -expectedFailures is recorded in its results and logged instead, and the test is stopped as
+// skipped so that it does not fail the run.
+func fail(t *testing.T, format string, args ...interface{}) {
+	t.Helper()
+	if v, ok := runningIn.Load(t); ok && v.(runningTest).results.expected[v.(runningTest).id] {
+		rt := v.(runningTest)
+		rt.results.xfailed[rt.id] = true
+		t.Logf("Expected failure: "+format, args...)
+		if !*keepGoing {
+			t.SkipNow()
+		}
+		return
+	}
+	if *keepGoing {
+		t.Errorf(format, args...)
+	} else {
+		t.Fatalf(format, args...)
+	}
+}
+
+// assertError fails the test with msg and the error got, unless got is, or wraps, the
+// expected error. It reports whether it did, as a failure does not end the test under
+// -continueOnFailure.
+func assertError(t *testing.T, got, want error, msg string) bool {
+	t.Helper()
+	if errors.Is(got, want) {
+		return true
+	}
+	fail(t, "%s: %v", msg, got)
+	return false
 }
 
 //v4001a
 func SourceUnknownPingUnknownEnode(t *testing.T) {
 	t.Log("Pinging unknown node id.")
-	if err := v4udp.ping(enode.ID{}, &net.UDPAddr{IP: targetIP, Port: 30303}, false, func(e *ecdsa.PublicKey) {
+	if err := v4udp.Ping(enode.ID{}, &net.UDPAddr{IP: targetIP, Port: 30303}, false, func(e *ecdsa.PublicKey) {
 
 		targetnode = enode.NewV4(e, targetIP, 30303, 30303)
 		t.Log("Discovered node id " + targetnode.String())
 	}); err != nil {
-		t.Fatalf("Unable to v4 ping: %v", err)
+		fail(t, "Unable to v4 ping: %v", err)
 	}
 }
 
 //v4001b
 func SourceUnknownPingKnownEnode(t *testing.T) {
 	t.Log("Test v4001")
-	if err := v4udp.ping(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Ping test failed: %v", err)
+	if err := v4udp.Ping(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Ping test failed: %v", err)
 	}
 }
 
 //v4002
 func SourceUnknownPingWrongTo(t *testing.T) {
 	t.Log("Test v4002")
-	if err := v4udp.pingWrongTo(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	if err := v4udp.PingWrongTo(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 
 }
@@ -159,50 +1065,46 @@ func SourceUnknownPingWrongTo(t *testing.T) {
 //v4003
 func SourceUnknownPingWrongFrom(t *testing.T) {
 	t.Log("Test v4003")
-	if err := v4udp.pingWrongFrom(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	if err := v4udp.PingWrongFrom(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 }
 
 //v4004
 func SourceUnknownPingExtraData(t *testing.T) {
 	t.Log("Test v4004")
-	if err := v4udp.pingExtraData(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	if err := v4udp.PingExtraData(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 }
 
 //v4005
 func SourceUnknownPingExtraDataWrongFrom(t *testing.T) {
 	t.Log("Test v4005")
-	if err := v4udp.pingExtraDataWrongFrom(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	if err := v4udp.PingExtraDataWrongFrom(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 }
 
 //v4006
 func SourceUnknownWrongPacketType(t *testing.T) {
 	t.Log("Test v4006")
-	if err := v4udp.pingTargetWrongPacketType(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != errTimeout {
-		t.Fatalf("Test failed: %v", err)
-	}
+	assertError(t, v4udp.PingTargetWrongPacketType(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil), discv4test.ErrTimeout, "Test failed")
 }
 
 //v4007
 func SourceUnknownFindNeighbours(t *testing.T) {
 	t.Log("Test v4007")
-	targetEncKey := encodePubkey(targetnode.Pubkey())
-	if err := v4udp.findnodeWithoutBond(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != errTimeout {
-		t.Fatalf("Test failed: %v", err)
-	}
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	assertError(t, v4udp.FindnodeWithoutBond(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey), discv4test.ErrTimeout, "Test failed")
 }
 
 //v4009
 func SourceKnownPingFromSignatureMismatch(t *testing.T) {
 
 	t.Log("Test v4009")
-	if err := v4udp.pingBondedWithMangledFromField(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	if err := v4udp.PingBondedWithMangledFromField(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 
 }
@@ -210,26 +1112,546 @@ func SourceKnownPingFromSignatureMismatch(t *testing.T) {
 //v4010
 func FindNeighboursOnRecentlyBondedTarget(t *testing.T) {
 	t.Log("Test v4010")
-	targetEncKey := encodePubkey(targetnode.Pubkey())
-	if err := v4udp.bondedSourceFindNeighbours(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != nil {
-		t.Fatalf("Test failed: %v", err)
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	if err := v4udp.BondedSourceFindNeighbours(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != nil {
+		fail(t, "Test failed: %v", err)
 	}
 }
 
 //v4011
 func PingPastExpiration(t *testing.T) {
 	t.Log("Test v4011")
-	if err := v4udp.pingPastExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != errTimeout {
-		t.Fatalf("Test failed: %v", err)
-	}
+	assertError(t, v4udp.PingPastExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil), discv4test.ErrTimeout, "Test failed")
 }
 
 //v4012
 func FindNeighboursPastExpiration(t *testing.T) {
 	t.Log("Test v4012")
-	targetEncKey := encodePubkey(targetnode.Pubkey())
-	if err := v4udp.bondedSourceFindNeighboursPastExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != errTimeout {
-		t.Fatalf("Test failed: %v", err)
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	assertError(t, v4udp.BondedSourceFindNeighboursPastExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey), discv4test.ErrTimeout, "Test failed")
+}
+
+//v4013
+func PingBadToLength(t *testing.T) {
+	t.Log("Test v4013")
+	err := v4udp.PingBadToLength(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil)
+	switch err {
+	case nil:
+		t.Log("Target is tolerant of a malformed 'to' IP and ponged")
+	case discv4test.ErrTimeout:
+		t.Log("Target is strict and dropped the ping with a malformed 'to' IP")
+	default:
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4014
+func NATEchoAccuracy(t *testing.T) {
+	t.Log("Test v4014")
+	observed, echoed, err := v4udp.NATEchoAccuracy(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Observed source %v:%d (tcp %d), echoed %v:%d (tcp %d)", observed.IP, observed.UDP, observed.TCP, echoed.IP, echoed.UDP, echoed.TCP)
+}
+
+//v4015
+func SendUnsolicitedNeighboursUnbonded(t *testing.T) {
+	t.Log("Test v4015")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	if err := v4udp.SendUnsolicitedNeighboursUnbonded(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4016
+func PingWrongSigScope(t *testing.T) {
+	t.Log("Test v4016")
+	if !assertError(t, v4udp.PingWrongSigScope(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil), discv4test.ErrTimeout, "Test failed, target accepted a signature excluding the packet type") {
+		return
+	}
+	t.Log("Target signature scope matches the spec")
+}
+
+//v4017
+func UnsolicitedPongNoBond(t *testing.T) {
+	t.Log("Test v4017")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	assertError(t, v4udp.UnsolicitedPongNoBond(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey), discv4test.ErrTimeout, "Test failed, target bonded off an unsolicited pong")
+}
+
+//v4018
+func PingFromSpoofedAsTarget(t *testing.T) {
+	t.Log("Test v4018")
+	if err := v4udp.PingFromSpoofedAsTarget(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, true, nil); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4019
+func FindnodeChunking(t *testing.T) {
+	t.Log("Test v4019")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	if err := v4udp.FindnodeChunking(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4020
+func AssertNetworkMatch(t *testing.T) {
+	t.Log("Test v4020")
+	if *forkID == "" {
+		t.Skip("No expected fork ID supplied")
+	}
+	expected, err := discv4test.ParseForkID(*forkID)
+	if err != nil {
+		t.Fatalf("Bad -forkID: %v", err)
+	}
+	if err := v4udp.AssertNetworkMatch(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, expected); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4021
+func FindnodeForKnownNeighbour(t *testing.T) {
+	t.Log("Test v4021")
+	if err := v4udp.FindnodeForKnownNeighbour(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4022
+func SendEmptyPacket(t *testing.T) {
+	t.Log("Test v4022")
+	if err := v4udp.SendEmptyPacket(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4023
+func ReversePingHonorsFromPort(t *testing.T) {
+	t.Log("Test v4023")
+	if err := v4udp.ReversePingHonorsFromPort(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4024
+func ENRLargeResponse(t *testing.T) {
+	t.Log("Test v4024")
+	size, err := v4udp.ENRLargeResponse(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Target node record is %d bytes", size)
+}
+
+//v4025
+func PingMaxExpiration(t *testing.T) {
+	t.Log("Test v4025")
+	atMax, aboveMax := v4udp.PingMaxExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	for _, res := range []struct {
+		what string
+		err  error
+	}{{"math.MaxInt64", atMax}, {"math.MaxInt64+1", aboveMax}} {
+		switch res.err {
+		case nil:
+			t.Logf("Target ponged a ping expiring at %s", res.what)
+		case discv4test.ErrTimeout:
+			t.Logf("Target dropped a ping expiring at %s, treating it as expired", res.what)
+		default:
+			fail(t, "Test failed: %v", res.err)
+		}
+	}
+}
+
+//v4026
+func ProtocolReport(t *testing.T) {
+	t.Log("Test v4026")
+	support, err := v4udp.ProtocolReport(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Target protocols: %v", support)
+}
+
+//v4027
+func FindnodeSignedByUnbondedKey(t *testing.T) {
+	t.Log("Test v4027")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	assertError(t, v4udp.FindnodeSignedByUnbondedKey(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey), discv4test.ErrTimeout, "Test failed, target answered a find neighbours signed by an unbonded key")
+}
+
+//v4028
+func FindnodeNoPrivateLeak(t *testing.T) {
+	t.Log("Test v4028")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	if err := v4udp.FindnodeNoPrivateLeak(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4029
+func SendType0Packet(t *testing.T) {
+	t.Log("Test v4029")
+	assertError(t, v4udp.SendType0Packet(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}), discv4test.ErrTimeout, "Test failed, target responded to a packet of the reserved type 0")
+}
+
+//v4030
+func FindnodeZeroTarget(t *testing.T) {
+	t.Log("Test v4030")
+	n, err := v4udp.FindnodeZeroTarget(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Target returned %d neighbours for the zero target", n)
+}
+
+//v4031
+func BondLatency(t *testing.T) {
+	t.Log("Test v4031")
+	timing, err := v4udp.BondLatency(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Bond timing: pong received %v, reverse ping received %v, pong sent %v", timing.PongReceived, timing.ReversePingReceived, timing.PongSent)
+}
+
+//v4032
+func PingCheckPongENRSeq(t *testing.T) {
+	t.Log("Test v4032")
+	seq, present, err := v4udp.PingCheckPongENRSeq(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case present:
+		t.Logf("Target's ENR sequence number is %d", seq)
+	default:
+		t.Log("Target's pong carries no ENR sequence number, it predates EIP-868")
+	}
+}
+
+//v4033
+func PingNonCanonicalRLP(t *testing.T) {
+	t.Log("Test v4033")
+	switch err := v4udp.PingNonCanonicalRLP(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err {
+	case discv4test.ErrTimeout:
+		t.Log("Target is strict: it dropped the ping with a non-canonical expiration")
+	case discv4test.ErrUnsolicitedReply:
+		fail(t, "Test failed: target is lenient, it ponged a ping with a non-canonical expiration")
+	default:
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4034
+func PingVerifyTransport(t *testing.T) {
+	t.Log("Test v4034")
+	if err := v4udp.PingVerifyTransport(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4035
+func FindnodeExpiredAfterBond(t *testing.T) {
+	t.Log("Test v4035")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	bonded, expired := v4udp.FindnodeExpiredAfterBond(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey)
+	if bonded != nil {
+		fail(t, "Test failed: find neighbours with a valid expiration after bonding: %v", bonded)
+	} else {
+		t.Log("Find neighbours with a valid expiration was answered, the bond is good")
+	}
+	if expired != discv4test.ErrTimeout {
+		fail(t, "Test failed: find neighbours past its expiration: got %v, want %v", expired, discv4test.ErrTimeout)
+	} else {
+		t.Log("Find neighbours past its expiration was ignored")
+	}
+}
+
+//v4036
+func PingDuplicateSuppression(t *testing.T) {
+	t.Log("Test v4036")
+	pongs, err := v4udp.PingDuplicateSuppression(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case pongs == 1:
+		t.Log("Target suppresses duplicate pings: 1 pong for 3 identical pings")
+	case pongs == 3:
+		t.Log("Target answers every duplicate ping: 3 pongs for 3 identical pings")
+	default:
+		t.Logf("Target sent %d pongs for 3 identical pings", pongs)
+	}
+}
+
+//v4037
+func FindnodeIPv6Chunking(t *testing.T) {
+	t.Log("Test v4037")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	ipv6, err := v4udp.FindnodeIPv6Chunking(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey)
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case ipv6 == 0:
+		t.Log("Target returned no IPv6 neighbours, so their chunking was not exercised")
+	default:
+		t.Logf("Target returned %d IPv6 neighbours, all within the packet size limit", ipv6)
+	}
+}
+
+//v4038
+func PingLargeTail(t *testing.T) {
+	t.Log("Test v4038")
+	if err := v4udp.PingLargeTail(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4039
+func DoubleFindnode(t *testing.T) {
+	t.Log("Test v4039")
+	first, second, err := v4udp.DoubleFindnode(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v (%d and %d neighbours)", err, first, second)
+	} else {
+		t.Logf("Target answered both find neighbours, with %d and %d neighbours", first, second)
+	}
+}
+
+//v4040
+func PingToPortZero(t *testing.T) {
+	t.Log("Test v4040")
+	if err := v4udp.PingToPortZero(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4041
+func PoisonSelfNeighbour(t *testing.T) {
+	t.Log("Test v4041")
+	found, err := v4udp.PoisonSelfNeighbour(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case !found:
+		t.Log("Target did not list our node, so the poisoned endpoint could not be checked")
+	default:
+		t.Log("Target kept our bonded endpoint over the poisoned one")
+	}
+}
+
+//v4042
+func RePingUpdatesEndpoint(t *testing.T) {
+	t.Log("Test v4042")
+	found, err := v4udp.RePingUpdatesEndpoint(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case !found:
+		t.Log("Target did not list our node, so the updated endpoint could not be checked")
+	default:
+		t.Log("Target lists our node at the endpoint we re-pinged from")
+	}
+}
+
+//v4043
+func DualIdentityPing(t *testing.T) {
+	t.Log("Test v4043")
+	if err := v4udp.DualIdentityPing(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4044
+func LatencyProfile(t *testing.T) {
+	t.Log("Test v4044")
+	//50 pings a second for 2 seconds, well above what a client sees from its peers
+	stats, err := v4udp.LatencyProfile(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, 2*time.Second, 50)
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	} else {
+		t.Logf("Ping latency under load: %v", stats)
+	}
+}
+
+//v4045
+func FindnodeNeighbourLiveness(t *testing.T) {
+	t.Log("Test v4045")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	live, pinged, err := v4udp.FindnodeNeighbourLiveness(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey)
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case pinged == 0:
+		t.Log("Target returned no neighbours other than us, so liveness could not be checked")
+	default:
+		t.Logf("%d of %d neighbours are live (%.0f%%)", live, pinged, 100*float64(live)/float64(pinged))
+	}
+}
+
+//v4046
+func FindnodeMixedFamilyChunking(t *testing.T) {
+	t.Log("Test v4046")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	ipv4, ipv6, err := v4udp.FindnodeMixedFamilyChunking(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey, nil)
+	switch {
+	case err != nil:
+		fail(t, "Test failed: %v", err)
+	case ipv4 == 0 || ipv6 == 0:
+		t.Logf("Target returned %d IPv4 and %d IPv6 neighbours, so mixed chunking was not exercised", ipv4, ipv6)
+	default:
+		t.Logf("Target returned %d IPv4 and %d IPv6 neighbours, all within the packet size limit", ipv4, ipv6)
+	}
+}
+
+//v4047
+func PingWeirdTail(t *testing.T) {
+	t.Log("Test v4047")
+	if err := v4udp.PingWeirdTail(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4048
+func DetectOneWayBonding(t *testing.T) {
+	t.Log("Test v4048")
+	if err := v4udp.DetectOneWayBonding(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}); err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4049
+func PongExpiration(t *testing.T) {
+	t.Log("Test v4049")
+	ahead, err := v4udp.PongExpiration(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Target's pong expires in %v", ahead)
+}
+
+//v4050
+func KeyspaceCoverage(t *testing.T) {
+	t.Log("Test v4050")
+	stats, err := v4udp.KeyspaceCoverage(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, 16)
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Keyspace coverage: %v", stats)
+}
+
+//v4051
+func ReplayFindnode(t *testing.T) {
+	t.Log("Test v4051")
+	targetEncKey := discv4test.EncodePubkey(targetnode.Pubkey())
+	unexpired, err := v4udp.ReplayFindnode(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, targetEncKey)
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	if unexpired {
+		t.Log("Target answered a replay of an unexpired findnode from another port")
+	} else {
+		t.Log("Target ignored a replay of an unexpired findnode from another port")
+	}
+}
+
+//v4052
+func PongExpirationFreshness(t *testing.T) {
+	t.Log("Test v4052")
+	delta, err := v4udp.PongExpirationFreshness(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, 2*time.Second)
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	t.Logf("Pongs 2s apart expire %v apart", delta)
+}
+
+//v4053
+func FindnodeForRequesterSelf(t *testing.T) {
+	t.Log("Test v4053")
+	others, includesSelf, err := v4udp.FindnodeForRequesterSelf(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+	if includesSelf {
+		t.Logf("Target returned us and %d other nodes for our own ID", others)
+	} else {
+		t.Logf("Target returned %d other nodes for our own ID, leaving us out", others)
+	}
+}
+
+//v4054
+func PingIdenticalFromTo(t *testing.T) {
+	t.Log("Test v4054")
+	asTarget, asUs := v4udp.PingIdenticalFromTo(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()})
+	for _, res := range []struct {
+		what string
+		err  error
+	}{{"the target's", asTarget}, {"our", asUs}} {
+		if res.err != nil {
+			fail(t, "Test failed with 'from' and 'to' both %s endpoint: %v", res.what, res.err)
+		}
+	}
+}
+
+//v4055
+func TargetKeyRotation(t *testing.T) {
+	t.Log("Test v4055")
+	if *targetNodeKey == "" || *targetID == "" {
+		t.Skip("no -targetNodeKey and -targetID to restart the target with a new key")
+	}
+	connectToDockerDaemon(t)
+	if t.Failed() {
+		return
+	}
+	// Removing the key file before the restart makes the client generate a new one. The
+	// target is back once it accepts RLPx connections, which touches no discovery state.
+	rotate := func() error {
+		exec, err := daemon.CreateExec(docker.CreateExecOptions{Container: *targetID, Cmd: []string{"rm", "-f", *targetNodeKey}})
+		if err != nil {
+			return err
+		}
+		if err := daemon.StartExec(exec.ID, docker.StartExecOptions{}); err != nil {
+			return err
+		}
+		if err := daemon.RestartContainer(*targetID, 10); err != nil {
+			return err
+		}
+		addr := (&net.TCPAddr{IP: targetnode.IP(), Port: targetnode.TCP()}).String()
+		for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(time.Second) {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				return conn.Close()
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("target not listening on %s after the restart: %v", addr, err)
+			}
+		}
+	}
+	key, err := v4udp.TargetKeyRotation(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, rotate)
+	if key != nil {
+		// Later runs of the suite must reach the target under its new node ID.
+		targetnode = enode.NewV4(key, targetnode.IP(), targetnode.TCP(), targetnode.UDP())
+		t.Logf("Target's new node ID is %x", targetnode.ID().Bytes()[:8])
+	}
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+	}
+}
+
+//v4056
+func FindnodeAfterInboundPingOnly(t *testing.T) {
+	t.Log("Test v4056")
+	//the target only pings the fresh identity when it next looks up nodes through the relay
+	answered, err := v4udp.FindnodeAfterInboundPingOnly(targetnode.ID(), &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}, time.Minute)
+	if err != nil {
+		fail(t, "Test failed: %v", err)
+		return
+	}
+	if answered {
+		t.Log("Target answered find neighbours once its own ping was ponged")
+	} else {
+		t.Log("Target did not answer find neighbours with only its own ping ponged")
 	}
 }
 
@@ -241,11 +1663,54 @@ func TestRLPx(t *testing.T) {
 		t.Run("basic", func(t *testing.T) {
 
 		})
+
+		t.Run("snappyNegotiation", func(t *testing.T) {
+			//TODO: read the target's Hello, check the advertised version and, if >= 5, send
+			//a snappy-compressed message and verify the target handles it.
+			t.Skip("depends on the RLPx handshake test")
+		})
 	})
 
 }
 
-func setupv4UDP() V4Udp {
+// natTimeout bounds the external IP query to the -nat device, which may never answer on a
+// network without a default route.
+const natTimeout = 5 * time.Second
+
+// announceAddr returns the address to announce for a socket bound to laddr. If natm is not nil,
+// the port is mapped through it and its external IP is announced. A device that does not give
+// its external IP within timeout is given up on and laddr is announced, so that the suite runs
+// on isolated networks too.
+func announceAddr(natm nat.Interface, laddr *net.UDPAddr, timeout time.Duration) *net.UDPAddr {
+	if natm == nil {
+		return laddr
+	}
+	if !laddr.IP.IsLoopback() {
+		go nat.Map(natm, nil, "udp", laddr.Port, laddr.Port, "ethereum discovery")
+	}
+	// TODO: react to external IP changes over time.
+	type result struct {
+		ip  net.IP
+		err error
+	}
+	ext := make(chan result, 1)
+	go func() {
+		ip, err := natm.ExternalIP()
+		ext <- result{ip, err}
+	}()
+	select {
+	case r := <-ext:
+		if r.err == nil {
+			return &net.UDPAddr{IP: r.ip, Port: laddr.Port}
+		}
+		log.Warn("No external IP from NAT device", "nat", natm, "announce", laddr, "err", r.err)
+	case <-time.After(timeout):
+		log.Warn("No external IP from NAT device in time", "nat", natm, "timeout", timeout, "announce", laddr)
+	}
+	return laddr
+}
+
+func setupv4UDP() *discv4test.V4Udp {
 	//Resolve an address (eg: ":port") to a UDP endpoint.
 	addr, err := net.ResolveUDPAddr("udp", *listenPort)
 	if err != nil {
@@ -253,7 +1718,7 @@ func setupv4UDP() V4Udp {
 	}
 
 	//Create a UDP connection
-	conn, err := net.ListenUDP("udp", addr)
+	conn, err := newConn(addr)
 	if err != nil {
 		utils.Fatalf("-ListenUDP: %v", err)
 	}
@@ -264,34 +1729,51 @@ func setupv4UDP() V4Udp {
 	if err != nil {
 		utils.Fatalf("-nat: %v", err)
 	}
-	realaddr := conn.LocalAddr().(*net.UDPAddr)
-	if natm != nil {
-		if !realaddr.IP.IsLoopback() {
-			go nat.Map(natm, nil, "udp", realaddr.Port, realaddr.Port, "ethereum discovery")
-		}
-		// TODO: react to external IP changes over time.
-		if ext, err := natm.ExternalIP(); err == nil {
-			realaddr = &net.UDPAddr{IP: ext, Port: realaddr.Port}
-		}
+	realaddr, err := discv4test.LocalUDPAddr(conn)
+	if err != nil {
+		utils.Fatalf("-listenPort: %v", err)
 	}
+	log.Info("Listening for discovery packets", "addr", realaddr)
+	realaddr = announceAddr(natm, realaddr, natTimeout)
 
-	nodeKey, err = crypto.GenerateKey()
+	rnd := rand.New(rand.NewSource(*seed))
+	nodeKey, err = discv4test.GenerateKey(rnd)
 
 	if err != nil {
 		utils.Fatalf("could not generate key: %v", err)
 	}
 
-	cfg := Config{
+	cfg := discv4test.Config{
 		PrivateKey:   nodeKey,
 		AnnounceAddr: realaddr,
 		NetRestrict:  restrictList,
+		Rand:         rnd,
+		Loss:         *loss,
+		Jitter:       *jitter,
+		ConnFactory:  newConn,
+		WriteRetries: 3,
+	}
+	cfg.MaxPongExpiration = *maxPongExpiration
+	//the chunking tests only report oversized neighbours packets if they are read whole
+	cfg.ReadBufferSize = *readBuffer
+	if pinned != nil {
+		cfg.PinnedPubkey = pinned
+		cfg.PinnedAddr = &net.UDPAddr{IP: targetnode.IP(), Port: targetnode.UDP()}
 	}
 
-	var v4UDP *V4Udp
+	var v4UDP *discv4test.V4Udp
 
-	if v4UDP, err = ListenUDP(conn, cfg); err != nil {
+	if v4UDP, err = discv4test.ListenUDP(conn, cfg); err != nil {
 		panic(err)
 	}
+	//an interrupted suite stops the test in progress by closing the socket it waits on
+	go func() {
+		select {
+		case <-shutdown:
+			v4UDP.Close()
+		case <-v4UDP.Done():
+		}
+	}()
 
-	return *v4UDP
+	return v4UDP
 }
@@ -0,0 +1,104 @@
+package discv4test
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// coverageBuckets is the number of equal slices of the ID space, by the top bits of the ID,
+// that KeyspaceCoverage spreads its nodes over to measure clustering.
+const coverageBuckets = 16
+
+// KeyspaceStats summarises the nodes a target returned for findnodes spread across the ID
+// space, as measured by KeyspaceCoverage.
+type KeyspaceStats struct {
+	Samples, Answered  int
+	Returned, Distinct int
+	// Uniformity is the entropy of the distinct nodes over coverageBuckets slices of the ID
+	// space, normalised to 1 if they are spread evenly and 0 if they all fall in one slice.
+	Uniformity float64
+}
+
+func (s KeyspaceStats) String() string {
+	return fmt.Sprintf("%d/%d findnodes answered, %d distinct of %d nodes returned, uniformity %.2f",
+		s.Answered, s.Samples, s.Distinct, s.Returned, s.Uniformity)
+}
+
+// KeyspaceCoverage bonds with the target and calls find neighbours for samples targets, one in
+// each of samples equal slices of the ID space, to assess the health of its routing table. A
+// healthy table returns many distinct nodes, spread across the ID space. An isolated or broken
+// one returns few nodes, or the same ones whatever the target. The error is ErrTimeout if no
+// findnode was answered.
+func (t *V4Udp) KeyspaceCoverage(toid enode.ID, toaddr *net.UDPAddr, samples int) (KeyspaceStats, error) {
+	stats := KeyspaceStats{Samples: samples}
+	if samples < 1 || samples > 1<<16 {
+		return stats, fmt.Errorf("%d samples not between 1 and %d", samples, 1<<16)
+	}
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return stats, err
+	}
+
+	distinct := make(map[enode.ID]bool)
+	for i := 0; i < samples; i++ {
+		nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+			Target:     t.targetInSlice(i, samples),
+			Expiration: uint64(time.Now().Add(expiration).Unix()),
+		})
+		if err != nil {
+			return stats, err
+		}
+		if received {
+			stats.Answered++
+		}
+		stats.Returned += len(nodes)
+		for _, rn := range nodes {
+			distinct[rn.ID.id()] = true
+		}
+	}
+	if stats.Answered == 0 {
+		return stats, ErrTimeout
+	}
+	stats.Distinct = len(distinct)
+	ids := make([]enode.ID, 0, len(distinct))
+	for id := range distinct {
+		ids = append(ids, id)
+	}
+	stats.Uniformity = uniformity(ids)
+	return stats, nil
+}
+
+// targetInSlice returns a random findnode target whose ID lies in slice i of n equal slices of
+// the ID space, by the top 16 bits of the ID.
+func (t *V4Udp) targetInSlice(i, n int) EncPubkey {
+	var target EncPubkey
+	for {
+		t.rand.Read(target[:])
+		id := target.id()
+		if (int(id[0])<<8|int(id[1]))*n>>16 == i {
+			return target
+		}
+	}
+}
+
+// uniformity returns the normalised entropy of ids over coverageBuckets slices of the ID space.
+func uniformity(ids []enode.ID) float64 {
+	if len(ids) == 0 {
+		return 0
+	}
+	var counts [coverageBuckets]int
+	for _, id := range ids {
+		counts[int(id[0])*coverageBuckets>>8]++
+	}
+	var entropy float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(ids))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy / math.Log2(coverageBuckets)
+}
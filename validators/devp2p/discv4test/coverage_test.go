@@ -0,0 +1,57 @@
+package discv4test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// TestKeyspaceCoverage checks that a responder with a large table returns different nodes for
+// targets across the ID space, and one with a small table the same few nodes whatever the
+// target.
+func TestKeyspaceCoverage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		neighbours   int
+		wantDistinct func(int) bool
+	}{
+		{neighbours: 8 * bucketSize, wantDistinct: func(d int) bool { return d > bucketSize }},
+		{neighbours: 3, wantDistinct: func(d int) bool { return d == 3 }},
+	}
+	for _, test := range tests {
+		r, toid, toaddr := newResponder(t, rnd, WithNeighbours(testNeighbours(rnd, test.neighbours)))
+		initiator := newLoopbackUDP(t, rnd, 0, 0)
+		stats, err := initiator.KeyspaceCoverage(toid, toaddr, 8)
+		r.Close()
+		initiator.Close()
+		if err != nil {
+			t.Fatalf("%d neighbours: got %v", test.neighbours, err)
+		}
+		if stats.Answered != 8 || !test.wantDistinct(stats.Distinct) {
+			t.Errorf("%d neighbours: got %v", test.neighbours, stats)
+		}
+	}
+}
+
+// TestUniformity checks the clustering metric at its extremes.
+func TestUniformity(t *testing.T) {
+	var spread, clustered []enode.ID
+	for i := 0; i < coverageBuckets; i++ {
+		var id enode.ID
+		id[0] = byte(i << 4)
+		spread = append(spread, id)
+		id[1] = byte(i)
+		id[0] = 0
+		clustered = append(clustered, id)
+	}
+	if u := uniformity(spread); u != 1 {
+		t.Errorf("spread: got %v, want 1", u)
+	}
+	if u := uniformity(clustered); u != 0 {
+		t.Errorf("clustered: got %v, want 0", u)
+	}
+	if u := uniformity(nil); u != 0 {
+		t.Errorf("none: got %v, want 0", u)
+	}
+}
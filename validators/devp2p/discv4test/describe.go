@@ -0,0 +1,119 @@
+package discv4test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Description is everything discovery v4 reveals about a target. Fields the target did not
+// reveal are left empty, and the failures that kept them empty are listed in Problems.
+type Description struct {
+	ID        string          `json:"id"`
+	Addr      string          `json:"addr"`
+	Protocols ProtocolSupport `json:"protocols"`
+	ENRSeq    *uint64         `json:"enrSeq,omitempty"` // sequence number in the pong, nil if absent
+	Record    string          `json:"record,omitempty"` // the target's node record, as enr:...
+	RecordIP  net.IP          `json:"recordIP,omitempty"`
+	RecordUDP int             `json:"recordUDP,omitempty"`
+	RecordTCP int             `json:"recordTCP,omitempty"`
+	ForkID    string          `json:"forkID,omitempty"`   // from the 'eth' entry of the record
+	Observed  *RPCEndpoint    `json:"observed,omitempty"` // our endpoint, as we sent from it
+	Echoed    *RPCEndpoint    `json:"echoed,omitempty"`   // our endpoint, as the target saw it
+	Problems  []string        `json:"problems,omitempty"`
+}
+
+// Describe gathers everything discovery v4 reveals about the target: the protocols it
+// supports, its node record and fork ID, and how it sees our endpoint. Every probe is run
+// even if an earlier one failed, so that a partial description is still returned. The
+// failures are recorded in the description rather than returned.
+func (t *V4Udp) Describe(toid enode.ID, toaddr *net.UDPAddr) *Description {
+	d := &Description{ID: toid.String(), Addr: toaddr.String()}
+	problem := func(what string, err error) {
+		d.Problems = append(d.Problems, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	s, err := t.ProtocolReport(toid, toaddr)
+	d.Protocols = s
+	if err != nil {
+		problem("protocol probe", err)
+	}
+	if !s.V4 {
+		problem("ping", ErrTimeout)
+		return d
+	}
+
+	if seq, present, err := t.PingCheckPongENRSeq(toid, toaddr); err != nil {
+		problem("pong ENR sequence number", err)
+	} else if present {
+		d.ENRSeq = &seq
+	}
+
+	observed, echoed, err := t.NATEchoAccuracy(toid, toaddr)
+	if observed.IP != nil {
+		d.Observed = &observed
+	}
+	if echoed.IP != nil {
+		d.Echoed = &echoed
+	}
+	if err != nil {
+		problem("endpoint echo", err)
+	}
+
+	if !s.ENR {
+		return d
+	}
+	n, err := t.RequestENR(toid, toaddr)
+	if err != nil {
+		problem("node record", err)
+		return d
+	}
+	d.Record = n.String()
+	d.RecordIP, d.RecordUDP, d.RecordTCP = n.IP(), n.UDP(), n.TCP()
+	var eth ethEntry
+	if err := n.Load(&eth); err != nil {
+		problem("fork ID", fmt.Errorf("%v: %v", ErrNoEthEntry, err))
+	} else {
+		d.ForkID = eth.ForkID.String()
+	}
+	return d
+}
+
+// String formats the description as a human-readable block.
+func (d *Description) String() string {
+	var b strings.Builder
+	line := func(label, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "%-14s "+format+"\n", append([]interface{}{label + ":"}, args...)...)
+	}
+	line("Node", "%s", d.ID)
+	line("Address", "%s", d.Addr)
+	line("Protocols", "%v", d.Protocols)
+	if d.ENRSeq != nil {
+		line("ENR seq", "%d", *d.ENRSeq)
+	} else {
+		line("ENR seq", "not in pong")
+	}
+	if d.Record != "" {
+		line("Record", "%s", d.Record)
+		line("Record addr", "%v udp %d tcp %d", d.RecordIP, d.RecordUDP, d.RecordTCP)
+	} else {
+		line("Record", "not available")
+	}
+	if d.ForkID != "" {
+		line("Fork ID", "%s", d.ForkID)
+	} else {
+		line("Fork ID", "not available")
+	}
+	if d.Observed != nil {
+		line("Our endpoint", "%v udp %d tcp %d", d.Observed.IP, d.Observed.UDP, d.Observed.TCP)
+	}
+	if d.Echoed != nil {
+		line("Seen as", "%v udp %d tcp %d", d.Echoed.IP, d.Echoed.UDP, d.Echoed.TCP)
+	}
+	for _, p := range d.Problems {
+		line("Problem", "%s", p)
+	}
+	return b.String()
+}
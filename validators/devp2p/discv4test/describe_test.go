@@ -0,0 +1,57 @@
+package discv4test
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// TestDescribe describes a loopback listener, which answers pings but not ENR requests, and
+// checks that what it reveals is filled in and what it does not is reported as unavailable.
+func TestDescribe(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	//cache the bond rather than wait out the bonding delay
+	source.bondMu.Lock()
+	source.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	source.bondMu.Unlock()
+
+	d := source.Describe(toid, target.conn.LocalAddr().(*net.UDPAddr))
+	if !d.Protocols.V4 || d.Protocols.ENR {
+		t.Errorf("got protocols %v, want v4 without ENR", d.Protocols)
+	}
+	if d.Record != "" || d.ForkID != "" || d.ENRSeq != nil {
+		t.Errorf("got record %q, fork ID %q, seq %v from a target without a record", d.Record, d.ForkID, d.ENRSeq)
+	}
+	if d.Observed == nil || d.Echoed == nil {
+		t.Errorf("got observed %v, echoed %v, want both", d.Observed, d.Echoed)
+	}
+	if len(d.Problems) != 0 {
+		t.Errorf("got problems %v", d.Problems)
+	}
+	if text := d.String(); !strings.Contains(text, "Record:        not available") {
+		t.Errorf("text does not report the record as unavailable:\n%s", text)
+	}
+
+	enc, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("could not encode description: %v", err)
+	}
+	var dec Description
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		t.Fatalf("could not decode description: %v", err)
+	}
+	if dec.ID != d.ID || dec.Protocols.V4 != d.Protocols.V4 {
+		t.Errorf("JSON round trip changed the description:\n%s", enc)
+	}
+}
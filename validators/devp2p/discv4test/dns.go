@@ -0,0 +1,218 @@
+package discv4test
+
+import (
+	"crypto/ecdsa"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// EIP-1459 entry prefixes
+const (
+	treeRootPrefix   = "enrtree-root:v1"
+	treeBranchPrefix = "enrtree-branch:"
+	treeLinkPrefix   = "enrtree://"
+	treeENRPrefix    = "enr:"
+)
+
+var (
+	ErrBadTreeLink = errors.New("invalid enrtree:// URL")
+	ErrNoTreeRoot  = errors.New("no enrtree root record")
+	ErrBadTreeRoot = errors.New("invalid enrtree root record")
+	ErrBadTreeSig  = errors.New("enrtree root signature does not match the tree key")
+	ErrBadTreeHash = errors.New("enrtree entry does not match its hash")
+
+	// b32 encodes tree keys and entry hashes, which are written without padding.
+	b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// LookupTXT fetches the TXT records of a domain, as net.LookupTXT does.
+type LookupTXT func(domain string) ([]string, error)
+
+// ResolveTree fetches the EIP-1459 node list published at url, an enrtree://<key>@<domain>
+// URL, and returns the nodes it lists. The root record must be signed by the key in the URL.
+// Trees linked from the root are resolved as well. Entries that fail to resolve are logged
+// and skipped, so that a partly broken tree still yields the nodes that can be reached.
+func ResolveTree(url string, lookup LookupTXT) ([]*enode.Node, error) {
+	return resolveTree(url, lookup, make(map[string]bool))
+}
+
+func resolveTree(url string, lookup LookupTXT, visited map[string]bool) ([]*enode.Node, error) {
+	pubkey, domain, err := parseTreeLink(url)
+	if err != nil {
+		return nil, err
+	}
+	visited[domain] = true
+
+	enrRoot, linkRoot, err := resolveTreeRoot(lookup, domain, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*enode.Node
+	for _, e := range resolveSubtree(lookup, domain, enrRoot) {
+		if !strings.HasPrefix(e, treeENRPrefix) {
+			log.Warn("Skipping non-ENR entry in enrtree ENR subtree", "domain", domain, "entry", e)
+			continue
+		}
+		n, err := enode.Parse(enode.ValidSchemes, e)
+		if err != nil {
+			log.Warn("Skipping invalid ENR in enrtree", "domain", domain, "err", err)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	for _, e := range resolveSubtree(lookup, domain, linkRoot) {
+		_, linked, err := parseTreeLink(e)
+		if err != nil {
+			log.Warn("Skipping invalid link in enrtree", "domain", domain, "err", err)
+			continue
+		}
+		if visited[linked] {
+			continue
+		}
+		linkedNodes, err := resolveTree(e, lookup, visited)
+		if err != nil {
+			log.Warn("Skipping unresolvable linked enrtree", "domain", linked, "err", err)
+			continue
+		}
+		nodes = append(nodes, linkedNodes...)
+	}
+	return nodes, nil
+}
+
+// parseTreeLink splits an enrtree://<key>@<domain> URL into the tree key and domain.
+func parseTreeLink(url string) (*ecdsa.PublicKey, string, error) {
+	if !strings.HasPrefix(url, treeLinkPrefix) {
+		return nil, "", ErrBadTreeLink
+	}
+	parts := strings.SplitN(url[len(treeLinkPrefix):], "@", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, "", ErrBadTreeLink
+	}
+	keybytes, err := b32.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: bad key encoding: %v", ErrBadTreeLink, err)
+	}
+	pubkey, err := crypto.DecompressPubkey(keybytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: bad key: %v", ErrBadTreeLink, err)
+	}
+	return pubkey, parts[1], nil
+}
+
+// resolveTreeRoot fetches the root record of the tree at domain, checks its signature
+// against pubkey and returns the root hashes of the ENR and link subtrees.
+func resolveTreeRoot(lookup LookupTXT, domain string, pubkey *ecdsa.PublicKey) (enrRoot, linkRoot string, err error) {
+	txts, err := lookup(domain)
+	if err != nil {
+		return "", "", err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, treeRootPrefix) {
+			return parseTreeRoot(txt, pubkey)
+		}
+	}
+	return "", "", ErrNoTreeRoot
+}
+
+// parseTreeRoot parses 'enrtree-root:v1 e=<enr-root> l=<link-root> seq=<n> sig=<sig>'.
+// The signature covers the record up to the sig field.
+func parseTreeRoot(txt string, pubkey *ecdsa.PublicKey) (enrRoot, linkRoot string, err error) {
+	var (
+		seq    uint64
+		sigstr string
+	)
+	fields := strings.Fields(txt)
+	if len(fields) != 5 || fields[0] != treeRootPrefix {
+		return "", "", ErrBadTreeRoot
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return "", "", ErrBadTreeRoot
+		}
+		switch kv[0] {
+		case "e":
+			enrRoot = kv[1]
+		case "l":
+			linkRoot = kv[1]
+		case "seq":
+			if seq, err = strconv.ParseUint(kv[1], 10, 64); err != nil {
+				return "", "", ErrBadTreeRoot
+			}
+		case "sig":
+			sigstr = kv[1]
+		default:
+			return "", "", ErrBadTreeRoot
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigstr)
+	if err != nil || len(sig) != 65 {
+		return "", "", ErrBadTreeRoot
+	}
+	signed := fmt.Sprintf("%s e=%s l=%s seq=%d", treeRootPrefix, enrRoot, linkRoot, seq)
+	if !crypto.VerifySignature(crypto.FromECDSAPub(pubkey), crypto.Keccak256([]byte(signed)), sig[:64]) {
+		return "", "", ErrBadTreeSig
+	}
+	return enrRoot, linkRoot, nil
+}
+
+// resolveSubtree walks the subtree whose root entry has the given hash and returns its
+// leaf entries. Branches are followed breadth first.
+func resolveSubtree(lookup LookupTXT, domain, root string) []string {
+	var (
+		leaves []string
+		queue  = []string{root}
+		seen   = make(map[string]bool)
+	)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		e, err := resolveTreeEntry(lookup, domain, hash)
+		if err != nil {
+			log.Warn("Skipping unresolvable enrtree entry", "domain", domain, "hash", hash, "err", err)
+			continue
+		}
+		if strings.HasPrefix(e, treeBranchPrefix) {
+			for _, child := range strings.Split(e[len(treeBranchPrefix):], ",") {
+				if child != "" {
+					queue = append(queue, child)
+				}
+			}
+			continue
+		}
+		leaves = append(leaves, e)
+	}
+	return leaves
+}
+
+// resolveTreeEntry fetches the entry at <hash>.<domain> and checks it matches its hash, the
+// base32 encoding of the first 16 bytes of its keccak256 hash.
+func resolveTreeEntry(lookup LookupTXT, domain, hash string) (string, error) {
+	txts, err := lookup(hash + "." + domain)
+	if err != nil {
+		return "", err
+	}
+	for _, txt := range txts {
+		if treeEntryHash(txt) == hash {
+			return txt, nil
+		}
+	}
+	return "", ErrBadTreeHash
+}
+
+func treeEntryHash(e string) string {
+	return b32.EncodeToString(crypto.Keccak256([]byte(e))[:16])
+}
@@ -0,0 +1,121 @@
+package discv4test
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+// testTree is an in-memory DNS zone holding EIP-1459 trees.
+type testTree map[string]string
+
+func (tt testTree) lookup(domain string) ([]string, error) {
+	if txt, ok := tt[domain]; ok {
+		return []string{txt}, nil
+	}
+	return nil, fmt.Errorf("no TXT record for %s", domain)
+}
+
+// add stores entry under its hash in domain and returns the hash.
+func (tt testTree) add(domain, entry string) string {
+	hash := treeEntryHash(entry)
+	tt[hash+"."+domain] = entry
+	return hash
+}
+
+// addRoot signs and stores the root of a tree at domain, returning the tree's URL.
+func (tt testTree) addRoot(domain string, key *ecdsa.PrivateKey, enrRoot, linkRoot string) (string, error) {
+	signed := fmt.Sprintf("%s e=%s l=%s seq=1", treeRootPrefix, enrRoot, linkRoot)
+	sig, err := crypto.Sign(crypto.Keccak256([]byte(signed)), key)
+	if err != nil {
+		return "", err
+	}
+	tt[domain] = signed + " sig=" + base64.RawURLEncoding.EncodeToString(sig)
+	return treeLinkPrefix + b32.EncodeToString(crypto.CompressPubkey(&key.PublicKey)) + "@" + domain, nil
+}
+
+func testTreeNode(t *testing.T, rnd *rand.Rand) string {
+	key, err := GenerateKey(rnd)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	var r enr.Record
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatalf("could not sign record: %v", err)
+	}
+	n, err := enode.New(enode.ValidSchemes, &r)
+	if err != nil {
+		t.Fatalf("could not create node: %v", err)
+	}
+	return n.String()
+}
+
+// TestResolveTree resolves a tree with two nodes and a link to a second tree with one more.
+func TestResolveTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tt := make(testTree)
+
+	linkedKey, _ := GenerateKey(rnd)
+	linkedENR := tt.add("linked.example.org", testTreeNode(t, rnd))
+	linkedURL, err := tt.addRoot("linked.example.org", linkedKey, linkedENR, tt.add("linked.example.org", treeBranchPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := GenerateKey(rnd)
+	branch := treeBranchPrefix + tt.add("nodes.example.org", testTreeNode(t, rnd)) + "," + tt.add("nodes.example.org", testTreeNode(t, rnd))
+	// an entry that was never published is skipped
+	branch += ",AAAAAAAAAAAAAAAAAAAAAAAAAA"
+	url, err := tt.addRoot("nodes.example.org", key, tt.add("nodes.example.org", branch), tt.add("nodes.example.org", linkedURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := ResolveTree(url, tt.lookup)
+	if err != nil {
+		t.Fatalf("could not resolve tree: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("got %d nodes, want 3", len(nodes))
+	}
+}
+
+// TestResolveTreeBadSignature checks that a root not signed by the URL's key is rejected.
+func TestResolveTreeBadSignature(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tt := make(testTree)
+
+	key, _ := GenerateKey(rnd)
+	otherKey, _ := GenerateKey(rnd)
+	enrRoot := tt.add("nodes.example.org", testTreeNode(t, rnd))
+	if _, err := tt.addRoot("nodes.example.org", otherKey, enrRoot, enrRoot); err != nil {
+		t.Fatal(err)
+	}
+	url := treeLinkPrefix + b32.EncodeToString(crypto.CompressPubkey(&key.PublicKey)) + "@nodes.example.org"
+
+	if _, err := ResolveTree(url, tt.lookup); err != ErrBadTreeSig {
+		t.Fatalf("got %v, want %v", err, ErrBadTreeSig)
+	}
+}
+
+// TestParseTreeLink checks that malformed enrtree URLs are rejected.
+func TestParseTreeLink(t *testing.T) {
+	for _, url := range []string{
+		"",
+		"enr:abc",
+		"enrtree://nodes.example.org",
+		"enrtree://AAAA@",
+		"enrtree://not-base32@nodes.example.org",
+	} {
+		if _, _, err := parseTreeLink(url); err == nil || !strings.HasPrefix(err.Error(), ErrBadTreeLink.Error()) {
+			t.Errorf("%q: got %v, want %v", url, err, ErrBadTreeLink)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package discv4test
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// LookupIP resolves a hostname to its IP addresses, as net.LookupIP does.
+type LookupIP func(host string) ([]net.IP, error)
+
+// ResolveHost returns the addresses of host, which may be a hostname or an IP literal. The
+// addresses of the preferred family come first, otherwise the resolver's order is kept.
+func ResolveHost(host string, lookup LookupIP, preferIPv6 bool) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return isIPv6(ips[i]) == preferIPv6 && isIPv6(ips[j]) != preferIPv6
+	})
+	return ips, nil
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+// ParseV4Host parses an enode URL whose host may be a hostname rather than an IP. The host
+// is resolved with ResolveHost, and the node is returned at the first address along with
+// all the addresses found.
+func ParseV4Host(rawurl string, lookup LookupIP, preferIPv6 bool) (*enode.Node, []net.IP, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "enode" || net.ParseIP(u.Hostname()) != nil {
+		n, err := enode.ParseV4(rawurl)
+		if err != nil {
+			return nil, nil, err
+		}
+		return n, []net.IP{n.IP()}, nil
+	}
+	ips, err := ResolveHost(u.Hostname(), lookup, preferIPv6)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Host = net.JoinHostPort(ips[0].String(), u.Port())
+	n, err := enode.ParseV4(u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, ips, nil
+}
+
+// FirstReachable pings the target at each of ips in turn and returns the first address it
+// answers on. The error is ErrTimeout if it answers on none of them.
+func (t *V4Udp) FirstReachable(toid enode.ID, ips []net.IP, port int) (net.IP, error) {
+	for _, ip := range ips {
+		switch err := t.Ping(toid, &net.UDPAddr{IP: ip, Port: port}, true, nil); err {
+		case nil:
+			return ip, nil
+		case ErrTimeout, ErrUnknownNode:
+		default:
+			return nil, err
+		}
+	}
+	return nil, ErrTimeout
+}
@@ -0,0 +1,67 @@
+package discv4test
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// TestResolveHost checks that IP literals are used as they are, and that resolved addresses
+// of the preferred family are ordered first.
+func TestResolveHost(t *testing.T) {
+	v4a, v4b, v6 := net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 2}, net.ParseIP("2001:db8::1")
+	lookup := func(host string) ([]net.IP, error) {
+		if host != "node.example.org" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{v4a, v6, v4b}, nil
+	}
+	tests := []struct {
+		host       string
+		preferIPv6 bool
+		want       []net.IP
+	}{
+		{"192.0.2.9", true, []net.IP{net.ParseIP("192.0.2.9")}},
+		{"node.example.org", false, []net.IP{v4a, v4b, v6}},
+		{"node.example.org", true, []net.IP{v6, v4a, v4b}},
+	}
+	for _, test := range tests {
+		ips, err := ResolveHost(test.host, lookup, test.preferIPv6)
+		if err != nil {
+			t.Fatalf("%s: %v", test.host, err)
+		}
+		if len(ips) != len(test.want) {
+			t.Fatalf("%s: got %v, want %v", test.host, ips, test.want)
+		}
+		for i := range ips {
+			if !ips[i].Equal(test.want[i]) {
+				t.Errorf("%s (prefer IPv6 %t): got %v, want %v", test.host, test.preferIPv6, ips, test.want)
+				break
+			}
+		}
+	}
+	if _, err := ResolveHost("other.example.org", lookup, false); err == nil {
+		t.Error("no error for an unresolvable host")
+	}
+}
+
+// TestFirstReachable checks that the first address the target answers on is picked, skipping
+// one it does not answer on.
+func TestFirstReachable(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	port := target.conn.LocalAddr().(*net.UDPAddr).Port
+	ip, err := source.FirstReachable(toid, []net.IP{{127, 0, 0, 2}, {127, 0, 0, 1}}, port)
+	if err != nil || !ip.Equal(net.IP{127, 0, 0, 1}) {
+		t.Fatalf("got %v, %v, want 127.0.0.1", ip, err)
+	}
+	if _, err := source.FirstReachable(toid, []net.IP{{127, 0, 0, 2}}, port); err != ErrTimeout {
+		t.Fatalf("unreachable: got %v, want %v", err, ErrTimeout)
+	}
+}
@@ -0,0 +1,117 @@
+package discv4test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// LatencyStats summarises the pong latencies of a LatencyProfile run. A ping whose pong did
+// not arrive within the response timeout counts as lost.
+type LatencyStats struct {
+	Sent, Received int
+	P50, P95, P99  time.Duration
+	Max            time.Duration
+}
+
+// Loss returns the fraction of pings that went unanswered.
+func (s LatencyStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+func (s LatencyStats) String() string {
+	return fmt.Sprintf("%d/%d pongs (%.1f%% lost), p50 %v, p95 %v, p99 %v, max %v",
+		s.Received, s.Sent, 100*s.Loss(), s.P50, s.P95, s.P99, s.Max)
+}
+
+// LatencyProfile pings the target at rate pings per second for duration, and measures the round
+// trip of each ping to characterise how its responder holds up under sustained load. Every ping
+// carries a random nonce as an extra field, so that each has its own hash and its pong can be
+// matched by reply token while many are outstanding. The error is ErrTimeout if no ping was
+// answered at all, or ErrClosed if t is closed before duration is up, as it is when the suite
+// is interrupted.
+func (t *V4Udp) LatencyProfile(toid enode.ID, toaddr *net.UDPAddr, duration time.Duration, rate float64) (LatencyStats, error) {
+	var (
+		stats     LatencyStats
+		mu        sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	if !(rate > 0) {
+		return stats, fmt.Errorf("ping rate %v is not positive", rate)
+	}
+	tick := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer tick.Stop()
+
+	for end := time.Now().Add(duration); time.Now().Before(end); <-tick.C {
+		select {
+		case <-t.closing:
+			wg.Wait()
+			return stats, ErrClosed
+		default:
+		}
+		nonce, err := rlp.EncodeToBytes(t.rand.Uint64())
+		if err != nil {
+			wg.Wait()
+			return stats, err
+		}
+		req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+		req.Rest = []rlp.RawValue{nonce}
+		packet, hash, err := encodePacket(t.priv, PingPacket, req)
+		if err != nil {
+			wg.Wait()
+			return stats, err
+		}
+
+		var rtt time.Duration
+		sent := time.Now()
+		errc := t.sendPacket(toid, toaddr, req, packet, func(p reply) error {
+			if p.ptype == PongPacket && bytes.Equal(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash) {
+				rtt = time.Since(sent)
+				return nil
+			}
+			return ErrPacketMismatch
+		})
+		stats.Sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if <-errc == nil {
+				mu.Lock()
+				latencies = append(latencies, rtt)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats.Received = len(latencies)
+	if stats.Received == 0 {
+		return stats, ErrTimeout
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.P50 = percentile(latencies, 0.50)
+	stats.P95 = percentile(latencies, 0.95)
+	stats.P99 = percentile(latencies, 0.99)
+	stats.Max = latencies[len(latencies)-1]
+	return stats, nil
+}
+
+// percentile returns the q-th percentile of sorted by the nearest-rank method.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,69 @@
+package discv4test
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestLatencyProfile profiles a loopback listener, which should answer every ping, and one
+// behind a lossy link, whose lost pongs must be counted rather than matched to other pings.
+func TestLatencyProfile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	for _, loss := range []float64{0, 0.5} {
+		target := newLoopbackUDP(t, rnd, loss, 0)
+		toid := EncodePubkey(&target.priv.PublicKey).id()
+		stats, err := source.LatencyProfile(toid, target.conn.LocalAddr().(*net.UDPAddr), 300*time.Millisecond, 100)
+		target.Close()
+		if err != nil {
+			t.Fatalf("loss %v: %v", loss, err)
+		}
+		if stats.Sent < 20 {
+			t.Errorf("loss %v: sent %d pings, want about 30", loss, stats.Sent)
+		}
+		if loss == 0 && stats.Received != stats.Sent || loss > 0 && (stats.Received == 0 || stats.Received == stats.Sent) {
+			t.Errorf("loss %v: got %v", loss, stats)
+		}
+		if !(stats.P50 <= stats.P95 && stats.P95 <= stats.P99 && stats.P99 <= stats.Max) {
+			t.Errorf("loss %v: percentiles out of order: %v", loss, stats)
+		}
+	}
+}
+
+// TestLatencyProfileClosed checks that closing the source cuts a profile short.
+func TestLatencyProfileClosed(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+
+	time.AfterFunc(100*time.Millisecond, source.Close)
+	start := time.Now()
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	_, err := source.LatencyProfile(toid, target.conn.LocalAddr().(*net.UDPAddr), 10*time.Second, 100)
+	if err != ErrClosed {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %v, want soon after the close", d)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for q, want := range map[float64]time.Duration{0.5: 50, 0.95: 95, 0.99: 99, 1: 100} {
+		if got := percentile(sorted, q); got != want {
+			t.Errorf("percentile %v: got %v, want %v", q, got, want)
+		}
+	}
+	if got := percentile(sorted[:1], 0.5); got != 1 {
+		t.Errorf("single sample: got %v, want 1", got)
+	}
+}
@@ -0,0 +1,59 @@
+package discv4test
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// lossyConn wraps a conn, dropping a fraction of the packets sent and received and delaying
+// sent packets by a random jitter. It is used to exercise timeout and retry handling.
+type lossyConn struct {
+	Conn
+	loss   float64       // fraction of packets dropped in each direction
+	jitter time.Duration // maximum delay added to each sent packet
+
+	mu   sync.Mutex // protects rand, which is used by both the read loop and senders
+	rand *rand.Rand
+}
+
+func newLossyConn(c Conn, loss float64, jitter time.Duration, rnd *rand.Rand) *lossyConn {
+	return &lossyConn{Conn: c, loss: loss, jitter: jitter, rand: rnd}
+}
+
+// impair decides the fate of one packet: whether it is dropped and how long it is delayed.
+func (c *lossyConn) impair() (drop bool, delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	drop = c.rand.Float64() < c.loss
+	if c.jitter > 0 {
+		delay = time.Duration(c.rand.Int63n(int64(c.jitter)))
+	}
+	return drop, delay
+}
+
+func (c *lossyConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	drop, delay := c.impair()
+	if drop {
+		return len(b), nil
+	}
+	if delay > 0 {
+		packet := append([]byte{}, b...)
+		time.AfterFunc(delay, func() { c.Conn.WriteToUDP(packet, addr) })
+		return len(b), nil
+	}
+	return c.Conn.WriteToUDP(b, addr)
+}
+
+func (c *lossyConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.Conn.ReadFromUDP(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if drop, _ := c.impair(); !drop {
+			return n, addr, nil
+		}
+	}
+}
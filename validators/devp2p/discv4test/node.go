@@ -14,12 +14,13 @@
 // You should have received a copy of the GNU Lesser General Public License
 // along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
 
-package main
+package discv4test
 
 import (
 	"crypto/ecdsa"
 	"errors"
 	"math/big"
+	"math/rand"
 	"net"
 	"time"
 
@@ -36,16 +37,18 @@ type node struct {
 	addedAt time.Time // time when the node was added to the table
 }
 
-type encPubkey [64]byte
+// EncPubkey is the 64 byte uncompressed secp256k1 public key used as a node ID on the wire.
+type EncPubkey [64]byte
 
-func encodePubkey(key *ecdsa.PublicKey) encPubkey {
-	var e encPubkey
+// EncodePubkey encodes a public key in wire format.
+func EncodePubkey(key *ecdsa.PublicKey) EncPubkey {
+	var e EncPubkey
 	math.ReadBits(key.X, e[:len(e)/2])
 	math.ReadBits(key.Y, e[len(e)/2:])
 	return e
 }
 
-func decodePubkey(e encPubkey) (*ecdsa.PublicKey, error) {
+func decodePubkey(e EncPubkey) (*ecdsa.PublicKey, error) {
 	p := &ecdsa.PublicKey{Curve: crypto.S256(), X: new(big.Int), Y: new(big.Int)}
 	half := len(e) / 2
 	p.X.SetBytes(e[:half])
@@ -56,13 +59,27 @@ func decodePubkey(e encPubkey) (*ecdsa.PublicKey, error) {
 	return p, nil
 }
 
-func (e encPubkey) id() enode.ID {
+// GenerateKey derives a secp256k1 private key from the given randomness source, so that
+// keys are reproducible for a given seed.
+func GenerateKey(rnd *rand.Rand) (*ecdsa.PrivateKey, error) {
+	b := make([]byte, 32)
+	for {
+		rnd.Read(b)
+		key, err := crypto.ToECDSA(b)
+		if err == nil {
+			return key, nil
+		}
+		// retry with fresh bytes if b is zero or not below the curve order
+	}
+}
+
+func (e EncPubkey) id() enode.ID {
 	return enode.ID(crypto.Keccak256Hash(e[:]))
 }
 
 // recoverNodeKey computes the public key used to sign the
 // given hash from the signature.
-func recoverNodeKey(hash, sig []byte) (key encPubkey, err error) {
+func recoverNodeKey(hash, sig []byte) (key EncPubkey, err error) {
 	pubkey, err := secp256k1.RecoverPubkey(hash, sig)
 	if err != nil {
 		return key, err
@@ -0,0 +1,220 @@
+package discv4test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Link types of the captures ReadPcap understands.
+const (
+	linkTypeNull     = 0   // BSD loopback, with a 4 byte address family header
+	linkTypeEthernet = 1   // Ethernet, optionally with 802.1Q VLAN tags
+	linkTypeRaw      = 101 // bare IPv4 or IPv6 packets
+	linkTypeLinuxSLL = 113 // Linux cooked capture, as from tcpdump -i any
+)
+
+var errNotUDP = errors.New("not an unfragmented UDP datagram")
+
+// CapturedPacket is a UDP datagram read from a packet capture.
+type CapturedPacket struct {
+	Time     time.Time
+	Src, Dst *net.UDPAddr
+	Payload  []byte
+}
+
+// ReadPcap reads the UDP datagrams of a capture in the classic libpcap format, as written by
+// tcpdump -w. Frames that are not UDP over IPv4 or IPv6, such as ARP, TCP or IP fragments, are
+// skipped. Captures in the pcapng format are not supported.
+func ReadPcap(r io.Reader) ([]CapturedPacket, error) {
+	var head [24]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("pcap header: %v", err)
+	}
+	var (
+		order binary.ByteOrder
+		nanos bool
+	)
+	switch magic := binary.LittleEndian.Uint32(head[:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic %#x)", magic)
+	}
+	linkType := order.Uint32(head[20:24])
+	switch linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", linkType)
+	}
+
+	var packets []CapturedPacket
+	for {
+		var rec [16]byte
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return packets, fmt.Errorf("pcap record %d: %v", len(packets), err)
+		}
+		frame := make([]byte, order.Uint32(rec[8:12]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return packets, fmt.Errorf("pcap record %d: %v", len(packets), err)
+		}
+		frac := time.Duration(order.Uint32(rec[4:8])) * time.Microsecond
+		if nanos {
+			frac /= time.Microsecond
+		}
+		p, err := decodeFrame(linkType, frame)
+		if err != nil {
+			continue
+		}
+		p.Time = time.Unix(int64(order.Uint32(rec[:4])), int64(frac))
+		packets = append(packets, p)
+	}
+}
+
+// decodeFrame returns the UDP datagram carried by a captured frame of the given link type.
+func decodeFrame(linkType uint32, frame []byte) (CapturedPacket, error) {
+	switch linkType {
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return CapturedPacket{}, errNotUDP
+		}
+		return decodeIP(frame[4:])
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return CapturedPacket{}, errNotUDP
+		}
+		etherType, rest := binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		for etherType == 0x8100 && len(rest) >= 4 {
+			etherType, rest = binary.BigEndian.Uint16(rest[2:4]), rest[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return CapturedPacket{}, errNotUDP
+		}
+		return decodeIP(rest)
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return CapturedPacket{}, errNotUDP
+		}
+		return decodeIP(frame[16:])
+	default:
+		return decodeIP(frame)
+	}
+}
+
+// decodeIP returns the UDP datagram in an IPv4 or IPv6 packet. IPv6 extension headers are
+// not followed.
+func decodeIP(b []byte) (CapturedPacket, error) {
+	var (
+		src, dst net.IP
+		udp      []byte
+	)
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		ihl := int(b[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(b[6:8])&0x3fff != 0
+		if b[9] != 17 || fragment || ihl < 20 || len(b) < ihl {
+			return CapturedPacket{}, errNotUDP
+		}
+		src, dst, udp = net.IP(b[12:16]), net.IP(b[16:20]), b[ihl:]
+	case len(b) >= 40 && b[0]>>4 == 6:
+		if b[6] != 17 {
+			return CapturedPacket{}, errNotUDP
+		}
+		src, dst, udp = net.IP(b[8:24]), net.IP(b[24:40]), b[40:]
+	default:
+		return CapturedPacket{}, errNotUDP
+	}
+	if len(udp) < 8 {
+		return CapturedPacket{}, errNotUDP
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return CapturedPacket{}, errNotUDP
+	}
+	return CapturedPacket{
+		Src:     &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(udp[0:2]))},
+		Dst:     &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(binary.BigEndian.Uint16(udp[2:4]))},
+		Payload: append([]byte(nil), udp[8:length]...),
+	}, nil
+}
+
+// ReplayResult is what became of one replayed packet.
+type ReplayResult struct {
+	Packet  string   // kind of packet, or why it could not be decoded
+	Expired bool     // its expiration had passed when it was replayed
+	Replies []string // kinds of the packets the target sent back
+}
+
+func (r ReplayResult) String() string {
+	state := "valid"
+	if r.Expired {
+		state = "expired"
+	}
+	replies := "no reply"
+	if len(r.Replies) > 0 {
+		replies = strings.Join(r.Replies, ", ")
+	}
+	return fmt.Sprintf("%s (%s): %s", r.Packet, state, replies)
+}
+
+// ReplayCapture sends each payload to the target verbatim, in order, and collects the packets
+// the target sends back within respTimeout of each. The payloads keep their original signatures
+// and expirations, so a replay of an old capture is of expired packets, which the target should
+// ignore, and replies to a replayed ping go to us, but under the node ID that signed it.
+func (t *V4Udp) ReplayCapture(toid enode.ID, toaddr *net.UDPAddr, payloads [][]byte) []ReplayResult {
+	results := make([]ReplayResult, len(payloads))
+	for i, payload := range payloads {
+		res := &results[i]
+		p, _, _, err := decodePacket(payload)
+		if err != nil {
+			res.Packet = fmt.Sprintf("undecodable packet (%v)", err)
+		} else {
+			res.Packet = p.name()
+			res.Expired = expired(packetExpiration(p))
+		}
+		errc := t.pending(toid, func(r reply) error {
+			res.Replies = append(res.Replies, replyName(r))
+			return ErrPacketMismatch
+		})
+		t.write(toaddr, "replayed "+res.Packet, payload)
+		<-errc
+	}
+	return results
+}
+
+// packetExpiration returns the expiration of a decoded packet, or 0 for a packet without one.
+func packetExpiration(p packet) uint64 {
+	switch p := p.(type) {
+	case *ping:
+		return p.Expiration
+	case *pong:
+		return p.Expiration
+	case *findnode:
+		return p.Expiration
+	case *neighbors:
+		return p.Expiration
+	case *enrRequest:
+		return p.Expiration
+	}
+	return 0
+}
+
+// replyName returns the kind of packet delivered to a pending reply.
+func replyName(r reply) string {
+	if in, ok := r.data.(incomingPacket); ok {
+		if p, ok := in.packet.(packet); ok {
+			return p.name()
+		}
+	}
+	return fmt.Sprintf("packet type %d", r.ptype)
+}
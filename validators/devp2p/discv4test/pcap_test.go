@@ -0,0 +1,133 @@
+package discv4test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// writePcap returns a little endian, microsecond resolution capture of frames, which must all
+// be of linkType.
+func writePcap(linkType uint32, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	head := make([]byte, 24)
+	binary.LittleEndian.PutUint32(head[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(head[4:], 2)
+	binary.LittleEndian.PutUint16(head[6:], 4)
+	binary.LittleEndian.PutUint32(head[16:], 65535)
+	binary.LittleEndian.PutUint32(head[20:], linkType)
+	b.Write(head)
+	for i, f := range frames {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:], uint32(1600000000+i))
+		binary.LittleEndian.PutUint32(rec[4:], 500)
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(f)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(f)))
+		b.Write(rec)
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// udpHeader returns a UDP header and payload between the given ports.
+func udpHeader(src, dst int, payload []byte) []byte {
+	h := make([]byte, 8)
+	binary.BigEndian.PutUint16(h[0:], uint16(src))
+	binary.BigEndian.PutUint16(h[2:], uint16(dst))
+	binary.BigEndian.PutUint16(h[4:], uint16(8+len(payload)))
+	return append(h, payload...)
+}
+
+// ipv4Packet returns an IPv4 packet of the given protocol, with the fragment field given.
+func ipv4Packet(proto byte, fragment uint16, src, dst net.IP, body []byte) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45
+	binary.BigEndian.PutUint16(h[2:], uint16(20+len(body)))
+	binary.BigEndian.PutUint16(h[6:], fragment)
+	h[8], h[9] = 64, proto
+	copy(h[12:], src.To4())
+	copy(h[16:], dst.To4())
+	return append(h, body...)
+}
+
+func ethernetFrame(etherType uint16, body []byte) []byte {
+	h := make([]byte, 14)
+	binary.BigEndian.PutUint16(h[12:], etherType)
+	return append(h, body...)
+}
+
+// TestReadPcap checks that the UDP datagrams of a capture are read with their addresses, and
+// that other frames are skipped.
+func TestReadPcap(t *testing.T) {
+	src, dst := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	udp := udpHeader(30304, 30303, []byte("payload"))
+	capture := writePcap(linkTypeEthernet,
+		ethernetFrame(0x0800, ipv4Packet(17, 0, src, dst, udp)),
+		ethernetFrame(0x0806, make([]byte, 28)),                 // ARP
+		ethernetFrame(0x0800, ipv4Packet(6, 0, src, dst, udp)),  // TCP
+		ethernetFrame(0x0800, ipv4Packet(17, 1, src, dst, udp)), // later fragment
+	)
+	packets, err := ReadPcap(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("got %d packets, want 1", len(packets))
+	}
+	p := packets[0]
+	if !p.Src.IP.Equal(src) || p.Src.Port != 30304 || !p.Dst.IP.Equal(dst) || p.Dst.Port != 30303 {
+		t.Errorf("got %v -> %v", p.Src, p.Dst)
+	}
+	if string(p.Payload) != "payload" || !p.Time.Equal(time.Unix(1600000000, 500000)) {
+		t.Errorf("got payload %q at %v", p.Payload, p.Time)
+	}
+
+	v6 := make([]byte, 40)
+	v6[0], v6[6] = 0x60, 17
+	copy(v6[8:], net.ParseIP("fd00::1"))
+	copy(v6[24:], net.ParseIP("fd00::2"))
+	packets, err = ReadPcap(bytes.NewReader(writePcap(linkTypeRaw, append(v6, udp...))))
+	if err != nil || len(packets) != 1 || !packets[0].Dst.IP.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("raw IPv6: got %v, %v", packets, err)
+	}
+
+	if _, err := ReadPcap(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Error("read a file without the pcap magic")
+	}
+}
+
+// TestReplayCapture checks that a replayed valid ping is answered and an expired one is not.
+func TestReplayCapture(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	key, _ := GenerateKey(rnd)
+	sender := &V4Udp{priv: key}
+	var payloads [][]byte
+	for _, exp := range []time.Time{time.Now().Add(expiration), time.Now().Add(-time.Hour)} {
+		packet, _, err := encodePacket(key, PingPacket, sender.makePing(toaddr, 4, uint64(exp.Unix())))
+		if err != nil {
+			t.Fatalf("could not encode packet: %v", err)
+		}
+		payloads = append(payloads, packet)
+	}
+	payloads = append(payloads, []byte("junk"))
+
+	results := initiator.ReplayCapture(toid, toaddr, payloads)
+	pong := (&pong{}).name()
+	if res := results[0]; res.Expired || len(res.Replies) == 0 || res.Replies[0] != pong {
+		t.Errorf("valid ping: got %v", res)
+	}
+	if res := results[1]; !res.Expired || len(res.Replies) != 0 {
+		t.Errorf("expired ping: got %v", res)
+	}
+	if res := results[2]; len(res.Replies) != 0 {
+		t.Errorf("junk: got %v", res)
+	}
+}
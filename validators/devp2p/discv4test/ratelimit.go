@@ -0,0 +1,39 @@
+package discv4test
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket paces outbound packets to a fixed rate. It holds at most one token, so packets
+// are spread evenly rather than sent in bursts.
+type tokenBucket struct {
+	rate float64 // tokens added per second
+
+	mu     sync.Mutex
+	tokens float64 // negative when callers have reserved tokens not yet added
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: 1, last: time.Now()}
+}
+
+// wait takes a token, blocking until one is available. Each caller reserves its token before
+// sleeping, so concurrent callers are paced one after the other.
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > 1 {
+		b.tokens = 1
+	}
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,82 @@
+package discv4test
+
+import (
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// SendRaw writes raw to toaddr as a single datagram, for scripting packet exchanges that no
+// other method covers. raw is sent as is, without any checks. To be accepted by a target it
+// must be framed as a discovery v4 packet:
+//
+//	hash || signature || packet-type || packet-data
+//
+// where hash is the keccak256 hash of everything after it, signature is the 65 byte recoverable
+// signature over the keccak256 hash of packet-type || packet-data, packet-type is a single byte
+// and packet-data is the RLP encoded packet. The whole packet must not exceed 1280 bytes.
+func (t *V4Udp) SendRaw(toaddr *net.UDPAddr, raw []byte) error {
+	return t.write(toaddr, "RAW", raw)
+}
+
+// ExpectRaw waits up to timeout for the next packet signed by from and returns its raw bytes,
+// framed as described for SendRaw. Any packet with a valid hash and signature is returned,
+// even one that fails to decode, and it is still handled as usual. Only packets arriving while
+// ExpectRaw waits are returned, so to catch a reply, start waiting before sending the request.
+// The error is ErrTimeout if no packet arrives in time.
+func (t *V4Udp) ExpectRaw(from enode.ID, timeout time.Duration) ([]byte, error) {
+	ch := t.addRawWaiter(from)
+	defer t.removeRawWaiter(from, ch)
+
+	select {
+	case raw := <-ch:
+		return raw, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	case <-t.closing:
+		return nil, ErrClosed
+	}
+}
+
+// addRawWaiter returns a channel receiving the packets signed by from until it is removed.
+// A packet arriving while the last one is still unread is dropped.
+func (t *V4Udp) addRawWaiter(from enode.ID) chan []byte {
+	ch := make(chan []byte, 1)
+	t.rawMu.Lock()
+	defer t.rawMu.Unlock()
+	if t.rawWaiters == nil {
+		t.rawWaiters = make(map[enode.ID][]chan []byte)
+	}
+	t.rawWaiters[from] = append(t.rawWaiters[from], ch)
+	return ch
+}
+
+func (t *V4Udp) removeRawWaiter(from enode.ID, ch chan []byte) {
+	t.rawMu.Lock()
+	defer t.rawMu.Unlock()
+	waiters := t.rawWaiters[from]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(t.rawWaiters, from)
+	} else {
+		t.rawWaiters[from] = waiters
+	}
+}
+
+// deliverRaw passes a copy of a packet signed by from to every ExpectRaw waiting for it.
+func (t *V4Udp) deliverRaw(from enode.ID, buf []byte) {
+	t.rawMu.Lock()
+	defer t.rawMu.Unlock()
+	for _, ch := range t.rawWaiters[from] {
+		select {
+		case ch <- append([]byte{}, buf...):
+		default:
+		}
+	}
+}
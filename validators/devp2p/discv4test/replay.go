@@ -0,0 +1,77 @@
+package discv4test
+
+import (
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// replayLifetime is how long the findnode replayed by ReplayFindnode stays valid. It leaves
+// time for the original request and a first replay to be answered before it expires.
+const replayLifetime = 4 * time.Second
+
+// ReplayFindnode documents the target's replay semantics for findnode. It bonds and calls find
+// neighbours with a request expiring after replayLifetime, keeping the signed packet. Before the
+// packet expires, it is replayed verbatim from a fresh socket at another port, and unexpired
+// reports whether the target answered it there. Answering is allowed: the packet is still valid
+// and its sender bonded at that IP. Once the packet has expired, it is replayed from our main
+// socket, and the error is ErrExpiredReplay if the target answers it. The error is ErrTimeout if
+// the original request was not answered.
+func (t *V4Udp) ReplayFindnode(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) (unexpired bool, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return false, err
+	}
+	req := &findnode{Target: target, Expiration: uint64(time.Now().Add(replayLifetime).Unix())}
+	packet, _, err := encodePacket(t.priv, FindnodePacket, req)
+	if err != nil {
+		return false, err
+	}
+	//collect the whole response, so that none of it arrives late and is taken for an answer
+	//to the expired replay
+	packets, err := t.collectNeighbourReply(toid, toaddr, req, packet)
+	if err != nil {
+		return false, err
+	}
+	if len(packets) == 0 {
+		return false, ErrTimeout
+	}
+
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return false, err
+	}
+	alt, err := t.listen(&net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		return false, err
+	}
+	defer alt.Close()
+	if _, err := alt.WriteToUDP(packet, toaddr); err != nil {
+		return false, err
+	}
+	switch err := waitForPacket(alt, toid, (&neighbors{}).name(), respTimeout); err {
+	case nil:
+		unexpired = true
+	case ErrTimeout:
+	default:
+		return false, err
+	}
+
+	//a second past the expiration, so that a target whose clock is a little behind ours
+	//still sees the packet as expired
+	time.Sleep(time.Until(time.Unix(int64(req.Expiration), 0)) + time.Second)
+	answered := func(p reply) error {
+		if p.ptype == NeighborsPacket {
+			return nil
+		}
+		return ErrPacketMismatch
+	}
+	switch err := <-t.sendPacket(toid, toaddr, req, packet, answered); err {
+	case nil:
+		return unexpired, ErrExpiredReplay
+	case ErrTimeout:
+		return unexpired, nil
+	default:
+		return unexpired, err
+	}
+}
@@ -0,0 +1,25 @@
+package discv4test
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestReplayFindnode checks that the reference responder answers a replayed findnode from
+// another port while it is valid, and ignores it once it has expired.
+func TestReplayFindnode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	nodes := testNeighbours(rnd, 3)
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(nodes))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	unexpired, err := initiator.ReplayFindnode(toid, toaddr, EncodePubkey(nodes[0].Pubkey()))
+	if err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if !unexpired {
+		t.Error("replay before the expiration was not answered")
+	}
+}
@@ -0,0 +1,211 @@
+package discv4test
+
+import (
+	"crypto/ecdsa"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ReferenceResponder is an in-process discovery v4 node that answers like a conforming
+// client: it pongs every ping, pings back peers whose endpoint it has not verified, and
+// answers findnode from bonded peers with its neighbours. Options turn on the misbehaviours
+// of real targets, so that the checks against them can be tested without a client.
+type ReferenceResponder struct {
+	*V4Udp
+}
+
+// ResponderOption changes the behaviour of a ReferenceResponder.
+type ResponderOption func(*responderConfig)
+
+// responderConfig holds the behaviour of a reference responder, consulted by the packet
+// handlers of a V4Udp that has one.
+type responderConfig struct {
+	neighbours      []*enode.Node
+	delay           time.Duration
+	reflect         bool
+	reorder         bool
+	skipReversePing bool
+	lookupInterval  time.Duration
+	serveRecord     bool
+	recordPad       int
+	record          []byte
+}
+
+// WithNeighbours sets the nodes returned in answer to findnode. Without it, findnode is
+// answered with no nodes.
+func WithNeighbours(nodes []*enode.Node) ResponderOption {
+	return func(c *responderConfig) { c.neighbours = nodes }
+}
+
+// WithDelay holds back every pong and neighbours response for d, as a slow or overloaded
+// target does.
+func WithDelay(d time.Duration) ResponderOption {
+	return func(c *responderConfig) { c.delay = d }
+}
+
+// WithReflect sends every packet received back to its sender unchanged, as a hairpin NAT or
+// a reflector in front of the target does.
+func WithReflect() ResponderOption {
+	return func(c *responderConfig) { c.reflect = true }
+}
+
+// WithReorderNeighbours sends the packets of a neighbours response in reverse order, so that
+// a response split across packets arrives with its short last packet first.
+func WithReorderNeighbours() ResponderOption {
+	return func(c *responderConfig) { c.reorder = true }
+}
+
+// WithSkipReversePing leaves pings from unverified peers unanswered by a ping of our own, so
+// that no peer can complete a bond.
+func WithSkipReversePing() ResponderOption {
+	return func(c *responderConfig) { c.skipReversePing = true }
+}
+
+// WithLookups calls find neighbours on every bonded peer each interval, and pings the nodes
+// they return that the responder has not bonded with, as a client looking up nodes does
+// before it queries them.
+func WithLookups(interval time.Duration) ResponderOption {
+	return func(c *responderConfig) { c.lookupInterval = interval }
+}
+
+// WithRecordPadding answers ENR requests from bonded peers with a record carrying a "pad"
+// entry of pad zero bytes. Above 300 bytes the record breaks the EIP-778 size limit, and
+// above about 1280 bytes the response breaks the packet size limit. Without it, ENR requests
+// are ignored.
+func WithRecordPadding(pad int) ResponderOption {
+	return func(c *responderConfig) { c.serveRecord, c.recordPad = true, pad }
+}
+
+// NewReferenceResponder starts a reference responder with the given key on c.
+func NewReferenceResponder(c Conn, key *ecdsa.PrivateKey, opts ...ResponderOption) (*ReferenceResponder, error) {
+	rc := &responderConfig{neighbours: []*enode.Node{}}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	if rc.serveRecord {
+		record, err := paddedRecord(key, rc.recordPad)
+		if err != nil {
+			return nil, err
+		}
+		rc.record = record
+	}
+	udp, err := newUDP(c, Config{PrivateKey: key, Neighbours: rc.neighbours, responder: rc})
+	if err != nil {
+		return nil, err
+	}
+	if rc.lookupInterval > 0 {
+		go udp.lookups(rc.lookupInterval)
+	}
+	return &ReferenceResponder{udp}, nil
+}
+
+// Node returns the responder's node, at the local address of its conn.
+func (r *ReferenceResponder) Node() (*enode.Node, error) {
+	laddr, err := LocalUDPAddr(r.conn)
+	if err != nil {
+		return nil, err
+	}
+	return enode.NewV4(&r.priv.PublicKey, laddr.IP, laddr.Port, laddr.Port), nil
+}
+
+// respond runs send now, or after the delay of a reference responder.
+func (t *V4Udp) respond(send func()) {
+	if t.responder == nil || t.responder.delay == 0 {
+		send()
+		return
+	}
+	time.AfterFunc(t.responder.delay, send)
+}
+
+// reversePing pings a peer that pinged a reference responder, unless it is bonded already or
+// reverse pings are skipped. Its pong completes the bond, which lets the peer call findnode.
+func (t *V4Udp) reversePing(toid enode.ID, toaddr *net.UDPAddr) {
+	if t.responder == nil || t.responder.skipReversePing || t.bonded(toid) {
+		return
+	}
+	t.pingToBond(toid, toaddr)
+}
+
+// pingToBond pings a peer of a reference responder and records the bond, with the peer's
+// address, when it pongs. The bond is recorded in the callback, before the read loop moves on
+// to the next packet, so a findnode sent right after the pong finds it.
+func (t *V4Udp) pingToBond(toid enode.ID, toaddr *net.UDPAddr) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return
+	}
+	t.sendPacket(toid, toaddr, req, packet, func(p reply) error {
+		if p.ptype != PongPacket || checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash) != nil {
+			return ErrPacketMismatch
+		}
+		t.bondMu.Lock()
+		if t.bondCache == nil {
+			t.bondCache = make(map[enode.ID]time.Time)
+		}
+		if t.peers == nil {
+			t.peers = make(map[enode.ID]*net.UDPAddr)
+		}
+		t.bondCache[toid] = time.Now()
+		t.peers[toid] = toaddr
+		t.bondMu.Unlock()
+		return nil
+	})
+}
+
+// lookups runs the lookups of a reference responder every interval until it is closed. Each
+// bonded peer is asked for the neighbours of our own ID, and the nodes returned that we have
+// not bonded with are pinged.
+func (t *V4Udp) lookups(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.closing:
+			return
+		}
+		t.bondMu.Lock()
+		peers := make(map[enode.ID]*net.UDPAddr, len(t.peers))
+		for id, addr := range t.peers {
+			peers[id] = addr
+		}
+		t.bondMu.Unlock()
+		self := EncodePubkey(&t.priv.PublicKey).id()
+		for id, addr := range peers {
+			nodes, _, err := t.collectNeighbours(id, addr, &findnode{
+				Target:     EncodePubkey(&t.priv.PublicKey),
+				Expiration: uint64(time.Now().Add(expiration).Unix()),
+			})
+			if err != nil {
+				continue
+			}
+			for _, rn := range nodes {
+				if nid := rn.ID.id(); nid != self && !t.bonded(nid) {
+					t.pingToBond(nid, &net.UDPAddr{IP: rn.IP, Port: int(rn.UDP)})
+				}
+			}
+		}
+	}
+}
+
+// paddedRecord encodes a signed v4 node record of key with a "pad" entry of pad zero bytes.
+// It is encoded by hand because the enr package refuses to sign a record above the size limit.
+func paddedRecord(key *ecdsa.PrivateKey, pad int) ([]byte, error) {
+	const seq = 1
+	// keys in the sorted order EIP-778 requires
+	kv := []interface{}{"id", "v4", "pad", make([]byte, pad), "secp256k1", crypto.CompressPubkey(&key.PublicKey)}
+	content, err := rlp.EncodeToBytes(append([]interface{}{uint64(seq)}, kv...))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(crypto.Keccak256(content), key)
+	if err != nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(append([]interface{}{sig[:64], uint64(seq)}, kv...))
+}
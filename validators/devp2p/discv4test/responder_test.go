@@ -0,0 +1,405 @@
+package discv4test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// newResponder starts a reference responder on a loopback socket and returns it with its
+// node ID and address.
+func newResponder(t *testing.T, rnd *rand.Rand, opts ...ResponderOption) (*ReferenceResponder, enode.ID, *net.UDPAddr) {
+	key, err := GenerateKey(rnd)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	r, err := NewReferenceResponder(c, key, opts...)
+	if err != nil {
+		t.Fatalf("could not start responder: %v", err)
+	}
+	n, err := r.Node()
+	if err != nil {
+		t.Fatalf("no responder node: %v", err)
+	}
+	return r, n.ID(), &net.UDPAddr{IP: n.IP(), Port: n.UDP()}
+}
+
+// testNeighbours returns count nodes at IPv6 addresses, so that more than one packet is
+// needed to send them all.
+func testNeighbours(rnd *rand.Rand, count int) []*enode.Node {
+	var nodes []*enode.Node
+	for i := 0; i < count; i++ {
+		key, _ := GenerateKey(rnd)
+		nodes = append(nodes, enode.NewV4(&key.PublicKey, net.ParseIP(fmt.Sprintf("fd00::%x", i+1)), 30303, 30303))
+	}
+	return nodes
+}
+
+// TestReferenceResponder checks that the responder bonds like a conforming client, pinging us
+// back, and then answers findnode with its neighbours.
+func TestReferenceResponder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	nodes := testNeighbours(rnd, bucketSize)
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(nodes))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	var expected []enode.ID
+	for _, n := range nodes {
+		expected = append(expected, n.ID())
+	}
+	if err := initiator.FindnodeExpectExactly(toid, toaddr, EncodePubkey(nodes[0].Pubkey()), expected); err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if err := initiator.FindnodeChunking(toid, toaddr, EncodePubkey(nodes[0].Pubkey())); err != nil {
+		t.Fatalf("chunking: %v", err)
+	}
+}
+
+// TestResponderSkipReversePing checks that without the reverse ping the bond stalls after
+// the pong.
+func TestResponderSkipReversePing(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd, WithSkipReversePing())
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	err := initiator.waitBondedWithin(toid, toaddr, respTimeout)
+	if bie, ok := err.(*BondIncompleteError); !ok || !bie.Pong {
+		t.Fatalf("got %v, want a bond incomplete after the pong", err)
+	}
+}
+
+// TestResponderDelay checks that the pong is held back for the delay.
+func TestResponderDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const delay = 200 * time.Millisecond
+	r, toid, toaddr := newResponder(t, rnd, WithDelay(delay))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	start := time.Now()
+	if err := initiator.Ping(toid, toaddr, true, nil); err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if rtt := time.Since(start); rtt < delay {
+		t.Fatalf("pong after %v, want at least %v", rtt, delay)
+	}
+}
+
+// TestResponderReorderNeighbours checks that a response sent last packet first is reported as
+// badly chunked.
+func TestResponderReorderNeighbours(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	nodes := testNeighbours(rnd, bucketSize)
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(nodes), WithReorderNeighbours())
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	err := initiator.FindnodeChunking(toid, toaddr, EncodePubkey(nodes[0].Pubkey()))
+	if err == nil || !strings.HasPrefix(err.Error(), ErrBadChunking.Error()) {
+		t.Fatalf("got %v, want %v", err, ErrBadChunking)
+	}
+}
+
+// TestResponderReflect checks that a ping comes back to its sender unchanged, as well as
+// being answered.
+func TestResponderReflect(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, _, toaddr := newResponder(t, rnd, WithReflect())
+	defer r.Close()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer c.Close()
+
+	key, _ := GenerateKey(rnd)
+	sender := &V4Udp{priv: key}
+	packet, _, err := encodePacket(key, PingPacket, sender.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix())))
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	if _, err := c.WriteToUDP(packet, toaddr); err != nil {
+		t.Fatalf("could not send ping: %v", err)
+	}
+
+	var reflected, ponged bool
+	buf := make([]byte, maxPacketSize)
+	c.SetReadDeadline(time.Now().Add(respTimeout))
+	for !reflected || !ponged {
+		n, _, err := c.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("reflected %t, ponged %t: %v", reflected, ponged, err)
+		}
+		if bytes.Equal(buf[:n], packet) {
+			reflected = true
+		} else if p, _, _, err := decodePacket(buf[:n]); err == nil && p.name() == (&pong{}).name() {
+			ponged = true
+		}
+	}
+}
+
+// TestLiveNeighbours checks that only the neighbours answering a ping are returned.
+func TestLiveNeighbours(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var nodes []*enode.Node
+	for i := 0; i < 2; i++ {
+		peer, _, _ := newResponder(t, rnd)
+		defer peer.Close()
+		n, err := peer.Node()
+		if err != nil {
+			t.Fatalf("no peer node: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+	dead := testNeighbours(rnd, 1)
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(append(nodes, dead...)))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	live, err := initiator.LiveNeighbours(toid, toaddr, EncodePubkey(nodes[0].Pubkey()))
+	if err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if len(live) != len(nodes) {
+		t.Fatalf("got %d live nodes, want %d", len(live), len(nodes))
+	}
+	for _, n := range live {
+		if n.ID() == dead[0].ID() {
+			t.Errorf("dead node %v returned", n.ID())
+		}
+	}
+}
+
+// TestFindnodeForRequesterSelf checks that the requester is told apart from the other nodes of
+// a lookup for its own ID.
+func TestFindnodeForRequesterSelf(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	laddr := initiator.conn.LocalAddr().(*net.UDPAddr)
+	self := enode.NewV4(&initiator.priv.PublicKey, laddr.IP, laddr.Port, laddr.Port)
+
+	for _, includeSelf := range []bool{false, true} {
+		nodes := testNeighbours(rnd, 2)
+		if includeSelf {
+			nodes = append(nodes, self)
+		}
+		r, toid, toaddr := newResponder(t, rnd, WithNeighbours(nodes))
+		others, includesSelf, err := initiator.FindnodeForRequesterSelf(toid, toaddr)
+		r.Close()
+		if err != nil {
+			t.Fatalf("self %t: got %v", includeSelf, err)
+		}
+		if others != 2 || includesSelf != includeSelf {
+			t.Errorf("self %t: got %d others, self %t", includeSelf, others, includesSelf)
+		}
+	}
+}
+
+// TestPingIdenticalFromTo checks that both pings with equal endpoints are ponged.
+func TestPingIdenticalFromTo(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	if asTarget, asUs := initiator.PingIdenticalFromTo(toid, toaddr); asTarget != nil || asUs != nil {
+		t.Fatalf("got %v as the target, %v as us", asTarget, asUs)
+	}
+}
+
+// TestReversePingHonorsFromPort checks that the responder, which pings back the envelope
+// address of a ping rather than its 'from', is reported as ignoring the advertised port.
+func TestReversePingHonorsFromPort(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	if err := initiator.ReversePingHonorsFromPort(toid, toaddr); err != ErrReversePingPort {
+		t.Fatalf("got %v, want %v", err, ErrReversePingPort)
+	}
+}
+
+// TestPingFromSpoofedAsTarget checks that the responder, which pongs to the envelope address,
+// passes even on loopback, where our real IP is the same as the spoofed one.
+func TestPingFromSpoofedAsTarget(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	if err := initiator.PingFromSpoofedAsTarget(toid, toaddr, true, nil); err != nil {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// restartResponder closes r and starts a reference responder with key on the same address.
+func restartResponder(r *ReferenceResponder, key *ecdsa.PrivateKey) (*ReferenceResponder, error) {
+	laddr, err := LocalUDPAddr(r.conn)
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewReferenceResponder(c, key)
+}
+
+// TestTargetKeyRotation checks that a responder restarted with a new key is discovered under
+// its new node ID, and that the findnode to its old one goes unanswered.
+func TestTargetKeyRotation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer func() { r.Close() }()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	key, _ := GenerateKey(rnd)
+	rotate := func() (err error) {
+		r, err = restartResponder(r, key)
+		return err
+	}
+	newKey, err := initiator.TargetKeyRotation(toid, toaddr, rotate)
+	if err != nil {
+		t.Fatalf("got %v", err)
+	}
+	if got, want := enode.PubkeyToIDV4(newKey), enode.PubkeyToIDV4(&key.PublicKey); got != want {
+		t.Fatalf("discovered %x, want %x", got[:8], want[:8])
+	}
+}
+
+// TestTargetKeyRotationStaleBond checks that a responder restarted with a new key, but with
+// its bonds kept, is reported as honouring the bond made with its old node ID.
+func TestTargetKeyRotationStaleBond(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer func() { r.Close() }()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	key, _ := GenerateKey(rnd)
+	rotate := func() (err error) {
+		if r, err = restartResponder(r, key); err != nil {
+			return err
+		}
+		r.bondMu.Lock()
+		r.bondCache = map[enode.ID]time.Time{enode.PubkeyToIDV4(&initiator.priv.PublicKey): time.Now()}
+		r.bondMu.Unlock()
+		return nil
+	}
+	if _, err := initiator.TargetKeyRotation(toid, toaddr, rotate); err != ErrStaleBond {
+		t.Fatalf("got %v, want %v", err, ErrStaleBond)
+	}
+}
+
+// TestTargetKeyKept checks that a responder restarted with its old key is reported as not
+// having rotated it.
+func TestTargetKeyKept(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd)
+	defer func() { r.Close() }()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	rotate := func() (err error) {
+		r, err = restartResponder(r, r.priv)
+		return err
+	}
+	if _, err := initiator.TargetKeyRotation(toid, toaddr, rotate); err != ErrKeyNotRotated {
+		t.Fatalf("got %v, want %v", err, ErrKeyNotRotated)
+	}
+}
+
+// TestFindnodeAfterInboundPingOnly checks that a responder looking up through the relay pings
+// the fresh identity, and then answers it, as it records a bond once its ping is ponged.
+func TestFindnodeAfterInboundPingOnly(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(testNeighbours(rnd, 1)), WithLookups(100*time.Millisecond))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	answered, err := initiator.FindnodeAfterInboundPingOnly(toid, toaddr, 5*time.Second)
+	if err != nil || !answered {
+		t.Fatalf("got answered %v, %v", answered, err)
+	}
+}
+
+// TestFindnodeAfterInboundPingOnlyNoLookup checks that a responder that never looks up, and
+// so never pings the fresh identity, times out.
+func TestFindnodeAfterInboundPingOnlyNoLookup(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r, toid, toaddr := newResponder(t, rnd, WithNeighbours(testNeighbours(rnd, 1)))
+	defer r.Close()
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	if _, err := initiator.FindnodeAfterInboundPingOnly(toid, toaddr, time.Second); err != ErrTimeout {
+		t.Fatalf("got %v, want %v", err, ErrTimeout)
+	}
+}
+
+// TestENRLargeResponse checks the size reported for records of the responder padded across
+// the record and packet size limits. A response above the packet limit is only read in full
+// with a larger read buffer, and is otherwise dropped.
+func TestENRLargeResponse(t *testing.T) {
+	tests := []struct {
+		pad        int
+		readBuffer int
+		want       error
+	}{
+		{0, 0, nil},
+		{400, 0, ErrENRTooLarge},
+		{1300, 0, ErrTimeout},
+		{1300, maxDatagramSize, ErrPacketTooLarge},
+	}
+	for _, test := range tests {
+		rnd := rand.New(rand.NewSource(1))
+		r, toid, toaddr := newResponder(t, rnd, WithRecordPadding(test.pad))
+		key, _ := GenerateKey(rnd)
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		initiator, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, ReadBufferSize: test.readBuffer})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+
+		size, err := initiator.ENRLargeResponse(toid, toaddr)
+		switch {
+		case test.want == nil && err != nil:
+			t.Errorf("pad %d: unexpected error %v", test.pad, err)
+		case test.want == nil && size > 300:
+			t.Errorf("pad %d: got size %d, want at most 300", test.pad, size)
+		case test.want != nil && (err == nil || !strings.HasPrefix(err.Error(), test.want.Error())):
+			t.Errorf("pad %d, read buffer %d: got %v, want %v", test.pad, test.readBuffer, err, test.want)
+		}
+		initiator.Close()
+		r.Close()
+	}
+}
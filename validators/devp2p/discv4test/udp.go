@@ -0,0 +1,4062 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package discv4test implements the discovery v4 conformance checks of the devp2p validator.
+// A V4Udp listener sends crafted packets to a target node and reports whether its
+// responses match the protocol, so the checks can be embedded in other tools.
+package discv4test
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+	"github.com/ethereum/go-ethereum/p2p/netutil"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Errors
+var (
+	ErrPacketTooSmall    = errors.New("too small")
+	ErrBadHash           = errors.New("bad hash")
+	ErrExpired           = errors.New("expired")
+	ErrUnsolicitedReply  = errors.New("unsolicited reply")
+	ErrUnknownNode       = errors.New("unknown node")
+	ErrTimeout           = errors.New("RPC timeout")
+	ErrClockWarp         = errors.New("reply deadline too far in the future")
+	ErrClosed            = errors.New("socket closed")
+	ErrResponseReceived  = errors.New("response received")
+	ErrPacketMismatch    = errors.New("packet mismatch")
+	ErrCorruptDHT        = errors.New("corrupt neighbours data")
+	ErrBadIPLength       = errors.New("invalid IP length")
+	ErrNATEchoMismatch   = errors.New("pong 'to' does not match observed source")
+	ErrBadReplyTokLength = errors.New("pong reply token is not 32 bytes")
+	ErrHandlerPanic      = errors.New("packet handler panicked")
+	ErrInvalidNeighbours = errors.New("neighbours failed validation")
+	ErrPongToSpoofed     = errors.New("pong 'to' echoes the spoofed 'from' address")
+	ErrBadChunking       = errors.New("neighbours response badly split across packets")
+	ErrNoEthEntry        = errors.New("node record has no 'eth' entry")
+	ErrWrongNetwork      = errors.New("node record advertises a different fork ID")
+	ErrSelfPacket        = errors.New("packet signed by our own key")
+	ErrMissingNeighbour  = errors.New("known node missing from neighbours")
+	ErrReversePingPort   = errors.New("reverse ping sent to envelope port, not advertised 'from' port")
+	ErrENRTooLarge       = errors.New("node record exceeds the size limit")
+	ErrPrivateLeak       = errors.New("neighbours leak internal addresses")
+	ErrUnknownPacketType = errors.New("unknown packet type")
+	ErrBadENRSeq         = errors.New("pong ENR sequence number is malformed")
+	ErrCancelled         = errors.New("pending reply cancelled")
+	ErrNeighbourSet      = errors.New("neighbours differ from the expected set")
+	ErrPongSource        = errors.New("pong arrived from an unexpected address")
+	ErrInvalidConfig     = errors.New("invalid config")
+	ErrReplyFromWrongIP  = errors.New("reply from a different IP than the request was sent to")
+	ErrPacketTooLarge    = errors.New("packet exceeds the size limit")
+	ErrFindnodeDropped   = errors.New("findnode was not answered")
+	ErrPoisonedEndpoint  = errors.New("bonded node's endpoint overwritten by unsolicited neighbours")
+	ErrStaleEndpoint     = errors.New("target kept our old endpoint after a ping from a new one")
+	ErrIdentityConfused  = errors.New("target confused two identities sharing an endpoint")
+	ErrPubkeyMismatch    = errors.New("pong not signed by the pinned public key")
+	ErrOneWayBond        = errors.New("one-way bonding: target pongs but never pings back")
+	ErrFarFuture         = errors.New("pong expiration implausibly far in the future")
+	ErrExpiredReplay     = errors.New("replay of an expired findnode was answered")
+	ErrStaleExpiration   = errors.New("pong expiration not refreshed between pings")
+	ErrKeyNotRotated     = errors.New("target kept its node ID across the key rotation")
+	ErrStaleBond         = errors.New("target honoured a bond made with its old node ID after a key rotation")
+	unexpectedPacket     = false
+)
+
+// Timeouts
+const (
+	respTimeout    = 500 * time.Millisecond
+	watchdogPeriod = 10 * time.Second // default interval between watchdog checks of the reply loop
+	expiration     = 20 * time.Second
+	bondExpiration = 24 * time.Hour
+	bondDeadline   = 5 * time.Second // time allowed for both halves of the bonding handshake
+
+	writeRetryBackoff = 5 * time.Millisecond // delay before retrying a failed write, doubled for each retry
+
+	ntpFailureThreshold = 32               // Continuous timeouts after which to check NTP
+	ntpWarningCooldown  = 10 * time.Minute // Minimum amount of time to pass before repeating NTP warning
+	driftThreshold      = 10 * time.Second // Allowed clock drift before warning user
+)
+
+// RPC packet types
+const (
+	PingPacket = iota + 1 // zero is 'reserved'
+	PongPacket
+	FindnodePacket
+	NeighborsPacket
+	ENRRequestPacket
+	ENRResponsePacket
+	GarbagePacket1
+	GarbagePacket2
+	GarbagePacket3
+	GarbagePacket4
+	GarbagePacket5
+	GarbagePacket6
+	GarbagePacket7
+	GarbagePacket8
+)
+
+// RPC request structures
+type (
+	ping struct {
+		Version    uint
+		From, To   RPCEndpoint
+		Expiration uint64
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	pingExtra struct {
+		Version    uint
+		From, To   RPCEndpoint
+		Expiration uint64
+		JunkData1  uint
+		JunkData2  []byte
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	// pingNonCanonical is a ping whose expiration is encoded by hand, so that it can be
+	// given leading zero bytes.
+	pingNonCanonical struct {
+		Version    uint
+		From, To   RPCEndpoint
+		Expiration rlp.RawValue
+	}
+
+	// pong is the reply to ping.
+	pong struct {
+		// This field should mirror the UDP envelope address
+		// of the ping packet, which provides a way to discover the
+		// the external address (after NAT).
+		To RPCEndpoint
+
+		ReplyTok   []byte // This contains the hash of the ping packet.
+		Expiration uint64 // Absolute timestamp at which the packet becomes invalid.
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	// findnode is a query for nodes close to the given target.
+	findnode struct {
+		Target     EncPubkey
+		Expiration uint64
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	// reply to findnode
+	neighbors struct {
+		Nodes      []rpcNode
+		Expiration uint64
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	// enrRequest queries for the remote node's record (EIP-868).
+	enrRequest struct {
+		Expiration uint64
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	// enrResponse is the reply to enrRequest.
+	enrResponse struct {
+		ReplyTok []byte // Hash of the enrRequest packet.
+		Record   enr.Record
+		// Ignore additional fields (for forward compatibility).
+		Rest []rlp.RawValue `rlp:"tail"`
+	}
+
+	incomingPacket struct {
+		packet      interface{}
+		recoveredID EncPubkey
+		received    time.Time    // set for pings, which are answered before they are passed on
+		source      *net.UDPAddr // address the packet arrived from
+		size        int          // length of the packet, set for oversized packets
+	}
+
+	rpcNode struct {
+		IP  net.IP // len 4 for IPv4 or 16 for IPv6
+		UDP uint16 // for discovery protocol
+		TCP uint16 // for RLPx protocol
+		ID  EncPubkey
+	}
+
+	// RPCEndpoint is the wire format of a node's address, as in the 'from' and 'to' fields of a ping.
+	RPCEndpoint struct {
+		IP  net.IP // len 4 for IPv4 or 16 for IPv6
+		UDP uint16 // for discovery protocol
+		TCP uint16 // for RLPx protocol
+	}
+)
+
+func makeEndpoint(addr *net.UDPAddr, tcpPort uint16) RPCEndpoint {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	return RPCEndpoint{IP: ip, UDP: uint16(addr.Port), TCP: tcpPort}
+}
+
+// checkIPLength verifies that a wire-format IP is either 4 (IPv4) or 16 (IPv6) bytes long.
+func checkIPLength(ip net.IP) error {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return ErrBadIPLength
+	}
+	return nil
+}
+
+// checkReplyTok verifies that a pong's reply token is the 32 byte hash of our ping. A token of
+// the wrong length is reported distinctly from one with the wrong content.
+func checkReplyTok(tok, hash []byte) error {
+	if len(tok) != macSize {
+		return ErrBadReplyTokLength
+	}
+	if !bytes.Equal(tok, hash) {
+		return ErrUnsolicitedReply
+	}
+	return nil
+}
+
+func (t *V4Udp) nodeFromRPC(sender *net.UDPAddr, rn rpcNode) (*node, error) {
+	if rn.UDP <= 1024 {
+		return nil, errors.New("low port")
+	}
+	if err := checkIPLength(rn.IP); err != nil {
+		return nil, err
+	}
+	if err := netutil.CheckRelayIP(sender.IP, rn.IP); err != nil {
+		return nil, err
+	}
+	if t.netrestrict != nil && !t.netrestrict.Contains(rn.IP) {
+		return nil, errors.New("not contained in netrestrict whitelist")
+	}
+	key, err := decodePubkey(rn.ID)
+	if err != nil {
+		return nil, err
+	}
+	n := wrapNode(enode.NewV4(key, rn.IP, int(rn.TCP), int(rn.UDP)))
+	err = n.ValidateComplete()
+	return n, err
+}
+
+func nodeToRPC(n *node) rpcNode {
+	var key ecdsa.PublicKey
+	var ekey EncPubkey
+	if err := n.Load((*enode.Secp256k1)(&key)); err == nil {
+		ekey = EncodePubkey(&key)
+	}
+	return rpcNode{ID: ekey, IP: n.IP(), UDP: uint16(n.UDP()), TCP: uint16(n.TCP())}
+}
+
+type packet interface {
+	handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error
+	name() string
+}
+
+// Conn is the packet transport the suite runs on. *net.UDPConn implements it; other
+// implementations can route packets through a relay, a tunnel or a network namespace.
+type Conn interface {
+	ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (n int, err error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// ConnFactory opens a Conn bound to laddr.
+type ConnFactory func(laddr *net.UDPAddr) (Conn, error)
+
+// LocalUDPAddr returns the local address of c. A custom conn may report another kind of
+// address, which is an error rather than a panic.
+func LocalUDPAddr(c Conn) (*net.UDPAddr, error) {
+	laddr, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("local address %v (%T) is not a UDP address", c.LocalAddr(), c.LocalAddr())
+	}
+	return laddr, nil
+}
+
+// ListenConn is the default ConnFactory. It listens on a plain UDP socket.
+func ListenConn(laddr *net.UDPAddr) (Conn, error) {
+	c, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//V4Udp is the v4UDP test class
+type V4Udp struct {
+	conn        Conn
+	netrestrict *netutil.Netlist
+	priv        *ecdsa.PrivateKey
+	ourEndpoint RPCEndpoint
+
+	addpending     chan *pending
+	gotreply       chan reply
+	cancelpendings chan chan struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	nat       nat.Interface
+
+	rand *rand.Rand // source of all test randomness (keys, targets), seeded for reproducibility
+
+	onStuck func() // called by the watchdog if the reply loop stops responding
+
+	clock func() time.Time // time source of the reply loop's deadlines, time.Now if nil
+
+	limiter *tokenBucket // paces outbound packets, nil if unlimited
+
+	neighbours []*enode.Node // nodes returned in answer to findnode, nil to ignore findnode
+
+	strictReplySource bool // replies must come from the IP their request was sent to
+
+	connFactory ConnFactory // opens extra sockets, ListenConn if nil
+
+	readBufferSize int // size of the read buffer, maxPacketSize if zero
+	writeRetries   int // retries of a write failing with a temporary error
+
+	pinned     *EncPubkey   // key pongs to Ping must be signed with, nil to accept any
+	pinnedAddr *net.UDPAddr // address the pinned key applies to, nil for every address
+
+	maxPongExpiration time.Duration // pongs expiring further ahead are rejected, unbounded if zero
+
+	responder *responderConfig // behaviour of a ReferenceResponder, nil for the test harness
+
+	bondMu    sync.Mutex
+	bondCache map[enode.ID]time.Time    // time of the last successful bond with each node
+	pingedAt  map[enode.ID]time.Time    // time of the last ping from each node, which we ponged
+	peers     map[enode.ID]*net.UDPAddr // addresses of the nodes a reference responder bonded with
+
+	rawMu      sync.Mutex
+	rawWaiters map[enode.ID][]chan []byte // ExpectRaw calls waiting for a packet from each node
+}
+
+// pending represents a pending reply.
+//
+// some implementations of the protocol wish to send more than one
+// reply packet to findnode. in general, any neighbors packet cannot
+// be matched up with a specific findnode packet.
+//
+// our implementation handles this by storing a callback function for
+// each pending reply. incoming packets from a node are dispatched
+// to all the callback functions for that node.
+type pending struct {
+	// these fields must match in the reply.
+	from    enode.ID
+	ip      net.IP // IP the request was sent to, matched only if StrictReplySource is set
+	anyNode bool   // match replies from ip under any node ID, instead of from
+
+	// time when the request must complete
+	deadline time.Time
+
+	//callback is called when a packet is received. if it returns nil,
+	//the callback is removed from the pending reply queue (handled successfully and expected by test case).
+	//if it returns a mismatch error, (ignored by callback, further 'pendings' may be in the test case)
+	//if it returns any other error, that error is considered the outcome of the
+	//'pending' operation
+
+	//callback func(resp interface{}) (done error)
+	callback func(resp reply) (done error)
+
+	// errc receives nil when the callback indicates completion or an
+	// error if no further reply is received within the timeout.
+	errc chan<- error
+}
+
+type reply struct {
+	from  enode.ID
+	ptype byte
+	data  interface{}
+	// loop sends nil on this channel if there was a matching
+	// request, or the reason there was none.
+	matched chan<- error
+}
+
+// ReadPacket is sent to the unhandled channel when it could not be processed
+type ReadPacket struct {
+	Data []byte
+	Addr *net.UDPAddr
+}
+
+// Config holds Table-related settings.
+type Config struct {
+	// These settings are required and configure the UDP listener:
+	PrivateKey *ecdsa.PrivateKey
+
+	// These settings are optional:
+	AnnounceAddr *net.UDPAddr      // local address announced in the DHT
+	NodeDBPath   string            // if set, the node database is stored at this filesystem location
+	NetRestrict  *netutil.Netlist  // network whitelist
+	Bootnodes    []*enode.Node     // list of bootstrap nodes
+	Unhandled    chan<- ReadPacket // unhandled packets are sent on this channel
+	Rand         *rand.Rand        // randomness source, seeded from the current time if nil
+
+	Loss              float64       // fraction of packets dropped in each direction, for resilience testing
+	Jitter            time.Duration // maximum random delay added to each sent packet, for resilience testing
+	SendRateLimit     float64       // maximum outbound packets per second, unlimited if zero
+	Neighbours        []*enode.Node // nodes returned in answer to findnode from bonded peers; findnode is ignored if nil
+	StrictReplySource bool          // reject replies from a different IP than their request was sent to
+	ConnFactory       ConnFactory   // opens the extra sockets some tests listen on, ListenConn if nil
+	ReadBufferSize    int           // size of the read buffer, 1280 if zero; raise it to read oversized packets in full
+	WriteRetries      int           // retries of a write failing with a temporary error such as ENOBUFS, none if zero
+	PinnedPubkey      *EncPubkey    // key pongs to Ping must be signed with, not checked if nil
+	PinnedAddr        *net.UDPAddr  // address whose pongs PinnedPubkey applies to, every address if nil
+	MaxPongExpiration time.Duration // pongs expiring further ahead than this are rejected, unbounded if zero
+	EnableWatchdog    bool          // periodically check that the reply loop is not stuck
+	WatchdogInterval  time.Duration // interval between watchdog checks, watchdogPeriod if zero
+
+	responder *responderConfig // set by NewReferenceResponder
+}
+
+// Validate checks every constraint on the config and returns ErrInvalidConfig listing all of
+// the problems found, or nil if there are none. The AnnounceAddr family is only checked against
+// the socket when the config is used, by ListenUDP.
+func (c Config) Validate() error {
+	return c.validate(nil)
+}
+
+// validate is Validate, also checking that AnnounceAddr is of the family of bound, the local
+// address of the socket, if it is not nil. Peers could not reach an IPv6 address announced
+// from an IPv4 socket, or the reverse, except that a socket bound to the unspecified IPv6
+// address is dual-stack and may announce either.
+func (c Config) validate(bound *net.UDPAddr) error {
+	var problems []string
+	if c.PrivateKey == nil {
+		problems = append(problems, "PrivateKey is required")
+	}
+	if c.AnnounceAddr != nil {
+		if ip := c.AnnounceAddr.IP; ip != nil && len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			problems = append(problems, fmt.Sprintf("AnnounceAddr IP has invalid length %d", len(ip)))
+		}
+		if c.AnnounceAddr.Port < 1 || c.AnnounceAddr.Port > math.MaxUint16 {
+			problems = append(problems, fmt.Sprintf("AnnounceAddr port %d out of range", c.AnnounceAddr.Port))
+		}
+		if ip := c.AnnounceAddr.IP; ip != nil && bound != nil && bound.IP != nil {
+			dualStack := bound.IP.Equal(net.IPv6unspecified)
+			if !dualStack && (ip.To4() == nil) != (bound.IP.To4() == nil) {
+				problems = append(problems, fmt.Sprintf("AnnounceAddr %v is not of the family of the socket bound to %v", c.AnnounceAddr, bound))
+			}
+		}
+	}
+	for i, n := range c.Bootnodes {
+		if n == nil {
+			problems = append(problems, fmt.Sprintf("Bootnodes[%d] is nil", i))
+		} else if err := n.ValidateComplete(); err != nil {
+			problems = append(problems, fmt.Sprintf("Bootnodes[%d] is invalid: %v", i, err))
+		}
+	}
+	if !(c.Loss >= 0 && c.Loss <= 1) {
+		problems = append(problems, fmt.Sprintf("Loss %v not between 0 and 1", c.Loss))
+	}
+	if c.Jitter < 0 {
+		problems = append(problems, fmt.Sprintf("Jitter %v is negative", c.Jitter))
+	}
+	if !(c.SendRateLimit >= 0) {
+		problems = append(problems, fmt.Sprintf("SendRateLimit %v is negative", c.SendRateLimit))
+	}
+	if c.ReadBufferSize != 0 && c.ReadBufferSize < maxPacketSize {
+		problems = append(problems, fmt.Sprintf("ReadBufferSize %d below the %d byte packet limit", c.ReadBufferSize, maxPacketSize))
+	}
+	if c.WriteRetries < 0 {
+		problems = append(problems, fmt.Sprintf("WriteRetries %d is negative", c.WriteRetries))
+	}
+	if c.PinnedPubkey != nil {
+		if _, err := decodePubkey(*c.PinnedPubkey); err != nil {
+			problems = append(problems, fmt.Sprintf("PinnedPubkey is invalid: %v", err))
+		}
+	} else if c.PinnedAddr != nil {
+		problems = append(problems, "PinnedAddr set without PinnedPubkey")
+	}
+	if c.MaxPongExpiration < 0 {
+		problems = append(problems, fmt.Sprintf("MaxPongExpiration %v is negative", c.MaxPongExpiration))
+	}
+	if c.WatchdogInterval < 0 {
+		problems = append(problems, fmt.Sprintf("WatchdogInterval %v is negative", c.WatchdogInterval))
+	} else if c.WatchdogInterval > 0 && !c.EnableWatchdog {
+		problems = append(problems, "WatchdogInterval set without EnableWatchdog")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%v: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ListenUDP returns a new table that listens for UDP packets on laddr.
+func ListenUDP(c Conn, cfg Config) (*V4Udp, error) {
+	v4Udp, err := newUDP(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("UDP listener up", "self")
+	return v4Udp, nil
+}
+
+func newUDP(c Conn, cfg Config) (*V4Udp, error) {
+	// a conn without a UDP address can't be checked, and needs AnnounceAddr, as below
+	bound, _ := LocalUDPAddr(c)
+	if err := cfg.validate(bound); err != nil {
+		return nil, err
+	}
+	realaddr := cfg.AnnounceAddr
+	if realaddr == nil {
+		laddr, err := LocalUDPAddr(c)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v, so AnnounceAddr is required", ErrInvalidConfig, err)
+		}
+		realaddr = laddr
+	}
+	//	self := enode.NewV4(&cfg.PrivateKey.PublicKey, realaddr.IP, realaddr.Port, realaddr.Port)
+	//	db, err := enode.OpenDB(cfg.NodeDBPath)
+	//	if err != nil {
+	//		return nil, err
+	//	}
+
+	udp := &V4Udp{
+		conn:              c,
+		priv:              cfg.PrivateKey,
+		netrestrict:       cfg.NetRestrict,
+		closing:           make(chan struct{}),
+		gotreply:          make(chan reply),
+		addpending:        make(chan *pending),
+		cancelpendings:    make(chan chan struct{}),
+		rand:              cfg.Rand,
+		neighbours:        cfg.Neighbours,
+		strictReplySource: cfg.StrictReplySource,
+		connFactory:       cfg.ConnFactory,
+		readBufferSize:    cfg.ReadBufferSize,
+		writeRetries:      cfg.WriteRetries,
+		pinned:            cfg.PinnedPubkey,
+		pinnedAddr:        cfg.PinnedAddr,
+		maxPongExpiration: cfg.MaxPongExpiration,
+		responder:         cfg.responder,
+	}
+	if udp.rand == nil {
+		udp.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if cfg.SendRateLimit > 0 {
+		udp.limiter = newTokenBucket(cfg.SendRateLimit)
+	}
+	if cfg.Loss > 0 || cfg.Jitter > 0 {
+		udp.conn = newLossyConn(c, cfg.Loss, cfg.Jitter, rand.New(rand.NewSource(udp.rand.Int63())))
+	}
+
+	udp.ourEndpoint = makeEndpoint(realaddr, uint16(realaddr.Port))
+	//	tab, err := newTable(udp, self, db, cfg.Bootnodes)
+	//	if err != nil {
+	//		return nil, err
+	//	}
+	//	udp.Table = tab
+
+	go udp.loop()
+	go udp.readLoop(cfg.Unhandled)
+	if cfg.EnableWatchdog {
+		interval := cfg.WatchdogInterval
+		if interval == 0 {
+			interval = watchdogPeriod
+		}
+		udp.onStuck = watchdogFatal
+		go udp.watchdog(interval)
+	}
+	return udp, nil
+}
+
+// Close shuts down the listener and fails any pending replies with ErrClosed.
+// It is safe to call more than once, including concurrently.
+func (t *V4Udp) Close() {
+	t.closeOnce.Do(func() {
+		close(t.closing)
+		t.conn.Close()
+		//t.db.Close()
+	})
+}
+
+// Done returns a channel that is closed once Close has been called.
+func (t *V4Udp) Done() <-chan struct{} {
+	return t.closing
+}
+
+// Ping sends a ping message to the given node and waits for a reply. If a public key is pinned
+// for toaddr in the config, the pong must be signed with it, and ErrPubkeyMismatch is returned
+// otherwise. Unlike validateEnodeID, which checks the pong against the node ID we were given,
+// this catches an enode URL naming a different node than the operator expects at the address.
+func (t *V4Udp) Ping(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if t.pinnedFor(toaddr) && inPacket.recoveredID != *t.pinned {
+				return fmt.Errorf("%v: answered by %x, pinned %x", ErrPubkeyMismatch, inPacket.recoveredID[:8], t.pinned[:8])
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			if recoveryCallback != nil {
+				key, err := decodePubkey(inPacket.recoveredID)
+				if err != nil {
+					recoveryCallback(key)
+				}
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// pinnedFor reports whether pongs from addr must be signed with the pinned key.
+func (t *V4Udp) pinnedFor(addr *net.UDPAddr) bool {
+	if t.pinned == nil {
+		return false
+	}
+	return t.pinnedAddr == nil || (t.pinnedAddr.IP.Equal(addr.IP) && t.pinnedAddr.Port == addr.Port)
+}
+
+// BondTiming breaks down the time taken to bond with a target, each phase measured from when
+// our ping was sent.
+type BondTiming struct {
+	PongReceived        time.Duration // the target answered our ping
+	ReversePingReceived time.Duration // the target pinged us back to check our endpoint
+	PongSent            time.Duration // we answered the reverse ping, completing the bond
+}
+
+// BondLatency measures how long the target takes to establish a bond in both directions. The
+// target only pings back peers it has no recent bond with, so the measurement is made from a
+// fresh identity on a new socket. It returns ErrTimeout if the target does not pong or does not
+// ping back.
+func (t *V4Udp) BondLatency(toid enode.ID, toaddr *net.UDPAddr) (BondTiming, error) {
+	var timing BondTiming
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return timing, err
+	}
+	c, err := t.listen(&net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		return timing, err
+	}
+	key, err := GenerateKey(t.rand)
+	if err != nil {
+		c.Close()
+		return timing, err
+	}
+	caddr, err := LocalUDPAddr(c)
+	if err != nil {
+		c.Close()
+		return timing, err
+	}
+	fresh, err := ListenUDP(c, Config{
+		PrivateKey:   key,
+		AnnounceAddr: &net.UDPAddr{IP: t.ourEndpoint.IP, Port: caddr.Port},
+		Rand:         rand.New(rand.NewSource(t.rand.Int63())),
+		ConnFactory:  t.connFactory,
+	})
+	if err != nil {
+		c.Close()
+		return timing, err
+	}
+	defer fresh.Close()
+
+	start := time.Now()
+	reversePing := fresh.pending(toid, func(p reply) error {
+		if p.ptype != PingPacket {
+			return ErrPacketMismatch
+		}
+		timing.ReversePingReceived = p.data.(incomingPacket).received.Sub(start)
+		timing.PongSent = time.Since(start)
+		return nil
+	})
+	if err := fresh.Ping(toid, toaddr, true, nil); err != nil {
+		return timing, err
+	}
+	timing.PongReceived = time.Since(start)
+	return timing, <-reversePing
+}
+
+// DetectOneWayBonding pings the target from a fresh identity, which it has no reason to trust
+// yet, and waits bondDeadline for the reverse ping that checks our endpoint. A target that
+// pongs but never pings back cannot complete the endpoint proof with any new peer, so real
+// peers never add it to their tables. This usually means its outbound UDP is blocked or not
+// mapped by its firewall or NAT. The error is ErrOneWayBond in that case, and ErrTimeout if
+// the target does not pong at all.
+func (t *V4Udp) DetectOneWayBonding(toid enode.ID, toaddr *net.UDPAddr) error {
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return err
+	}
+	key, err := GenerateKey(t.rand)
+	if err != nil {
+		return err
+	}
+	fresh, err := t.sibling(key, laddr.IP, nil)
+	if err != nil {
+		return err
+	}
+	defer fresh.Close()
+
+	err = fresh.waitBondedWithin(toid, toaddr, bondDeadline)
+	bie, ok := err.(*BondIncompleteError)
+	switch {
+	case !ok:
+		return err
+	case !bie.Pong:
+		return ErrTimeout
+	}
+	return fmt.Errorf("%v: pong after %v, no reverse ping within %v; check that the target can send UDP to new peers", ErrOneWayBond, bie.PongAfter, bie.Deadline)
+}
+
+// PongExpiration pings the target and returns how far into the future it set the expiration
+// of its pong, which should be a short while. A pong expiring beyond the configured
+// MaxPongExpiration is rejected, and the error is then ErrFarFuture. It is ErrTimeout if no
+// pong arrives.
+func (t *V4Udp) PongExpiration(toid enode.ID, toaddr *net.UDPAddr) (time.Duration, error) {
+	exp, err := t.pongExpiration(toid, toaddr)
+	return untilUnix(exp), err
+}
+
+// PongExpirationFreshness pings the target twice, gap apart, and returns how much later the
+// second pong expires than the first. A target computing the expiration as it sends each pong
+// gives about gap, one that computed it once and reuses it gives zero, and the error is then
+// ErrStaleExpiration. Expirations are in whole seconds, so gap should be at least a second.
+func (t *V4Udp) PongExpirationFreshness(toid enode.ID, toaddr *net.UDPAddr, gap time.Duration) (time.Duration, error) {
+	first, err := t.pongExpiration(toid, toaddr)
+	if err != nil {
+		return 0, err
+	}
+	time.Sleep(gap)
+	second, err := t.pongExpiration(toid, toaddr)
+	if err != nil {
+		return 0, err
+	}
+	delta := time.Duration(int64(second)-int64(first)) * time.Second
+	if delta <= 0 {
+		return delta, fmt.Errorf("%v: pongs %v apart expire at %d and %d", ErrStaleExpiration, gap, first, second)
+	}
+	return delta, nil
+}
+
+// pongExpiration pings the target and returns the expiration of its pong, as a Unix timestamp.
+// The error is ErrFarFuture if it is beyond MaxPongExpiration, with the expiration returned.
+func (t *V4Udp) pongExpiration(toid enode.ID, toaddr *net.UDPAddr) (uint64, error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		exp       uint64
+		farFuture bool
+	)
+	callback := func(p reply) error {
+		if p.ptype != PongPacket && p.ptype != farFuturePong {
+			return ErrPacketMismatch
+		}
+		pongReply := p.data.(incomingPacket).packet.(*pong)
+		if err := checkReplyTok(pongReply.ReplyTok, hash); err != nil {
+			return err
+		}
+		exp = pongReply.Expiration
+		farFuture = p.ptype == farFuturePong
+		return nil
+	}
+	if err := <-t.sendPacket(toid, toaddr, req, packet, callback); err != nil {
+		return 0, err
+	}
+	if farFuture {
+		return exp, fmt.Errorf("%v: expires in %v, limit %v", ErrFarFuture, untilUnix(exp), t.maxPongExpiration)
+	}
+	return exp, nil
+}
+
+// untilUnix returns the time until the Unix timestamp ts, capped at the largest duration for
+// timestamps too far ahead to be represented.
+func untilUnix(ts uint64) time.Duration {
+	now := uint64(time.Now().Unix())
+	if ts <= now {
+		return 0
+	}
+	if secs := ts - now; secs < uint64(math.MaxInt64/int64(time.Second)) {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+// PingCheckPongENRSeq pings the target and reads the ENR sequence number that EIP-868 adds as
+// the first extra field of the pong. present is false if the pong has no extra fields, as for
+// targets predating EIP-868. It returns ErrBadENRSeq if the field is not an integer.
+func (t *V4Udp) PingCheckPongENRSeq(toid enode.ID, toaddr *net.UDPAddr) (seq uint64, present bool, err error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return 0, false, err
+	}
+	callback := func(p reply) error {
+		if p.ptype != PongPacket {
+			return ErrPacketMismatch
+		}
+		pongReply := p.data.(incomingPacket).packet.(*pong)
+		if err := checkReplyTok(pongReply.ReplyTok, hash); err != nil {
+			return err
+		}
+		seq, present, err = pongENRSeq(pongReply)
+		return err
+	}
+	err = <-t.sendPacket(toid, toaddr, req, packet, callback)
+	return seq, present, err
+}
+
+// pongENRSeq decodes the EIP-868 ENR sequence number from the extra fields of a pong.
+func pongENRSeq(p *pong) (seq uint64, present bool, err error) {
+	if len(p.Rest) == 0 {
+		return 0, false, nil
+	}
+	if err := rlp.DecodeBytes(p.Rest[0], &seq); err != nil {
+		return 0, true, fmt.Errorf("%v: %v", ErrBadENRSeq, err)
+	}
+	return seq, true, nil
+}
+
+// PingWithRetry pings the target up to attempts times, retrying only on timeouts, so that
+// packet loss on the way does not fail a target that answers.
+func (t *V4Udp) PingWithRetry(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey), attempts int) (err error) {
+	for i := 0; i < attempts; i++ {
+		if err = t.Ping(toid, toaddr, validateEnodeID, recoveryCallback); err != ErrTimeout {
+			return err
+		}
+	}
+	return err
+}
+
+func (t *V4Udp) PingWrongFrom(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	from := makeEndpoint(&net.UDPAddr{IP: []byte{0, 1, 2, 3}, Port: 1}, 0) //this is a garbage endpoint
+
+	req := &ping{
+		Version:    4,
+		From:       from,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect the usual ping stuff - a bad 'from' should be ignored
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			if recoveryCallback != nil {
+				key, err := decodePubkey(inPacket.recoveredID)
+				if err != nil {
+					recoveryCallback(key)
+				}
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+func (t *V4Udp) PingWrongTo(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(&net.UDPAddr{IP: []byte{0, 1, 2, 3}, Port: 1}, 0)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return nil
+		}
+
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// ping with a 'to' endpoint whose IP is neither 4 nor 16 bytes long. A target may either
+// tolerate this (and pong, using the envelope address) or drop the packet as malformed.
+// The error is nil if the target ponged, ErrTimeout if it dropped the packet.
+func (t *V4Udp) PingBadToLength(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := RPCEndpoint{IP: []byte{1, 2, 3, 4, 5}, UDP: uint16(toaddr.Port), TCP: 0} //5 byte IP
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// listen opens an extra socket through the configured ConnFactory.
+func (t *V4Udp) listen(laddr *net.UDPAddr) (Conn, error) {
+	if t.connFactory == nil {
+		return ListenConn(laddr)
+	}
+	return t.connFactory(laddr)
+}
+
+// localSourceAddr returns the source address the OS uses for packets sent from our
+// socket to toaddr. The IP is obtained from the routing table via a connected socket,
+// the port is the one our listening socket is bound to.
+func (t *V4Udp) localSourceAddr(toaddr *net.UDPAddr) (*net.UDPAddr, error) {
+	laddr, err := LocalUDPAddr(t.conn)
+	if err != nil {
+		return nil, err
+	}
+	if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		return laddr, nil
+	}
+	route, err := net.DialUDP("udp", nil, toaddr)
+	if err != nil {
+		return nil, err
+	}
+	defer route.Close()
+	return &net.UDPAddr{IP: route.LocalAddr().(*net.UDPAddr).IP, Port: laddr.Port}, nil
+}
+
+// NATEchoAccuracy pings the target and compares the 'to' endpoint echoed in its pong with the
+// source address our packet was actually sent from. It returns the observed and echoed
+// endpoints, and ErrNATEchoMismatch if the IP or either port differs.
+func (t *V4Udp) NATEchoAccuracy(toid enode.ID, toaddr *net.UDPAddr) (observed, echoed RPCEndpoint, err error) {
+
+	source, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return observed, echoed, err
+	}
+	observed = makeEndpoint(source, t.ourEndpoint.TCP)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         makeEndpoint(toaddr, 0),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return observed, echoed, err
+	}
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+			pongReply := inPacket.packet.(*pong)
+
+			if err := checkReplyTok(pongReply.ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+			echoed = pongReply.To
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+	}
+	if err = <-t.sendPacket(toid, toaddr, req, packet, callback); err != nil {
+		return observed, echoed, err
+	}
+
+	if !observed.IP.Equal(echoed.IP) || observed.UDP != echoed.UDP || observed.TCP != echoed.TCP {
+		return observed, echoed, fmt.Errorf("%v: observed %v:%d/%d, echoed %v:%d/%d", ErrNATEchoMismatch,
+			observed.IP, observed.UDP, observed.TCP, echoed.IP, echoed.UDP, echoed.TCP)
+	}
+	return observed, echoed, nil
+}
+
+// ReversePingHonorsFromPort pings the target from a fresh identity, advertising in 'from' the
+// port of a second socket rather than the port the ping is sent from, as a node behind NAT
+// would. The target has not bonded with the fresh identity, so it should ping back on the
+// advertised port. The error is ErrReversePingPort if the reverse ping arrives on the
+// envelope port instead, and ErrTimeout if none arrives at all.
+func (t *V4Udp) ReversePingHonorsFromPort(toid enode.ID, toaddr *net.UDPAddr) error {
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return err
+	}
+	alt, err := t.listen(&net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		return err
+	}
+	defer alt.Close()
+	altAddr, err := LocalUDPAddr(alt)
+	if err != nil {
+		return err
+	}
+
+	key, err := GenerateKey(t.rand)
+	if err != nil {
+		return err
+	}
+	req := &ping{
+		Version:    4,
+		From:       makeEndpoint(altAddr, t.ourEndpoint.TCP),
+		To:         makeEndpoint(toaddr, 0),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, hash, err := encodePacket(key, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	altPing := make(chan error, 1)
+	go func() { altPing <- waitForPing(alt, toid, 2*respTimeout) }()
+
+	//a ping from the target to the envelope endpoint of ours arrives on our main socket, but
+	//so may one to our main identity, at the endpoint it was told
+	envelope := makeEndpoint(laddr, 0)
+	envelopePing := t.pending(toid, func(p reply) error {
+		if p.ptype != PingPacket {
+			return ErrPacketMismatch
+		}
+		to := p.data.(incomingPacket).packet.(*ping).To
+		if !to.IP.Equal(envelope.IP) || to.UDP != envelope.UDP {
+			return ErrPacketMismatch
+		}
+		return ErrReversePingPort
+	})
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash)
+		}
+		return ErrPacketMismatch
+	}
+	if err := <-t.sendPacket(toid, toaddr, req, packet, callback); err != nil {
+		return err
+	}
+	if err := <-envelopePing; err != ErrTimeout {
+		return err
+	}
+	return <-altPing
+}
+
+// waitForPing reads from c until a ping signed by id arrives or the timeout passes, in which
+// case ErrTimeout is returned.
+func waitForPing(c Conn, id enode.ID, timeout time.Duration) error {
+	return waitForPacket(c, id, (&ping{}).name(), timeout)
+}
+
+// waitForPacket reads from c until a packet of the named kind signed by id arrives or the
+// timeout passes, in which case ErrTimeout is returned.
+func waitForPacket(c Conn, id enode.ID, name string, timeout time.Duration) error {
+	d, ok := c.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return fmt.Errorf("conn %T does not support read deadlines", c)
+	}
+	d.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1280)
+	for {
+		n, _, err := c.ReadFromUDP(buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return ErrTimeout
+		} else if err != nil {
+			return err
+		}
+		p, fromKey, _, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if p.name() == name && fromKey.id() == id {
+			return nil
+		}
+	}
+}
+
+// ping with a signature that covers only the payload, excluding the packet type byte. The
+// key recovered over the spec digest will not match ours, so the target should drop the packet.
+// The error is ErrTimeout if the target rejected it, ErrUnsolicitedReply if it ponged.
+func (t *V4Udp) PingWrongSigScope(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacketWithSigScope(t.priv, PingPacket, req, headSize+1)
+	if err != nil {
+		return err
+	}
+
+	//expect no pong
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return ErrUnsolicitedReply
+		}
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// ping with a 'from' endpoint claiming the target's own IP. The target should ignore it and
+// pong to our real envelope address, echoing that address rather than its own in 'to'.
+func (t *V4Udp) PingFromSpoofedAsTarget(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	from := makeEndpoint(toaddr, uint16(toaddr.Port)) //the target's own endpoint
+
+	req := &ping{
+		Version:    4,
+		From:       from,
+		To:         to,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+			pongReply := inPacket.packet.(*pong)
+
+			if err := checkReplyTok(pongReply.ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			//on loopback or behind the same NAT our real IP is the target's too, so only
+			//the port tells the echoed envelope address from the spoofed one
+			if pongReply.To.IP.Equal(from.IP) && pongReply.To.UDP == from.UDP {
+				return ErrPongToSpoofed
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+//ping with a 'future format' packet containing extra fields
+func (t *V4Udp) PingExtraData(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	req := &pingExtra{
+		Version:   4,
+		From:      t.ourEndpoint,
+		To:        to,
+		JunkData1: 42,
+		JunkData2: []byte{9, 8, 7, 6, 5, 4, 3, 2, 1},
+
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect the usual ping responses
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			if recoveryCallback != nil {
+				key, err := decodePubkey(inPacket.recoveredID)
+				if err != nil {
+					recoveryCallback(key)
+				}
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+	}
+	return <-t.sendPacket(toid, toaddr, &ping{}, packet, callback) //the dummy ping is just to get the name
+
+}
+
+//ping with a 'future format' packet containing extra fields and make sure it works even with the wrong 'from' field
+func (t *V4Udp) PingExtraDataWrongFrom(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	from := makeEndpoint(&net.UDPAddr{IP: []byte{0, 1, 2, 3}, Port: 1}, 0) //this is a garbage endpoint
+
+	req := &pingExtra{
+		Version:   4,
+		From:      from,
+		To:        to,
+		JunkData1: 42,
+		JunkData2: []byte{9, 8, 7, 6, 5, 4, 3, 2, 1},
+
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect the usual ping reponses
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			if recoveryCallback != nil {
+				key, err := decodePubkey(inPacket.recoveredID)
+				if err != nil {
+					recoveryCallback(key)
+				}
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+	}
+	return <-t.sendPacket(toid, toaddr, &ping{}, packet, callback) //the dummy ping is just to get the name
+
+}
+
+// send a packet (a ping packet, though it could be something else) with an unknown packet type to the client and
+// see how the target behaves. If the target responds to the ping, then fail.
+func (t *V4Udp) PingTargetWrongPacketType(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, GarbagePacket8, req)
+	if err != nil {
+		return err
+	}
+
+	//expect anything but a ping or pong
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return ErrUnsolicitedReply
+		}
+
+		if p.ptype == PingPacket {
+			return ErrUnsolicitedReply
+		}
+
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+func (t *V4Udp) FindnodeWithoutBond(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+
+	req := &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, FindnodePacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect nothing
+	callback := func(p reply) error {
+
+		return ErrUnsolicitedReply
+	}
+
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// bond with the target using our own key, then call find neighbours from the same address
+// signed by a fresh key the target has never bonded with. Bonding belongs to the signing
+// identity, not the source address, so the target should ignore the find neighbours. The error
+// is ErrTimeout if it did, and ErrUnsolicitedReply if it answered.
+func (t *V4Udp) FindnodeSignedByUnbondedKey(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+	unbondedKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return err
+	}
+
+	req := &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err := encodePacket(unbondedKey, FindnodePacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect nothing
+	callback := func(p reply) error {
+		if p.ptype == NeighborsPacket {
+			return ErrUnsolicitedReply
+		}
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+func (t *V4Udp) PingBondedWithMangledFromField(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	//try to bond with the target using normal ping data
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	to := makeEndpoint(toaddr, 0)
+
+	from := makeEndpoint(&net.UDPAddr{IP: []byte{0, 1, 2, 3}, Port: 1}, 0) //this is a garbage endpoint
+
+	req := &ping{
+		Version:    4,
+		From:       from,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect the usual ping stuff - a bad 'from' should be ignored
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			inPacket := p.data.(incomingPacket)
+
+			if err := checkReplyTok(inPacket.packet.(*pong).ReplyTok, hash); err != nil {
+				return err
+			}
+
+			if validateEnodeID && toid != inPacket.recoveredID.id() {
+				return ErrUnknownNode
+			}
+
+			if recoveryCallback != nil {
+				key, err := decodePubkey(inPacket.recoveredID)
+				if err != nil {
+					recoveryCallback(key)
+				}
+			}
+		} else {
+			return ErrPacketMismatch
+		}
+		return nil
+
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+func (t *V4Udp) BondedSourceFindNeighbours(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	//try to bond with the target
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	//send an unsolicited neighbours packet
+	encFakeKey, err := t.sendFakeNeighbour(toaddr, t.priv)
+	if err != nil {
+		return err
+	}
+
+	//now call find neighbours
+	return t.findnodeWithoutFakeNeighbour(toid, toaddr, target, encFakeKey)
+
+}
+
+// send an unsolicited neighbours packet to the target, signed by the given key, listing a fake node.
+// The key of the fake node is returned.
+func (t *V4Udp) sendFakeNeighbour(toaddr *net.UDPAddr, signer *ecdsa.PrivateKey) (EncPubkey, error) {
+	packet, encFakeKey, err := t.fakeNeighbourPacket(signer, uint64(time.Now().Add(expiration).Unix()))
+	if err != nil {
+		return EncPubkey{}, err
+	}
+	return encFakeKey, t.write(toaddr, (&neighbors{}).name(), packet)
+}
+
+// poisonedEndpoint is the endpoint PoisonSelfNeighbour claims for our node.
+var poisonedEndpoint = RPCEndpoint{IP: net.IP{1, 2, 3, 4}, UDP: 123, TCP: 123}
+
+// PoisonSelfNeighbour bonds with the target, then sends it an unsolicited neighbours packet
+// from a third party listing our own node at poisonedEndpoint. It then calls find neighbours
+// for our own ID and checks that the target still lists us at the endpoint it bonded with.
+// found is false if the target does not list us at all, in which case nothing was checked.
+// The error is ErrPoisonedEndpoint if the target lists us at the poisoned endpoint.
+func (t *V4Udp) PoisonSelfNeighbour(toid enode.ID, toaddr *net.UDPAddr) (found bool, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return false, err
+	}
+
+	thirdKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return false, err
+	}
+	self := EncodePubkey(&t.priv.PublicKey)
+	poison := &neighbors{
+		Nodes:      []rpcNode{{ID: self, IP: poisonedEndpoint.IP, UDP: poisonedEndpoint.UDP, TCP: poisonedEndpoint.TCP}},
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err := encodePacket(thirdKey, NeighborsPacket, poison)
+	if err != nil {
+		return false, err
+	}
+	if err := t.write(toaddr, poison.name(), packet); err != nil {
+		return false, err
+	}
+
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     self,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case !received:
+		return false, ErrTimeout
+	}
+	for _, rn := range nodes {
+		if rn.ID != self {
+			continue
+		}
+		if rn.IP.Equal(poisonedEndpoint.IP) && rn.UDP == poisonedEndpoint.UDP {
+			return true, fmt.Errorf("%v: listed at %v:%d", ErrPoisonedEndpoint, rn.IP, rn.UDP)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// RePingUpdatesEndpoint bonds with the target from our main socket, endpoint A, then pings it
+// with the same identity from a second socket, endpoint B, as a node whose NAT mapping changed
+// would. A third party then bonds with the target and calls find neighbours for our ID, and
+// the target should list us at B. found is false if the target does not list us at all, in
+// which case nothing was checked. The error is ErrStaleEndpoint if it lists us at A.
+func (t *V4Udp) RePingUpdatesEndpoint(toid enode.ID, toaddr *net.UDPAddr) (found bool, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return false, err
+	}
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return false, err
+	}
+
+	moved, err := t.sibling(t.priv, laddr.IP, nil)
+	if err != nil {
+		return false, err
+	}
+	defer moved.Close()
+	if err := moved.Ping(toid, toaddr, false, nil); err != nil {
+		return false, fmt.Errorf("re-ping from new endpoint: %v", err)
+	}
+	//the target may check the new endpoint before taking it, give it time to ping B
+	<-moved.pending(toid, func(p reply) error {
+		if p.ptype != PingPacket {
+			return ErrPacketMismatch
+		}
+		return nil
+	})
+
+	thirdKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return false, err
+	}
+	third, err := t.sibling(thirdKey, laddr.IP, nil)
+	if err != nil {
+		return false, err
+	}
+	defer third.Close()
+	if err := third.waitBonded(toid, toaddr); err != nil {
+		return false, fmt.Errorf("third party bond: %v", err)
+	}
+	self := EncodePubkey(&t.priv.PublicKey)
+	nodes, received, err := third.collectNeighbours(toid, toaddr, &findnode{
+		Target:     self,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case !received:
+		return false, ErrTimeout
+	}
+	for _, rn := range nodes {
+		if rn.ID != self {
+			continue
+		}
+		if int(rn.UDP) == laddr.Port && rn.IP.Equal(laddr.IP) {
+			return true, fmt.Errorf("%v: listed at %v:%d, re-pinged from port %d", ErrStaleEndpoint, rn.IP, rn.UDP, moved.ourEndpoint.UDP)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// sibling starts a second listener with the given key on a fresh socket at ip, opened through
+// the conn factory. It answers pings like our main listener, so it can bond on its own, and
+// findnode from bonded nodes with neighbours, unless they are nil.
+func (t *V4Udp) sibling(key *ecdsa.PrivateKey, ip net.IP, neighbours []*enode.Node) (*V4Udp, error) {
+	c, err := t.listen(&net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := LocalUDPAddr(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	sib, err := newUDP(c, Config{
+		PrivateKey:   key,
+		AnnounceAddr: &net.UDPAddr{IP: ip, Port: laddr.Port},
+		Neighbours:   neighbours,
+		Rand:         rand.New(rand.NewSource(t.rand.Int63())),
+		ConnFactory:  t.connFactory,
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sib, nil
+}
+
+// fakeNeighbourPacket encodes a neighbours packet listing a single fake node whose key is drawn
+// from the test randomness source.
+func (t *V4Udp) fakeNeighbourPacket(signer *ecdsa.PrivateKey, expiration uint64) ([]byte, EncPubkey, error) {
+	fakeKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return nil, EncPubkey{}, err
+	}
+	encFakeKey := EncodePubkey(&fakeKey.PublicKey)
+	fakeNeighbour := rpcNode{ID: encFakeKey, IP: net.IP{1, 2, 3, 4}, UDP: 123, TCP: 123}
+	req := neighbors{Nodes: []rpcNode{fakeNeighbour}, Expiration: expiration}
+
+	packet, _, err := encodePacket(signer, NeighborsPacket, &req)
+	if err != nil {
+		return nil, EncPubkey{}, err
+	}
+	return packet, encFakeKey, nil
+}
+
+// call find neighbours on a bonded target and expect a neighbours response that does not include the fake node.
+func (t *V4Udp) findnodeWithoutFakeNeighbour(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey, encFakeKey EncPubkey) error {
+	findReq := &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, FindnodePacket, findReq)
+	if err != nil {
+		return err
+	}
+
+	//expect good neighbours response with no junk
+	callback := func(p reply) error {
+
+		if p.ptype == NeighborsPacket {
+			//got a response.
+			//we assume the target is not connected to a public or populated bootnode
+			//so we assume the target does not have any other neighbours in the DHT
+			inPacket := p.data.(incomingPacket)
+			nodes := inPacket.packet.(*neighbors).Nodes
+
+			for _, neighbour := range nodes {
+				if neighbour.ID == encFakeKey {
+					return ErrCorruptDHT
+				}
+			}
+			return t.checkNeighbours(toaddr, nodes)
+
+		}
+		return ErrUnsolicitedReply
+	}
+
+	return <-t.sendPacket(toid, toaddr, findReq, packet, callback)
+
+}
+
+// checkNeighbours runs every node of a neighbours response through nodeFromRPC, as a real
+// client would before adding it to its table. It returns ErrInvalidNeighbours listing the
+// filtered count and offending entries, for example a private IP relayed by a public target.
+func (t *V4Udp) checkNeighbours(sender *net.UDPAddr, nodes []rpcNode) error {
+	var invalid []string
+	for _, rn := range nodes {
+		if _, err := t.nodeFromRPC(sender, rn); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%x@%v:%d (%v)", rn.ID[:8], rn.IP, rn.UDP, err))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%v: %d of %d filtered: %s", ErrInvalidNeighbours, len(invalid), len(nodes), strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// FindnodeForKnownNeighbour bonds with the target, which should then hold us in its table,
+// and calls find neighbours with our own ID as the target. An exact match is the closest
+// possible node, so we must appear in the response. It returns ErrMissingNeighbour if we
+// don't, and ErrTimeout if no neighbours arrive at all.
+func (t *V4Udp) FindnodeForKnownNeighbour(toid enode.ID, toaddr *net.UDPAddr) error {
+	//try to bond with the target
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	self := EncodePubkey(&t.priv.PublicKey)
+	findReq := &findnode{
+		Target:     self,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, FindnodePacket, findReq)
+	if err != nil {
+		return err
+	}
+
+	//the response may span several packets, wait until one of them lists us
+	var received int
+	callback := func(p reply) error {
+		if p.ptype != NeighborsPacket {
+			return ErrPacketMismatch
+		}
+		for _, neighbour := range p.data.(incomingPacket).packet.(*neighbors).Nodes {
+			received++
+			if neighbour.ID == self {
+				return nil
+			}
+		}
+		return ErrPacketMismatch
+	}
+
+	err = <-t.sendPacket(toid, toaddr, findReq, packet, callback)
+	if err == ErrTimeout && received > 0 {
+		return fmt.Errorf("%v: not among %d nodes returned", ErrMissingNeighbour, received)
+	}
+	return err
+}
+
+// FindnodeChunking calls find neighbours on a bonded target and collects every neighbours
+// packet of the response. It returns ErrBadChunking if the response is over-fragmented or
+// ends with a spurious empty packet, and ErrTimeout if no neighbours arrive at all.
+func (t *V4Udp) FindnodeChunking(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	//try to bond with the target
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	packets, err := t.collectNeighbourPackets(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return err
+	}
+	if len(packets) == 0 {
+		return ErrTimeout
+	}
+	chunks := make([][]rpcNode, len(packets))
+	for i, p := range packets {
+		chunks[i] = p.nodes
+	}
+	return checkChunking(chunks)
+}
+
+// FindnodeNoPrivateLeak calls find neighbours on a bonded target and scans every node returned
+// for private, loopback, link-local and unspecified IPs. Such addresses are expected from a
+// target that is itself on a private network, but a public target returning them leaks its LAN
+// topology. It returns ErrPrivateLeak listing the offending nodes, and ErrTimeout if no
+// neighbours arrive at all.
+func (t *V4Udp) FindnodeNoPrivateLeak(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return err
+	}
+	if !received {
+		return ErrTimeout
+	}
+	if leaks := privateLeaks(toaddr.IP, nodes); len(leaks) > 0 {
+		return fmt.Errorf("%v: %d of %d nodes: %s", ErrPrivateLeak, len(leaks), len(nodes), strings.Join(leaks, ", "))
+	}
+	return nil
+}
+
+// FindnodeNeighbourLiveness calls find neighbours on a bonded target and pings every node it
+// returns, other than ourselves, to see how many are still live. A target that keeps its table
+// fresh returns mostly live nodes, one that never evicts returns dead entries. It returns the
+// number of nodes that answered and the number pinged, and ErrTimeout if no neighbours arrive
+// at all.
+func (t *V4Udp) FindnodeNeighbourLiveness(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) (live, pinged int, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, 0, err
+	}
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	switch {
+	case err != nil:
+		return 0, 0, err
+	case !received:
+		return 0, 0, ErrTimeout
+	}
+	//we would only be pinging ourselves, and drop our own packets
+	self := EncodePubkey(&t.priv.PublicKey)
+	others := nodes[:0]
+	for _, rn := range nodes {
+		if rn.ID != self {
+			others = append(others, rn)
+		}
+	}
+	return len(t.pingAll(others)), len(others), nil
+}
+
+// LiveNeighbours bonds with the target, calls find neighbours for target, and returns the
+// nodes returned that pass validation and answer a ping from the node ID listed, for use as
+// static or bootstrap nodes. The error is ErrTimeout if the target returned no nodes.
+func (t *V4Udp) LiveNeighbours(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) ([]*enode.Node, error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return nil, err
+	}
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !received {
+		return nil, ErrTimeout
+	}
+	var valid []rpcNode
+	for _, rn := range nodes {
+		if _, err := t.nodeFromRPC(toaddr, rn); err == nil {
+			valid = append(valid, rn)
+		}
+	}
+	var live []*enode.Node
+	for _, rn := range t.pingAll(valid) {
+		n, _ := t.nodeFromRPC(toaddr, rn)
+		live = append(live, &n.Node)
+	}
+	return live, nil
+}
+
+// pingAll pings every node at once and returns those that answered from the node ID listed,
+// in the order given.
+func (t *V4Udp) pingAll(nodes []rpcNode) []rpcNode {
+	answered := make([]bool, len(nodes))
+	var wg sync.WaitGroup
+	for i, rn := range nodes {
+		wg.Add(1)
+		go func(i int, rn rpcNode) {
+			defer wg.Done()
+			answered[i] = t.Ping(rn.ID.id(), &net.UDPAddr{IP: rn.IP, Port: int(rn.UDP)}, true, nil) == nil
+		}(i, rn)
+	}
+	wg.Wait()
+	var live []rpcNode
+	for i, rn := range nodes {
+		if answered[i] {
+			live = append(live, rn)
+		}
+	}
+	return live
+}
+
+// FindnodeZeroTarget calls find neighbours on a bonded target with an all-zero target key.
+// This is a valid request at the edge of the keyspace (the lookup is for nodes closest to the
+// hash of the zero key), so the target should answer as for any other target. It returns the
+// number of nodes received, ErrTimeout if no neighbours arrive, and ErrInvalidNeighbours if
+// any node returned fails validation.
+func (t *V4Udp) FindnodeZeroTarget(toid enode.ID, toaddr *net.UDPAddr) (int, error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, err
+	}
+
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     EncPubkey{},
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return len(nodes), err
+	}
+	if !received {
+		return 0, ErrTimeout
+	}
+	return len(nodes), t.checkNeighbours(toaddr, nodes)
+}
+
+// FindnodeForRequesterSelf calls find neighbours on a bonded target for our own node ID, the ID
+// of the requester, and checks the nodes returned as FindnodeZeroTarget does. It returns how
+// many nodes other than us were returned, and whether we were among them. The spec does not
+// say whether the requester belongs in its own lookup, and go-ethereum includes it, as
+// FindnodeForKnownNeighbour relies on, so that is reported rather than failed. The error is
+// ErrTimeout if no neighbours arrive, and ErrInvalidNeighbours if any node fails validation.
+func (t *V4Udp) FindnodeForRequesterSelf(toid enode.ID, toaddr *net.UDPAddr) (others int, includesSelf bool, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, false, err
+	}
+	self := EncodePubkey(&t.priv.PublicKey)
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     self,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if !received {
+		return 0, false, ErrTimeout
+	}
+	for _, rn := range nodes {
+		if rn.ID == self {
+			includesSelf = true
+		} else {
+			others++
+		}
+	}
+	return others, includesSelf, t.checkNeighbours(toaddr, nodes)
+}
+
+// FindnodeExpectExactly calls find neighbours on a bonded target and collects every neighbours
+// packet of the response. For a network whose topology is fixed, the set of returned IDs must
+// equal expected, in any order and ignoring duplicates. It returns ErrNeighbourSet listing the
+// missing and unexpected nodes, and ErrTimeout if no neighbours arrive at all.
+func (t *V4Udp) FindnodeExpectExactly(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey, expected []enode.ID) error {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	nodes, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return err
+	}
+	if !received {
+		return ErrTimeout
+	}
+	got := make([]enode.ID, len(nodes))
+	for i, rn := range nodes {
+		got[i] = rn.ID.id()
+	}
+
+	missing, unexpected := neighbourSetDiff(expected, got)
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v: missing %v, unexpected %v", ErrNeighbourSet, shortIDs(missing), shortIDs(unexpected))
+}
+
+// neighbourSetDiff compares the set of got against expected, returning the IDs only in
+// expected and those only in got. Duplicates are reported once.
+func neighbourSetDiff(expected, got []enode.ID) (missing, unexpected []enode.ID) {
+	want := make(map[enode.ID]bool, len(expected))
+	for _, id := range expected {
+		want[id] = true
+	}
+	seen := make(map[enode.ID]bool, len(got))
+	for _, id := range got {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if !want[id] {
+			unexpected = append(unexpected, id)
+		}
+	}
+	for _, id := range expected {
+		if !seen[id] {
+			seen[id] = true
+			missing = append(missing, id)
+		}
+	}
+	return missing, unexpected
+}
+
+func shortIDs(ids []enode.ID) []string {
+	short := make([]string, len(ids))
+	for i, id := range ids {
+		short[i] = fmt.Sprintf("%x", id[:8])
+	}
+	return short
+}
+
+// FindnodeExpiredAfterBond bonds with the target and calls find neighbours twice in the same
+// session, first with a valid expiration and then with one in the past. Neighbours coming back
+// for the first call prove the bond, so the second going unanswered is down to its expiration
+// alone. bonded is nil if the first call was answered and ErrTimeout if not. expired is
+// ErrTimeout if the target ignored the second call, and ErrUnsolicitedReply if it answered.
+func (t *V4Udp) FindnodeExpiredAfterBond(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) (bonded, expired error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err, err
+	}
+
+	_, received, err := t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	switch {
+	case err != nil:
+		bonded = err
+	case !received:
+		bonded = ErrTimeout
+	}
+
+	_, received, err = t.collectNeighbours(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(-expiration).Unix()),
+	})
+	switch {
+	case err != nil:
+		expired = err
+	case received:
+		expired = ErrUnsolicitedReply
+	default:
+		expired = ErrTimeout
+	}
+	return bonded, expired
+}
+
+// collectNeighbours sends req and collects the nodes of every neighbours packet until the
+// response times out, so that no packet of the response is left to arrive later. received
+// reports whether any neighbours packet arrived.
+func (t *V4Udp) collectNeighbours(toid enode.ID, toaddr *net.UDPAddr, req *findnode) (nodes []rpcNode, received bool, err error) {
+	packets, err := t.collectNeighbourPackets(toid, toaddr, req)
+	for _, p := range packets {
+		if p.oversized == 0 {
+			received = true
+			nodes = append(nodes, p.nodes...)
+		}
+	}
+	return nodes, received, err
+}
+
+// neighboursPacket is one packet of a neighbours response.
+type neighboursPacket struct {
+	nodes     []rpcNode
+	oversized int // length of the packet if above maxPacketSize, zero otherwise
+}
+
+// collectNeighbourPackets is collectNeighbours for tests that check how the response is
+// split, returning the packets in the order they arrived. Unlike collectNeighbours, it
+// includes the packets above maxPacketSize, which are not handled otherwise.
+func (t *V4Udp) collectNeighbourPackets(toid enode.ID, toaddr *net.UDPAddr, req *findnode) ([]neighboursPacket, error) {
+	packet, _, err := encodePacket(t.priv, FindnodePacket, req)
+	if err != nil {
+		return nil, err
+	}
+	return t.collectNeighbourReply(toid, toaddr, req, packet)
+}
+
+// collectNeighbourReply is collectNeighbourPackets for req already encoded as packet, for tests
+// that send the same packet again.
+func (t *V4Udp) collectNeighbourReply(toid enode.ID, toaddr *net.UDPAddr, req *findnode, packet []byte) (packets []neighboursPacket, err error) {
+	callback := func(p reply) error {
+		in := p.data.(incomingPacket)
+		n, ok := in.packet.(*neighbors)
+		switch {
+		case ok && p.ptype == NeighborsPacket:
+			packets = append(packets, neighboursPacket{nodes: n.Nodes})
+		case ok && p.ptype == oversizedPacket:
+			packets = append(packets, neighboursPacket{nodes: n.Nodes, oversized: in.size})
+		}
+		return ErrPacketMismatch
+	}
+	if err := <-t.sendPacket(toid, toaddr, req, packet, callback); err != ErrTimeout {
+		return packets, err
+	}
+	return packets, nil
+}
+
+// DoubleFindnode calls find neighbours twice in quick succession on a bonded target, for two
+// random targets in opposite halves of the ID space. Neighbours packets don't say which
+// request they answer, so each packet is attributed to the target most of its nodes are
+// closer to. It returns the number of nodes attributed to each request. The error is
+// ErrFindnodeDropped if only one of them was answered, and ErrTimeout if neither was.
+func (t *V4Udp) DoubleFindnode(toid enode.ID, toaddr *net.UDPAddr) (first, second int, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, 0, err
+	}
+
+	targets := t.oppositeTargets()
+	counts := make([]int, len(targets))
+	errcs := make([]<-chan error, len(targets))
+	for i, target := range targets {
+		i, self, other := i, target.id(), targets[1-i].id()
+		req := &findnode{
+			Target:     target,
+			Expiration: uint64(time.Now().Add(expiration).Unix()),
+		}
+		packet, _, err := encodePacket(t.priv, FindnodePacket, req)
+		if err != nil {
+			return 0, 0, err
+		}
+		//both callbacks see every neighbours packet and keep only those for their own target
+		callback := func(p reply) error {
+			if p.ptype == NeighborsPacket {
+				nodes := p.data.(incomingPacket).packet.(*neighbors).Nodes
+				if closerTo(nodes, self, other) {
+					counts[i] += len(nodes)
+				}
+			}
+			return ErrPacketMismatch
+		}
+		errcs[i] = t.sendPacket(toid, toaddr, req, packet, callback)
+	}
+	for _, errc := range errcs {
+		if err := <-errc; err != ErrTimeout {
+			return counts[0], counts[1], err
+		}
+	}
+
+	switch {
+	case counts[0] == 0 && counts[1] == 0:
+		err = ErrTimeout
+	case counts[0] == 0:
+		err = fmt.Errorf("%v: first of two requests", ErrFindnodeDropped)
+	case counts[1] == 0:
+		err = fmt.Errorf("%v: second of two requests", ErrFindnodeDropped)
+	}
+	return counts[0], counts[1], err
+}
+
+// oppositeTargets returns two random findnode targets whose IDs differ in the top bit, so
+// that the nodes closest to each lie in different halves of the ID space.
+func (t *V4Udp) oppositeTargets() [2]EncPubkey {
+	var targets [2]EncPubkey
+	for {
+		t.rand.Read(targets[0][:])
+		t.rand.Read(targets[1][:])
+		if (targets[0].id()[0]^targets[1].id()[0])&0x80 != 0 {
+			return targets
+		}
+	}
+}
+
+// closerTo reports whether most of nodes are closer to a than to b. On a tie it reports
+// whether the first node is, as a response is sorted by distance to its target.
+func closerTo(nodes []rpcNode, a, b enode.ID) bool {
+	var votes int
+	for _, rn := range nodes {
+		votes -= enode.DistCmp(rn.ID.id(), a, b)
+	}
+	if votes == 0 && len(nodes) > 0 {
+		return enode.DistCmp(nodes[0].ID.id(), a, b) < 0
+	}
+	return votes > 0
+}
+
+// FindnodeIPv6Chunking calls find neighbours on a bonded target and checks that every
+// neighbours packet holding IPv6 nodes stays within maxPacketSize. IPv6 nodes are 12 bytes
+// larger than IPv4 ones, so fewer fit in a packet, and a target that chunks by the IPv4 count
+// sends packets over the limit. It returns the number of IPv6 nodes received, and
+// ErrPacketTooLarge if a packet was oversized. An oversized packet is only read in full with a
+// ReadBufferSize above maxPacketSize; otherwise it is truncated and dropped. A target
+// returning no IPv6 nodes doesn't exercise the check at all.
+func (t *V4Udp) FindnodeIPv6Chunking(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) (int, error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, err
+	}
+
+	packets, err := t.collectNeighbourPackets(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(packets) == 0 {
+		return 0, ErrTimeout
+	}
+	var (
+		ipv6      int
+		oversized []string
+	)
+	for _, p := range packets {
+		var v6 int
+		for _, rn := range p.nodes {
+			if rn.IP.To4() == nil {
+				v6++
+			}
+		}
+		ipv6 += v6
+		if p.oversized > 0 {
+			oversized = append(oversized, fmt.Sprintf("%d bytes with %d nodes, %d IPv6", p.oversized, len(p.nodes), v6))
+		}
+	}
+	if len(oversized) > 0 {
+		return ipv6, fmt.Errorf("%v: %s", ErrPacketTooLarge, strings.Join(oversized, ", "))
+	}
+	return ipv6, nil
+}
+
+// FindnodeMixedFamilyChunking calls find neighbours on a bonded target and checks that a
+// response mixing IPv4 and IPv6 nodes is chunked by the actual size of the nodes in each
+// packet. Every packet must stay within maxPacketSize, and a target that packs by the IPv4
+// size overflows once IPv6 nodes are in the packet. If expected is not nil, every node in it
+// must be returned, so that a target trimming nodes to fit a packet is caught. It returns the
+// number of IPv4 and IPv6 nodes received, ErrPacketTooLarge if a packet was oversized and
+// ErrMissingNeighbour if an expected node was dropped. As for FindnodeIPv6Chunking, oversized
+// packets are only seen with a ReadBufferSize above maxPacketSize.
+func (t *V4Udp) FindnodeMixedFamilyChunking(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey, expected []enode.ID) (ipv4, ipv6 int, err error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, 0, err
+	}
+
+	packets, err := t.collectNeighbourPackets(toid, toaddr, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(packets) == 0 {
+		return 0, 0, ErrTimeout
+	}
+	var (
+		got       []enode.ID
+		oversized []string
+	)
+	for _, p := range packets {
+		var v4, v6 int
+		for _, rn := range p.nodes {
+			if rn.IP.To4() == nil {
+				v6++
+			} else {
+				v4++
+			}
+			got = append(got, rn.ID.id())
+		}
+		ipv4 += v4
+		ipv6 += v6
+		if p.oversized > 0 {
+			oversized = append(oversized, fmt.Sprintf("%d bytes with %d IPv4 and %d IPv6 nodes", p.oversized, v4, v6))
+		}
+	}
+	if len(oversized) > 0 {
+		return ipv4, ipv6, fmt.Errorf("%v: %s", ErrPacketTooLarge, strings.Join(oversized, ", "))
+	}
+	if missing, _ := neighbourSetDiff(expected, got); len(missing) > 0 {
+		return ipv4, ipv6, fmt.Errorf("%v: dropped %v", ErrMissingNeighbour, shortIDs(missing))
+	}
+	return ipv4, ipv6, nil
+}
+
+// addressClass names the kind of internal address ip is, or returns "" for a public address.
+func addressClass(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	case netutil.IsLAN(ip):
+		return "private"
+	}
+	return ""
+}
+
+// privateLeaks returns the nodes whose IPs the sender should not relay. Unspecified addresses
+// are never valid. A public sender should relay only public addresses, and a sender on a private
+// network may relay loopback addresses only if it is on loopback itself.
+func privateLeaks(sender net.IP, nodes []rpcNode) []string {
+	senderClass := addressClass(sender)
+	var leaks []string
+	for _, rn := range nodes {
+		class := addressClass(rn.IP)
+		if class == "" {
+			continue
+		}
+		leak := class == "unspecified" || senderClass == "" || (class == "loopback" && senderClass != "loopback")
+		if !leak {
+			continue
+		}
+		leaks = append(leaks, fmt.Sprintf("%x@%v (%s)", rn.ID[:8], rn.IP, class))
+	}
+	return leaks
+}
+
+// chunkNeighbours splits a findnode result into neighbours packets of at most maxNeighbors
+// nodes, as our findnode handler sends them. An empty result is sent as one empty packet,
+// but a result that exactly fills its last packet gets no trailing empty packet.
+func chunkNeighbours(nodes []rpcNode) [][]rpcNode {
+	var chunks [][]rpcNode
+	for len(nodes) > maxNeighbors {
+		chunks = append(chunks, nodes[:maxNeighbors])
+		nodes = nodes[maxNeighbors:]
+	}
+	if len(nodes) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, nodes)
+	}
+	return chunks
+}
+
+// bucketSize is the number of closest nodes sent in answer to a findnode.
+const bucketSize = 16
+
+// closestNeighbours returns the bucketSize configured neighbours closest to target that may be
+// relayed to sender, in order of distance.
+func (t *V4Udp) closestNeighbours(sender *net.UDPAddr, target enode.ID) []rpcNode {
+	var nodes []*enode.Node
+	for _, n := range t.neighbours {
+		if netutil.CheckRelayIP(sender.IP, n.IP()) == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return enode.DistCmp(target, nodes[i].ID(), nodes[j].ID()) < 0
+	})
+	if len(nodes) > bucketSize {
+		nodes = nodes[:bucketSize]
+	}
+	closest := make([]rpcNode, len(nodes))
+	for i, n := range nodes {
+		closest[i] = nodeToRPC(wrapNode(n))
+	}
+	return closest
+}
+
+// bonded reports whether a bond with id made within bondExpiration is cached.
+func (t *V4Udp) bonded(id enode.ID) bool {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+	last, ok := t.bondCache[id]
+	return ok && time.Since(last) < bondExpiration
+}
+
+// checkChunking verifies that the packets of a neighbours response are split as chunkNeighbours
+// would: every packet but the last is full, and only a lone packet may be empty.
+func checkChunking(chunks [][]rpcNode) error {
+	for i, chunk := range chunks {
+		if i < len(chunks)-1 && len(chunk) < maxNeighbors {
+			return fmt.Errorf("%v: packet %d of %d has %d nodes, want %d", ErrBadChunking, i+1, len(chunks), len(chunk), maxNeighbors)
+		}
+		if i > 0 && len(chunk) == 0 {
+			return fmt.Errorf("%v: trailing empty packet", ErrBadChunking)
+		}
+	}
+	return nil
+}
+
+// RequestENR asks the target for its node record (EIP-868) and returns it as a node, after
+// checking that the record is validly signed by the target. Targets only answer bonded peers.
+func (t *V4Udp) RequestENR(toid enode.ID, toaddr *net.UDPAddr) (*enode.Node, error) {
+	req := &enrRequest{
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+
+	packet, hash, err := encodePacket(t.priv, ENRRequestPacket, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var n *enode.Node
+	callback := func(p reply) error {
+		if p.ptype != ENRResponsePacket {
+			return ErrPacketMismatch
+		}
+		resp := p.data.(incomingPacket).packet.(*enrResponse)
+		if err := checkReplyTok(resp.ReplyTok, hash); err != nil {
+			return err
+		}
+		var err error
+		if n, err = enode.New(enode.ValidSchemes, &resp.Record); err != nil {
+			return err
+		}
+		if n.ID() != toid {
+			return ErrUnknownNode
+		}
+		return nil
+	}
+
+	if err := <-t.sendPacket(toid, toaddr, req, packet, callback); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ENRLargeResponse bonds with the target, requests its node record and returns the record's
+// encoded size. The size is read from the raw response, so that a record too large for the
+// enr package to decode is measured too. The error is ErrENRTooLarge if the record exceeds the
+// EIP-778 limit of 300 bytes, and ErrPacketTooLarge if the response exceeds the 1280 byte
+// packet limit. A response larger than the read buffer is cut short and fails its hash check,
+// so it shows up as ErrTimeout, as does no response at all.
+func (t *V4Udp) ENRLargeResponse(toid enode.ID, toaddr *net.UDPAddr) (int, error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return 0, err
+	}
+	req := &enrRequest{Expiration: uint64(time.Now().Add(expiration).Unix())}
+	packet, hash, err := encodePacket(t.priv, ENRRequestPacket, req)
+	if err != nil {
+		return 0, err
+	}
+	rawc := t.addRawWaiter(toid)
+	defer t.removeRawWaiter(toid, rawc)
+	if err := t.write(toaddr, req.name(), packet); err != nil {
+		return 0, err
+	}
+
+	timeout := time.After(respTimeout)
+	for {
+		select {
+		case raw := <-rawc:
+			size, err := enrRecordSize(raw, hash)
+			switch {
+			case err == ErrPacketMismatch:
+				continue
+			case err != nil:
+				return 0, err
+			case len(raw) > maxPacketSize:
+				return size, fmt.Errorf("%v: ENR response of %d bytes", ErrPacketTooLarge, len(raw))
+			case size > enr.SizeLimit:
+				return size, fmt.Errorf("%v: %d bytes", ErrENRTooLarge, size)
+			}
+			return size, nil
+		case <-timeout:
+			return 0, ErrTimeout
+		case <-t.closing:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// enrRecordSize returns the encoded size of the record in the raw packet, if it is an ENR
+// response to the request with the given hash, and ErrPacketMismatch otherwise.
+func enrRecordSize(raw, hash []byte) (int, error) {
+	if len(raw) <= headSize || raw[headSize] != ENRResponsePacket {
+		return 0, ErrPacketMismatch
+	}
+	var resp struct {
+		ReplyTok []byte
+		Record   rlp.RawValue
+		Rest     []rlp.RawValue `rlp:"tail"`
+	}
+	if err := rlp.NewStream(bytes.NewReader(raw[headSize+1:]), 0).Decode(&resp); err != nil {
+		return 0, err
+	}
+	if checkReplyTok(resp.ReplyTok, hash) != nil {
+		return 0, ErrPacketMismatch
+	}
+	return len(resp.Record), nil
+}
+
+// ProtocolSupport summarises which discovery protocols a target speaks and which ping
+// versions it accepts.
+type ProtocolSupport struct {
+	V4       bool   // answers v4 pings
+	ENR      bool   // answers EIP-868 ENR requests
+	Accepted []uint // ping versions other than 4 that were ponged
+	Rejected []uint // ping versions other than 4 that were dropped
+}
+
+// probedVersions are the ping versions other than 4 sent by ProtocolReport.
+var probedVersions = []uint{0, 3, 5, 255}
+
+func (s ProtocolSupport) String() string {
+	if !s.V4 {
+		return "discovery v4: no, target does not answer pings"
+	}
+	enr := "no"
+	if s.ENR {
+		enr = "yes"
+	}
+	strictness := "ignores the ping version"
+	switch {
+	case len(s.Accepted) == 0:
+		strictness = "accepts only ping version 4"
+	case len(s.Rejected) > 0:
+		strictness = fmt.Sprintf("accepts ping versions %v, rejects %v", s.Accepted, s.Rejected)
+	}
+	return fmt.Sprintf("discovery v4: yes, EIP-868 ENR: %s, %s", enr, strictness)
+}
+
+// pingedRecently reports whether id pinged us within bondExpiration, checking our endpoint.
+func (t *V4Udp) pingedRecently(id enode.ID) bool {
+	t.bondMu.Lock()
+	defer t.bondMu.Unlock()
+	last, ok := t.pingedAt[id]
+	return ok && time.Since(last) < bondExpiration
+}
+
+// ProtocolReport probes the discovery protocols the target supports and how strictly it
+// enforces the ping version field. Pings and ENR requests the target does not answer are
+// recorded as unsupported; any other failure is returned as an error.
+func (t *V4Udp) ProtocolReport(toid enode.ID, toaddr *net.UDPAddr) (ProtocolSupport, error) {
+	var s ProtocolSupport
+	err := t.waitBonded(toid, toaddr)
+	if bondErr, ok := err.(*BondIncompleteError); ok {
+		//a target that pongs speaks v4, even if the bond fails
+		s.V4 = bondErr.Pong
+		if !bondErr.Pong {
+			return s, nil
+		}
+		return s, err
+	} else if err != nil {
+		return s, err
+	}
+	s.V4 = true
+
+	switch _, err := t.RequestENR(toid, toaddr); err {
+	case nil:
+		s.ENR = true
+	case ErrTimeout:
+	default:
+		return s, err
+	}
+
+	for _, v := range probedVersions {
+		req := t.makePing(toaddr, v, uint64(time.Now().Add(expiration).Unix()))
+		switch err := t.pingRequest(toid, toaddr, req); err {
+		case nil:
+			s.Accepted = append(s.Accepted, v)
+		case ErrTimeout:
+			s.Rejected = append(s.Rejected, v)
+		default:
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// ForkID is the EIP-2124 fork identifier a node advertises in the 'eth' entry of its record.
+// It commits to the genesis hash and the forks passed, so it identifies the chain.
+type ForkID struct {
+	Hash [4]byte // CRC32 checksum of the genesis hash and passed fork block numbers
+	Next uint64  // block number of the next upcoming fork, or 0 if none is scheduled
+}
+
+// ParseForkID parses a fork ID written as the hex checksum, optionally followed by ':' and
+// the next fork block number, e.g. "0xfc64ec04:1150000".
+func ParseForkID(s string) (ForkID, error) {
+	var id ForkID
+	parts := strings.SplitN(s, ":", 2)
+	hash, err := hex.DecodeString(strings.TrimPrefix(parts[0], "0x"))
+	if err != nil || len(hash) != len(id.Hash) {
+		return id, fmt.Errorf("invalid fork ID hash %q", parts[0])
+	}
+	copy(id.Hash[:], hash)
+	if len(parts) == 2 {
+		if id.Next, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return id, fmt.Errorf("invalid fork ID next block %q", parts[1])
+		}
+	}
+	return id, nil
+}
+
+// String formats the fork ID the way ParseForkID reads it.
+func (id ForkID) String() string {
+	return fmt.Sprintf("%#x:%d", id.Hash, id.Next)
+}
+
+// ethEntry is the 'eth' entry of a node record.
+type ethEntry struct {
+	ForkID ForkID
+	// Ignore additional fields (for forward compatibility).
+	Rest []rlp.RawValue `rlp:"tail"`
+}
+
+func (e ethEntry) ENRKey() string { return "eth" }
+
+// AssertNetworkMatch bonds with the target, fetches its node record and checks that the
+// 'eth' entry advertises the expected fork ID. The record carries no network ID, but the
+// fork ID hash identifies the chain. A differing next fork is only logged, as the target
+// may simply not know about an upcoming fork yet.
+func (t *V4Udp) AssertNetworkMatch(toid enode.ID, toaddr *net.UDPAddr, expected ForkID) error {
+	//try to bond with the target
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	n, err := t.RequestENR(toid, toaddr)
+	if err != nil {
+		return err
+	}
+	var eth ethEntry
+	if err := n.Load(&eth); err != nil {
+		return fmt.Errorf("%v: %v", ErrNoEthEntry, err)
+	}
+	if eth.ForkID.Hash != expected.Hash {
+		return fmt.Errorf("%v: got %x, want %x", ErrWrongNetwork, eth.ForkID.Hash, expected.Hash)
+	}
+	if eth.ForkID.Next != expected.Next {
+		log.Warn("Target expects a different next fork", "got", eth.ForkID.Next, "want", expected.Next)
+	}
+	return nil
+}
+
+// send an unsolicited neighbours packet from an identity the target has never bonded with,
+// then bond with our own identity and check that the fake node was not added to the target's table.
+func (t *V4Udp) SendUnsolicitedNeighboursUnbonded(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	unbondedKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return err
+	}
+	encFakeKey, err := t.sendFakeNeighbour(toaddr, unbondedKey)
+	if err != nil {
+		return err
+	}
+
+	//bond so that the target will answer our find neighbours
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	return t.findnodeWithoutFakeNeighbour(toid, toaddr, target, encFakeKey)
+}
+
+// send a pong the target never asked for from an identity it has never bonded with, then call
+// find neighbours from that identity. An unsolicited pong is not an endpoint proof, so the target
+// should still ignore the find neighbours. The error is ErrTimeout if it did.
+func (t *V4Udp) UnsolicitedPongNoBond(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	unbondedKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return err
+	}
+
+	replyTok := make([]byte, macSize)
+	t.rand.Read(replyTok)
+	pongReq := &pong{
+		To:         makeEndpoint(toaddr, 0),
+		ReplyTok:   replyTok,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err := encodePacket(unbondedKey, PongPacket, pongReq)
+	if err != nil {
+		return err
+	}
+	if err := t.write(toaddr, pongReq.name(), packet); err != nil {
+		return err
+	}
+	//hang around for a bit in case the target processes the pong asynchronously
+	time.Sleep(2 * time.Second)
+
+	findReq := &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err = encodePacket(unbondedKey, FindnodePacket, findReq)
+	if err != nil {
+		return err
+	}
+
+	//expect nothing
+	callback := func(p reply) error {
+		if p.ptype == NeighborsPacket {
+			return ErrUnsolicitedReply
+		}
+		return ErrPacketMismatch
+	}
+
+	return <-t.sendPacket(toid, toaddr, findReq, packet, callback)
+}
+
+// BondIncompleteError reports which half of the bonding handshake stalled: either the target
+// did not answer our ping, or it did but never pinged us back to check our endpoint.
+type BondIncompleteError struct {
+	Pong      bool          // the target answered our ping
+	PongAfter time.Duration // time from our ping to the pong, if there was one
+	Deadline  time.Duration // time allowed for the whole handshake
+}
+
+func (e *BondIncompleteError) Error() string {
+	if !e.Pong {
+		return "bond incomplete: no pong"
+	}
+	return fmt.Sprintf("bond incomplete: pong after %v, but no reverse ping within %v", e.PongAfter, e.Deadline)
+}
+
+// waitBonded bonds with the target within bondDeadline.
+func (t *V4Udp) waitBonded(toid enode.ID, toaddr *net.UDPAddr) error {
+	return t.waitBondedWithin(toid, toaddr, bondDeadline)
+}
+
+// waitBondedWithin bonds with the target unless a bond made within bondExpiration is cached,
+// in which case the ping round-trip is skipped. Expired entries are dropped. A bond takes a
+// pong to our ping and a ping from the target checking our endpoint, which it only sends if
+// it has not checked it recently. If neither half completes within deadline, the error is a
+// *BondIncompleteError saying which one stalled.
+func (t *V4Udp) waitBondedWithin(toid enode.ID, toaddr *net.UDPAddr, deadline time.Duration) error {
+	t.bondMu.Lock()
+	last, ok := t.bondCache[toid]
+	if ok && time.Since(last) < bondExpiration {
+		t.bondMu.Unlock()
+		return nil
+	}
+	delete(t.bondCache, toid)
+	t.bondMu.Unlock()
+
+	start := time.Now()
+	switch err := t.Ping(toid, toaddr, false, nil); err {
+	case nil:
+	case ErrTimeout:
+		return &BondIncompleteError{Deadline: deadline}
+	default:
+		return err
+	}
+	pongAfter := time.Since(start)
+
+	//wait for the target to ping us back, unless it did so recently enough to still trust
+	//our endpoint. A ping arriving between two pendings is caught by pingedRecently.
+	for !t.pingedRecently(toid) {
+		if time.Since(start) >= deadline {
+			return &BondIncompleteError{Pong: true, PongAfter: pongAfter, Deadline: deadline}
+		}
+		<-t.pending(toid, func(p reply) error {
+			if p.ptype != PingPacket {
+				return ErrPacketMismatch
+			}
+			return nil
+		})
+	}
+
+	t.bondMu.Lock()
+	if t.bondCache == nil {
+		t.bondCache = make(map[enode.ID]time.Time)
+	}
+	t.bondCache[toid] = time.Now()
+	t.bondMu.Unlock()
+	return nil
+}
+
+// send a well formed ping payload with the reserved packet type 0. No packet type 0 is
+// defined, so the target should drop it. The error is ErrUnsolicitedReply if the target
+// responded at all.
+func (t *V4Udp) SendType0Packet(toid enode.ID, toaddr *net.UDPAddr) error {
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         makeEndpoint(toaddr, 0),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err := encodePacket(t.priv, 0, req)
+	if err != nil {
+		return err
+	}
+
+	//expect nothing
+	callback := func(p reply) error {
+		return ErrUnsolicitedReply
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+// PingNonCanonicalRLP sends a ping whose expiration is an RLP integer with a leading zero
+// byte. RLP integers must be encoded without leading zeros, so a strict target drops the
+// ping. The error is ErrTimeout if it did, and ErrUnsolicitedReply if the target was lenient
+// and ponged.
+func (t *V4Udp) PingNonCanonicalRLP(toid enode.ID, toaddr *net.UDPAddr) error {
+	req := &pingNonCanonical{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         makeEndpoint(toaddr, 0),
+		Expiration: nonCanonicalUint(uint64(time.Now().Add(expiration).Unix())),
+	}
+	packet, _, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect no pong
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return ErrUnsolicitedReply
+		}
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, &ping{}, packet, callback) //the dummy ping is just to get the name
+}
+
+// nonCanonicalUint encodes x as an RLP string holding its big-endian bytes behind one
+// leading zero byte.
+func nonCanonicalUint(x uint64) rlp.RawValue {
+	b := []byte{0}
+	for shift := 56; shift >= 0; shift -= 8 {
+		if len(b) > 1 || byte(x>>uint(shift)) != 0 {
+			b = append(b, byte(x>>uint(shift)))
+		}
+	}
+	return append(rlp.RawValue{0x80 + byte(len(b))}, b...)
+}
+
+// send a zero-length datagram, which is too small to be a packet and should be dropped
+// without any reply, then ping the target to check it survived. The error is
+// ErrUnsolicitedReply if the target reacted to the empty packet.
+func (t *V4Udp) SendEmptyPacket(toid enode.ID, toaddr *net.UDPAddr) error {
+	//expect nothing
+	errc := t.pending(toid, func(p reply) error {
+		return ErrUnsolicitedReply
+	})
+	if err := t.write(toaddr, "EMPTY", []byte{}); err != nil {
+		return err
+	}
+	if err := <-errc; err != ErrTimeout {
+		return err
+	}
+	return t.Ping(toid, toaddr, false, nil)
+}
+
+// ping sends a ping message to the given node and waits for a reply.
+func (t *V4Udp) PingPastExpiration(toid enode.ID, toaddr *net.UDPAddr, validateEnodeID bool, recoveryCallback func(e *ecdsa.PublicKey)) error {
+
+	to := makeEndpoint(toaddr, 0)
+
+	req := &ping{
+		Version:    4,
+		From:       t.ourEndpoint,
+		To:         to, // TODO: maybe use known TCP port from DB
+		Expiration: uint64(time.Now().Add(-expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+
+	//expect no pong
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return ErrUnsolicitedReply
+		}
+		return ErrPacketMismatch
+
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+
+}
+
+// PingMaxExpiration pings the target with an expiration of math.MaxInt64 and then one just
+// above it. Both are far in the future and valid, but a target that converts the timestamp to
+// a signed time wraps the second into the past. For each ping the error is nil if the target
+// ponged and ErrTimeout if it dropped the ping.
+func (t *V4Udp) PingMaxExpiration(toid enode.ID, toaddr *net.UDPAddr) (atMax, aboveMax error) {
+	atMax = t.pingRequest(toid, toaddr, t.makePing(toaddr, 4, math.MaxInt64))
+	aboveMax = t.pingRequest(toid, toaddr, t.makePing(toaddr, 4, math.MaxInt64+1))
+	return atMax, aboveMax
+}
+
+// PingIdenticalFromTo pings the target twice with the 'from' and 'to' endpoints equal, first
+// both set to the target's endpoint and then both set to ours. This is unusual but valid, as
+// both fields are advisory, so the target should pong each as usual. For each ping the error is
+// nil if it did, and ErrTimeout if it dropped the ping.
+func (t *V4Udp) PingIdenticalFromTo(toid enode.ID, toaddr *net.UDPAddr) (asTarget, asUs error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	req.From = req.To
+	asTarget = t.pingRequest(toid, toaddr, req)
+
+	req = t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	req.To = req.From
+	asUs = t.pingRequest(toid, toaddr, req)
+	return asTarget, asUs
+}
+
+// keyRotationTimeout is how long TargetKeyRotation keeps pinging the target after rotating
+// its key, giving a restarted client time to come back up.
+const keyRotationTimeout = 30 * time.Second
+
+// TargetKeyRotation bonds with the target and calls rotate to restart it with a new node key on
+// the same address, which must return once the target is listening again. It then checks that
+// bonding follows the node ID rather than the address. A findnode is sent before anything
+// else, and as findnode is not addressed to a node ID, a target answering it under any key
+// honours the bond made with its old identity. The target is then pinged until it answers,
+// for up to keyRotationTimeout, to discover its new node ID. It returns the target's new
+// public key. The error is ErrTimeout if the target never answered the pings,
+// ErrKeyNotRotated if it kept its node ID, and ErrStaleBond if the findnode was answered.
+func (t *V4Udp) TargetKeyRotation(toid enode.ID, toaddr *net.UDPAddr, rotate func() error) (*ecdsa.PublicKey, error) {
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return nil, err
+	}
+	if err := rotate(); err != nil {
+		return nil, err
+	}
+
+	req := &findnode{
+		Target:     EncodePubkey(&t.priv.PublicKey),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, _, err := encodePacket(t.priv, FindnodePacket, req)
+	if err != nil {
+		return nil, err
+	}
+	answered := false
+	errc := t.pendingAnyNode(toaddr.IP, func(p reply) error {
+		if p.ptype == NeighborsPacket {
+			answered = true
+		}
+		return ErrPacketMismatch
+	})
+	if err := t.write(toaddr, req.name(), packet); err != nil {
+		return nil, err
+	}
+	if err := <-errc; err != ErrTimeout {
+		return nil, err
+	}
+
+	newKey, err := EncPubkey{}, ErrTimeout
+	for deadline := time.Now().Add(keyRotationTimeout); err == ErrTimeout && time.Now().Before(deadline); {
+		newKey, err = t.pingAnyNode(toaddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodePubkey(newKey)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case newKey.id() == toid:
+		return key, ErrKeyNotRotated
+	case answered:
+		return key, ErrStaleBond
+	}
+	return key, nil
+}
+
+// pingAnyNode pings toaddr and returns the public key that signed the pong, for a target whose
+// node ID is not known.
+func (t *V4Udp) pingAnyNode(toaddr *net.UDPAddr) (EncPubkey, error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return EncPubkey{}, err
+	}
+	var key EncPubkey
+	errc := t.pendingAnyNode(toaddr.IP, func(p reply) error {
+		in := p.data.(incomingPacket)
+		if p.ptype != PongPacket || checkReplyTok(in.packet.(*pong).ReplyTok, hash) != nil {
+			return ErrPacketMismatch
+		}
+		key = in.recoveredID
+		return nil
+	})
+	if err := t.write(toaddr, req.name(), packet); err != nil {
+		return EncPubkey{}, err
+	}
+	return key, <-errc
+}
+
+// FindnodeAfterInboundPingOnly checks whether the target answers find neighbours from a node
+// that has proved its endpoint only by answering the target's ping, without ever pinging the
+// target itself. The target has to make first contact, so the fresh identity is introduced
+// through a relay: a second identity bonds with the target and lists the fresh one in answer
+// to its find neighbours. A target looking up nodes pings the fresh identity before querying
+// it, the fresh identity pongs, and then calls find neighbours. Either outcome is allowed by
+// the spec, so answered is reported rather than checked. The error is ErrTimeout if the
+// target does not ping the fresh identity within the given time, as it looks up nodes on its
+// own schedule.
+func (t *V4Udp) FindnodeAfterInboundPingOnly(toid enode.ID, toaddr *net.UDPAddr, within time.Duration) (answered bool, err error) {
+	laddr, err := t.localSourceAddr(toaddr)
+	if err != nil {
+		return false, err
+	}
+	key, err := GenerateKey(t.rand)
+	if err != nil {
+		return false, err
+	}
+	fresh, err := t.sibling(key, laddr.IP, nil)
+	if err != nil {
+		return false, err
+	}
+	defer fresh.Close()
+	faddr, err := LocalUDPAddr(fresh.conn)
+	if err != nil {
+		return false, err
+	}
+	relayKey, err := GenerateKey(t.rand)
+	if err != nil {
+		return false, err
+	}
+	relay, err := t.sibling(relayKey, laddr.IP, []*enode.Node{enode.NewV4(&key.PublicKey, laddr.IP, faddr.Port, faddr.Port)})
+	if err != nil {
+		return false, err
+	}
+	defer relay.Close()
+	if err := relay.waitBonded(toid, toaddr); err != nil {
+		return false, err
+	}
+
+	//the fresh identity pongs the target's ping as it arrives, before the pending sees it
+	start := time.Now()
+	for !fresh.pingedRecently(toid) {
+		if time.Since(start) >= within {
+			return false, ErrTimeout
+		}
+		<-fresh.pending(toid, func(p reply) error {
+			if p.ptype != PingPacket {
+				return ErrPacketMismatch
+			}
+			return nil
+		})
+	}
+
+	_, received, err := fresh.collectNeighbours(toid, toaddr, &findnode{
+		Target:     EncodePubkey(&key.PublicKey),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	return received, err
+}
+
+// makePing returns a ping from our endpoint to toaddr with the given version and expiration.
+func (t *V4Udp) makePing(toaddr *net.UDPAddr, version uint, exp uint64) *ping {
+	return &ping{
+		Version:    version,
+		From:       t.ourEndpoint,
+		To:         makeEndpoint(toaddr, 0),
+		Expiration: exp,
+	}
+}
+
+// PingToPortZero sends a ping whose 'to' endpoint has both ports set to zero. The 'to' field
+// is advisory only, so the target should pong as usual. The error is ErrTimeout if it
+// rejects the ping instead.
+func (t *V4Udp) PingToPortZero(toid enode.ID, toaddr *net.UDPAddr) error {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	req.To.UDP, req.To.TCP = 0, 0
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+	callback := func(p reply) error {
+		if p.ptype != PongPacket {
+			return ErrPacketMismatch
+		}
+		return checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash)
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+// largeTailSize is the size of the ping sent by PingLargeTail, just below maxPacketSize.
+const largeTailSize = maxPacketSize - 16
+
+// pingWithTail returns a ping whose Rest tail holds a single byte string, sized so that the
+// encoded packet is size bytes long. Where the string's length prefix grows, the packet may
+// come out a byte short.
+func (t *V4Udp) pingWithTail(toaddr *net.UDPAddr, size int) (*ping, error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	base, err := rlp.EncodeToBytes(req)
+	if err != nil {
+		return nil, err
+	}
+	for n := size - headSize - 1 - len(base); n > 0; n-- {
+		blob, err := rlp.EncodeToBytes(make([]byte, n))
+		if err != nil {
+			return nil, err
+		}
+		req.Rest = []rlp.RawValue{blob}
+		enc, err := rlp.EncodeToBytes(req)
+		if err != nil {
+			return nil, err
+		}
+		if headSize+1+len(enc) <= size {
+			return req, nil
+		}
+	}
+	return nil, fmt.Errorf("no room for a tail in a %d byte ping", size)
+}
+
+// PingLargeTail sends a ping of largeTailSize bytes, padded out with a large byte string in
+// the tail of unknown fields that forward compatibility requires targets to ignore. The
+// target should pong as usual. The error is ErrTimeout if it rejects the ping instead.
+func (t *V4Udp) PingLargeTail(toid enode.ID, toaddr *net.UDPAddr) error {
+	req, err := t.pingWithTail(toaddr, largeTailSize)
+	if err != nil {
+		return err
+	}
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+	callback := func(p reply) error {
+		if p.ptype != PongPacket {
+			return ErrPacketMismatch
+		}
+		return checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash)
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+// weirdTail is the tail of the ping sent by PingWeirdTail. It holds the byte string shapes
+// PingExtraData does not send, none of them a list: a byte below 0x80 encoded as itself, the
+// empty string, and a string long enough to need a length-of-length prefix.
+var weirdTail = []rlp.RawValue{
+	{0x2a},
+	{0x80},
+	append([]byte{0xb8, 60}, make([]byte, 60)...),
+}
+
+// PingWeirdTail sends a ping whose tail of unknown fields holds the unusual but valid byte
+// strings of weirdTail rather than lists. A decoder that keeps the tail as raw values accepts
+// any shape, but one that expects list elements or skips them by a fixed prefix size does not.
+// The target should pong as usual. The error is ErrTimeout if it rejects the ping instead.
+func (t *V4Udp) PingWeirdTail(toid enode.ID, toaddr *net.UDPAddr) error {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	req.Rest = weirdTail
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+	callback := func(p reply) error {
+		if p.ptype != PongPacket {
+			return ErrPacketMismatch
+		}
+		return checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash)
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+// duplicatePings is the number of identical pings sent by PingDuplicateSuppression.
+const duplicatePings = 3
+
+// PingDuplicateSuppression sends duplicatePings identical pings, byte for byte, in quick
+// succession and counts the pongs that answer them. A target that suppresses duplicates
+// answers once, one that does not answers every ping. The pongs all carry the same reply
+// token, so rather than complete on the first one, the callback counts them until the
+// response times out. The error is ErrTimeout if no pong arrives at all.
+func (t *V4Udp) PingDuplicateSuppression(toid enode.ID, toaddr *net.UDPAddr) (int, error) {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return 0, err
+	}
+
+	var pongs int
+	errc := t.pending(toid, func(p reply) error {
+		if p.ptype == PongPacket && checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash) == nil {
+			pongs++
+		}
+		return ErrPacketMismatch
+	})
+	for i := 0; i < duplicatePings; i++ {
+		if err := t.write(toaddr, req.name(), packet); err != nil {
+			return 0, err
+		}
+	}
+	if err := <-errc; err != ErrTimeout {
+		return pongs, err
+	}
+	if pongs == 0 {
+		return 0, ErrTimeout
+	}
+	return pongs, nil
+}
+
+// PingVerifyTransport pings the target and checks that the pong comes back over UDP from the
+// address the ping was sent to. A pong from another IP or port suggests a proxy, or a
+// multi-homed target answering from the wrong interface. The error is ErrPongSource if so.
+func (t *V4Udp) PingVerifyTransport(toid enode.ID, toaddr *net.UDPAddr) error {
+	req := t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	packet, hash, err := encodePacket(t.priv, PingPacket, req)
+	if err != nil {
+		return err
+	}
+	callback := func(p reply) error {
+		if p.ptype != PongPacket {
+			return ErrPacketMismatch
+		}
+		in := p.data.(incomingPacket)
+		if err := checkReplyTok(in.packet.(*pong).ReplyTok, hash); err != nil {
+			return err
+		}
+		return checkPongSource(toaddr, in.source)
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+// checkPongSource returns ErrPongSource unless source is the address a ping was sent to.
+func checkPongSource(toaddr, source *net.UDPAddr) error {
+	if source == nil || !source.IP.Equal(toaddr.IP) || source.Port != toaddr.Port {
+		return fmt.Errorf("%v: got %v, pinged %v", ErrPongSource, source, toaddr)
+	}
+	return nil
+}
+
+// PingAsIdentity pings the target with a ping signed by key instead of our own, so that a
+// test can present any number of identities from one socket. The pong is addressed to that
+// identity but still arrives on our socket. The error is nil if the target ponged.
+func (t *V4Udp) PingAsIdentity(key *ecdsa.PrivateKey, toid enode.ID, toaddr *net.UDPAddr) error {
+	return t.pingRequestAs(key, toid, toaddr, t.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix())))
+}
+
+// DualIdentityPing pings the target from two fresh identities on our socket at nearly the same
+// time, as two nodes behind one NAT would. Each ping must be answered by a pong carrying its own
+// hash, and the target should check the endpoint of each identity with a ping of its own. The
+// error is ErrIdentityConfused if only one identity was answered, or if the target pinged back
+// fewer than twice, and ErrTimeout if neither was answered.
+func (t *V4Udp) DualIdentityPing(toid enode.ID, toaddr *net.UDPAddr) error {
+	var (
+		packets [2][]byte
+		errcs   [2]<-chan error
+		exp     = uint64(time.Now().Add(expiration).Unix())
+	)
+	for i := range packets {
+		key, err := GenerateKey(t.rand)
+		if err != nil {
+			return err
+		}
+		packet, hash, err := encodePacket(key, PingPacket, t.makePing(toaddr, 4, exp))
+		if err != nil {
+			return err
+		}
+		packets[i] = packet
+		//both pongs come from the target, so each pending picks out its own by the reply token
+		errcs[i] = t.pendingAt(toid, toaddr.IP, func(p reply) error {
+			if p.ptype == PongPacket && bytes.Equal(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash) {
+				return nil
+			}
+			return ErrPacketMismatch
+		})
+	}
+	//count the target's pings checking our endpoint, one is due for each identity
+	reversePings := 0
+	pings := t.pendingAt(toid, toaddr.IP, func(p reply) error {
+		if p.ptype == PingPacket {
+			reversePings++
+		}
+		return ErrPacketMismatch
+	})
+	for _, packet := range packets {
+		if err := t.write(toaddr, (&ping{}).name(), packet); err != nil {
+			return err
+		}
+	}
+
+	errs := [2]error{<-errcs[0], <-errcs[1]}
+	<-pings
+	switch {
+	case errs[0] == ErrTimeout && errs[1] == ErrTimeout:
+		return ErrTimeout
+	case errs[0] == ErrTimeout || errs[1] == ErrTimeout:
+		return fmt.Errorf("%v: only one of two identities ponged", ErrIdentityConfused)
+	case errs[0] != nil:
+		return errs[0]
+	case errs[1] != nil:
+		return errs[1]
+	case reversePings < 2:
+		return fmt.Errorf("%v: pinged back %d times for two identities", ErrIdentityConfused, reversePings)
+	}
+	return nil
+}
+
+// signer returns priv, or our own key if priv is nil.
+func (t *V4Udp) signer(priv *ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	if priv == nil {
+		return t.priv
+	}
+	return priv
+}
+
+// pingRequest sends req to the target and waits for a pong.
+func (t *V4Udp) pingRequest(toid enode.ID, toaddr *net.UDPAddr, req *ping) error {
+	return t.pingRequestAs(nil, toid, toaddr, req)
+}
+
+// pingRequestAs is pingRequest with the ping signed by priv, or by our own key if priv is nil.
+func (t *V4Udp) pingRequestAs(priv *ecdsa.PrivateKey, toid enode.ID, toaddr *net.UDPAddr, req *ping) error {
+	packet, hash, err := encodePacket(t.signer(priv), PingPacket, req)
+	if err != nil {
+		return err
+	}
+	callback := func(p reply) error {
+		if p.ptype == PongPacket {
+			return checkReplyTok(p.data.(incomingPacket).packet.(*pong).ReplyTok, hash)
+		}
+		return ErrPacketMismatch
+	}
+	return <-t.sendPacket(toid, toaddr, req, packet, callback)
+}
+
+func (t *V4Udp) BondedSourceFindNeighboursPastExpiration(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) error {
+	//try to bond with the target
+	if err := t.waitBonded(toid, toaddr); err != nil {
+		return err
+	}
+
+	//now call find neighbours
+	findReq := &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(-expiration).Unix()),
+	}
+
+	packet, _, err := encodePacket(t.priv, FindnodePacket, findReq)
+	if err != nil {
+		return err
+	}
+
+	//expect good neighbours response with no junk
+	callback := func(p reply) error {
+
+		if p.ptype == NeighborsPacket {
+			return ErrUnsolicitedReply
+
+		}
+		return ErrPacketMismatch
+	}
+
+	return <-t.sendPacket(toid, toaddr, findReq, packet, callback)
+
+}
+
+// sendPacket registers the pending reply and then writes the packet. The pending must be in
+// place before the write: pending returns only once the loop has added it, and the loop handles
+// one event at a time, so a reply arriving however soon after the write finds it registered.
+func (t *V4Udp) sendPacket(toid enode.ID, toaddr *net.UDPAddr, req packet, packet []byte, callback func(reply) error) <-chan error {
+
+	errc := t.pendingAt(toid, toaddr.IP, callback)
+	t.write(toaddr, req.name(), packet)
+	return errc
+}
+
+// func (t *V4Udp) waitping(from enode.ID) error {
+// 	return <-t.pending(from, PingPacket, func(interface{}) bool { return true })
+// }
+
+// findnode sends a findnode request to the given node and waits until
+// the node has sent up to k neighbors.
+//func (t *V4Udp) findnode(toid enode.ID, toaddr *net.UDPAddr, target EncPubkey) ([]*node, error) {
+
+// If we haven't seen a ping from the destination node for a while, it won't remember
+// our endpoint proof and reject findnode. Solicit a ping first.
+
+//!!!!!*******TODO *******!!!!!!
+//Replace this with a test-scoped variable
+//!!!************************!!!
+// if time.Since(t.db.LastPingReceived(toid)) > bondExpiration {
+// 	t.Ping(toid, toaddr)
+// 	t.waitping(toid)
+// }
+//bucketSize
+
+//*********************//
+// bucketSize := 16
+// nodes := make([]*node, 0, bucketSize)
+// nreceived := 0
+// errc := t.pending(toid, NeighborsPacket, func(r interface{}) bool {
+// 	reply := r.(incomingPacket).packet.(*neighbors)
+// 	for _, rn := range reply.Nodes {
+// 		nreceived++
+// 		n, err := t.nodeFromRPC(toaddr, rn)
+// 		if err != nil {
+// 			log.Trace("Invalid neighbor node received", "ip", rn.IP, "addr", toaddr, "err", err)
+// 			continue
+// 		}
+// 		nodes = append(nodes, n)
+// 	}
+// 	return nreceived >= bucketSize
+// })
+// t.send(toaddr, FindnodePacket, &findnode{
+// 	Target:     target,
+// 	Expiration: uint64(time.Now().Add(expiration).Unix()),
+// })
+//return nodes, <-errc
+//return nil, nil
+//}
+
+// pending adds a reply callback to the pending reply queue.
+// see the documentation of type pending for a detailed explanation.
+func (t *V4Udp) pending(id enode.ID, callback func(reply) error) <-chan error {
+	return t.pendingAt(id, nil, callback)
+}
+
+// pendingAt is pending for a request sent to ip. If StrictReplySource is set, only replies
+// from ip are passed to the callback. A nil ip matches replies from any address.
+func (t *V4Udp) pendingAt(id enode.ID, ip net.IP, callback func(reply) error) <-chan error {
+	return t.addPending(&pending{from: id, ip: ip, callback: callback})
+}
+
+// pendingAnyNode is pending for a request to a node whose ID is not known. Replies from ip are
+// passed to the callback whatever node ID signed them.
+func (t *V4Udp) pendingAnyNode(ip net.IP, callback func(reply) error) <-chan error {
+	return t.addPending(&pending{ip: ip, anyNode: true, callback: callback})
+}
+
+// addPending hands p to the loop, with a channel for its outcome.
+func (t *V4Udp) addPending(p *pending) <-chan error {
+	ch := make(chan error, 1)
+	p.errc = ch
+	select {
+	case t.addpending <- p:
+		// loop will handle it
+	case <-t.closing:
+		ch <- ErrClosed
+	}
+	return ch
+}
+
+// CancelPendings fails every pending reply with ErrCancelled. Calling it at the end of a test
+// stops replies the test left pending from matching packets meant for a later test. Pendings
+// registered after it returns are unaffected.
+func (t *V4Udp) CancelPendings() {
+	done := make(chan struct{})
+	select {
+	case t.cancelpendings <- done:
+		<-done
+	case <-t.closing:
+	}
+}
+
+func (t *V4Udp) handleReply(from enode.ID, ptype byte, req incomingPacket) bool {
+	return t.deliverReply(from, ptype, req) == nil
+}
+
+// deliverReply passes a reply to the pending requests from the same node. The error is
+// ErrUnsolicitedReply if none of them matched it, or ErrReplyFromWrongIP if the only ones that
+// would have were sent to a different IP and StrictReplySource is set.
+func (t *V4Udp) deliverReply(from enode.ID, ptype byte, req incomingPacket) error {
+	matched := make(chan error, 1)
+	select {
+	case t.gotreply <- reply{from, ptype, req, matched}:
+		// loop will handle it
+		return <-matched
+	case <-t.closing:
+		return ErrUnsolicitedReply
+	}
+}
+
+// matches reports whether r is from the node p waits for.
+func (p *pending) matches(r reply) bool {
+	if !p.anyNode {
+		return p.from == r.from
+	}
+	in, ok := r.data.(incomingPacket)
+	return ok && in.source != nil && in.source.IP.Equal(p.ip)
+}
+
+// wrongReplySource reports whether r must be withheld from p because it came from a different
+// IP than p's request was sent to.
+func (t *V4Udp) wrongReplySource(p *pending, r reply) bool {
+	if !t.strictReplySource || p.ip == nil {
+		return false
+	}
+	in, ok := r.data.(incomingPacket)
+	return ok && in.source != nil && !in.source.IP.Equal(p.ip)
+}
+
+// watchdogID is the node ID of the no-op replies sent through the loop by the watchdog.
+var watchdogID = enode.ID{0xff, 0xff, 0xff, 0xff}
+
+// watchdog runs in its own goroutine. Every interval it passes a no-op reply through the
+// pending queue, and calls onStuck if the loop does not process it within the interval.
+// This catches callbacks that never return, which would otherwise hang the run silently.
+func (t *V4Udp) watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.closing:
+			return
+		}
+
+		done := make(chan struct{})
+		go func() {
+			errc := t.pending(watchdogID, func(reply) error { return nil })
+			t.handleReply(watchdogID, 0, incomingPacket{})
+			<-errc
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-t.closing:
+			return
+		case <-time.After(interval):
+			t.onStuck()
+			return
+		}
+	}
+}
+
+// watchdogFatal dumps all goroutines and exits, since a stuck loop hangs every later test.
+func watchdogFatal() {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	log.Error("Reply loop is stuck")
+	fmt.Fprintf(os.Stderr, "discv4test: reply loop is stuck, goroutine dump:\n%s", buf)
+	os.Exit(1)
+}
+
+// now returns the current time of the reply loop's clock.
+func (t *V4Udp) now() time.Time {
+	if t.clock != nil {
+		return t.clock()
+	}
+	return time.Now()
+}
+
+// loop runs in its own goroutine. it keeps track of
+// the refresh timer and the pending reply queue.
+func (t *V4Udp) loop() {
+	var (
+		plist        = list.New()
+		timeout      = time.NewTimer(0)
+		nextTimeout  *pending // head of plist when timeout was last reset
+		contTimeouts = 0      // number of continuous timeouts to do NTP checks
+	//	ntpWarnTime  = time.Unix(0, 0)
+	)
+	<-timeout.C // ignore first timeout
+	defer timeout.Stop()
+
+	resetTimeout := func() {
+		if plist.Front() == nil || nextTimeout == plist.Front().Value {
+			return
+		}
+		// Start the timer so it fires when the next pending reply has expired.
+		now := t.now()
+		for el := plist.Front(); el != nil; el = el.Next() {
+			nextTimeout = el.Value.(*pending)
+			if dist := nextTimeout.deadline.Sub(now); dist < 2*respTimeout {
+				timeout.Reset(dist)
+				return
+			}
+			// Remove pending replies whose deadline is too far in the
+			// future. These can occur if the system clock jumped
+			// backwards after the deadline was assigned.
+			nextTimeout.errc <- ErrClockWarp
+			plist.Remove(el)
+		}
+		nextTimeout = nil
+		timeout.Stop()
+	}
+
+	for {
+		resetTimeout()
+
+		select {
+		case <-t.closing:
+			for el := plist.Front(); el != nil; el = el.Next() {
+				el.Value.(*pending).errc <- ErrClosed
+			}
+			return
+
+		case p := <-t.addpending:
+			p.deadline = t.now().Add(respTimeout)
+			plist.PushBack(p)
+
+		case done := <-t.cancelpendings:
+			for el := plist.Front(); el != nil; el = el.Next() {
+				el.Value.(*pending).errc <- ErrCancelled
+			}
+			plist.Init()
+			nextTimeout = nil
+			timeout.Stop()
+			close(done)
+
+		case r := <-t.gotreply:
+			var matched, wrongIP bool
+			for el := plist.Front(); el != nil; el = el.Next() {
+				p := el.Value.(*pending)
+				if p.matches(r) && t.wrongReplySource(p, r) {
+					wrongIP = true
+				} else if p.matches(r) {
+
+					// Remove the matcher if its callback indicates
+					// that all replies have been received. This is
+					// required for packet types that expect multiple
+					// reply packets.
+
+					cbres := invokeCallback(p, r)
+					if cbres != ErrPacketMismatch {
+						matched = true
+						if cbres == nil {
+							plist.Remove(el)
+							p.errc <- nil
+						} else {
+							plist.Remove(el)
+							p.errc <- cbres
+						}
+					}
+
+					// Reset the continuous timeout counter (time drift detection)
+					contTimeouts = 0
+				}
+			}
+			switch {
+			case matched:
+				r.matched <- nil
+			case wrongIP:
+				r.matched <- ErrReplyFromWrongIP
+			default:
+				r.matched <- ErrUnsolicitedReply
+			}
+
+		case <-timeout.C:
+			now := t.now()
+			nextTimeout = nil
+
+			// Notify and remove callbacks whose deadline is in the past.
+			for el := plist.Front(); el != nil; el = el.Next() {
+				p := el.Value.(*pending)
+				if now.After(p.deadline) || now.Equal(p.deadline) {
+					p.errc <- ErrTimeout
+					plist.Remove(el)
+					contTimeouts++
+				}
+			}
+			// If we've accumulated too many timeouts, do an NTP time sync check
+
+			//****************************************
+			//TODO: Replace with something under test
+			//control
+			//****************************************
+
+			// if contTimeouts > ntpFailureThreshold {
+			// 	if time.Since(ntpWarnTime) >= ntpWarningCooldown {
+			// 		ntpWarnTime = time.Now()
+			// 		go checkClockDrift()
+			// 	}
+			// 	contTimeouts = 0
+			// }
+		}
+	}
+}
+
+// invokeCallback runs the callback of a pending reply. A panic in the callback is logged and
+// reported as ErrHandlerPanic, failing that pending instead of killing the loop.
+func invokeCallback(p *pending, r reply) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Error("Panic in reply callback", "from", r.from, "ptype", r.ptype, "err", rec)
+			err = ErrHandlerPanic
+		}
+	}()
+	return p.callback(r)
+}
+
+const (
+	macSize  = 256 / 8
+	sigSize  = 520 / 8
+	headSize = macSize + sigSize // space of packet frame data
+
+	maxPacketSize   = 1280  // discovery packets are defined to be no larger than this
+	maxDatagramSize = 65535 // largest UDP payload
+
+	// oversizedPacket is the type under which a packet above maxPacketSize is passed to the
+	// pending requests of its sender, so that tests can report it. It is not handled.
+	oversizedPacket = 0xff
+
+	// farFuturePong is the type under which a pong expiring beyond maxPongExpiration is passed
+	// to the pending requests of its sender, so that tests can report it. It is not handled.
+	farFuturePong = 0xfe
+)
+
+var (
+	headSpace = make([]byte, headSize)
+
+	// Neighbors replies are sent across multiple packets to
+	// stay below the 1280 byte limit. We compute the maximum number
+	// of entries by stuffing a packet until it grows too large.
+	maxNeighbors int
+)
+
+func init() {
+	p := neighbors{Expiration: ^uint64(0)}
+	maxSizeNode := rpcNode{IP: make(net.IP, 16), UDP: ^uint16(0), TCP: ^uint16(0)}
+	for n := 0; ; n++ {
+		p.Nodes = append(p.Nodes, maxSizeNode)
+		size, _, err := rlp.EncodeToReader(p)
+		if err != nil {
+			// If this ever happens, it will be caught by the unit tests.
+			panic("cannot encode: " + err.Error())
+		}
+		if headSize+size+1 >= maxPacketSize {
+			maxNeighbors = n
+			break
+		}
+	}
+}
+
+func (t *V4Udp) send(toaddr *net.UDPAddr, ptype byte, req packet) ([]byte, error) {
+	return t.sendAs(nil, toaddr, ptype, req)
+}
+
+// sendAs is send with the packet signed by priv, or by our own key if priv is nil.
+func (t *V4Udp) sendAs(priv *ecdsa.PrivateKey, toaddr *net.UDPAddr, ptype byte, req packet) ([]byte, error) {
+	packet, hash, err := encodePacket(t.signer(priv), ptype, req)
+	if err != nil {
+		return hash, err
+	}
+	return hash, t.write(toaddr, req.name(), packet)
+}
+
+// write sends packet to toaddr. A write failing with a temporary error, as the send buffer
+// filling up under load does, is retried up to writeRetries times with a short backoff, so
+// that it does not show up as a protocol timeout.
+func (t *V4Udp) write(toaddr *net.UDPAddr, what string, packet []byte) error {
+	if t.limiter != nil {
+		t.limiter.wait()
+	}
+	_, err := t.conn.WriteToUDP(packet, toaddr)
+	for retry := 0; retry < t.writeRetries && netutil.IsTemporaryError(err); retry++ {
+		log.Debug("Temporary UDP write error", "addr", toaddr, "err", err)
+		time.Sleep(writeRetryBackoff << uint(retry))
+		_, err = t.conn.WriteToUDP(packet, toaddr)
+	}
+	log.Trace(">> "+what, "addr", toaddr, "err", err)
+	return err
+}
+
+func encodePacket(priv *ecdsa.PrivateKey, ptype byte, req interface{}) (packet, hash []byte, err error) {
+	return encodePacketWithSigScope(priv, ptype, req, headSize)
+}
+
+// encodePacketWithSigScope encodes a packet whose signature covers packet[sigStart:]. The spec
+// requires sigStart to be headSize, so that the type byte is signed along with the payload.
+func encodePacketWithSigScope(priv *ecdsa.PrivateKey, ptype byte, req interface{}, sigStart int) (packet, hash []byte, err error) {
+	b := new(bytes.Buffer)
+	b.Write(headSpace)
+	b.WriteByte(ptype)
+	if err := rlp.Encode(b, req); err != nil {
+		log.Error("Can't encode discv4 packet", "err", err)
+		return nil, nil, err
+	}
+	packet = b.Bytes()
+	sig, err := crypto.Sign(crypto.Keccak256(packet[sigStart:]), priv)
+	if err != nil {
+		log.Error("Can't sign discv4 packet", "err", err)
+		return nil, nil, err
+	}
+	copy(packet[macSize:], sig)
+	// add the hash to the front. Note: this doesn't protect the
+	// packet in any way. Our public key will be part of this hash in
+	// The future.
+	hash = crypto.Keccak256(packet[macSize:])
+	copy(packet, hash)
+	return packet, hash, nil
+}
+
+// readLoop runs in its own goroutine. it handles incoming UDP packets.
+func (t *V4Udp) readLoop(unhandled chan<- ReadPacket) {
+	defer t.conn.Close()
+	if unhandled != nil {
+		defer close(unhandled)
+	}
+	// Discovery packets are defined to be no larger than maxPacketSize bytes.
+	// A larger buffer may be configured to read oversized packets in full, so
+	// that a sender breaking the limit can be reported rather than its packet
+	// cut short and failing its hash.
+	size := t.readBufferSize
+	if size == 0 {
+		size = maxPacketSize
+	}
+	buf := make([]byte, size)
+	for {
+		nbytes, from, err := t.conn.ReadFromUDP(buf)
+		if netutil.IsTemporaryError(err) {
+			// Ignore temporary read errors.
+			log.Debug("Temporary UDP read error", "err", err)
+			continue
+		} else if err == io.EOF {
+			// The conn was closed cleanly, as fakes and closed sockets report.
+			log.Debug("UDP connection closed")
+			return
+		} else if err != nil {
+			// Shut down the loop for permament errors. These are expected once we
+			// are closing, but otherwise mean the socket failed under us.
+			select {
+			case <-t.closing:
+				log.Debug("UDP read error", "err", err)
+			default:
+				log.Error("UDP read error", "err", err)
+			}
+			return
+		}
+		if nbytes == len(buf) && len(buf) < maxDatagramSize {
+			log.Warn("UDP packet may be truncated by the read buffer", "addr", from, "size", nbytes)
+		}
+		if t.handlePacket(from, buf[:nbytes]) != nil && unhandled != nil {
+			select {
+			case unhandled <- ReadPacket{buf[:nbytes], from}:
+			default:
+			}
+		}
+	}
+}
+
+func (t *V4Udp) handlePacket(from *net.UDPAddr, buf []byte) (err error) {
+	// a malformed packet must not take down the read loop
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Error("Panic handling discv4 packet", "addr", from, "err", rec)
+			err = ErrHandlerPanic
+		}
+	}()
+	if t.responder != nil && t.responder.reflect {
+		t.write(from, "reflected packet", buf)
+	}
+	inpacket, fromKey, hash, err := decodePacket(buf)
+	if fromKey != (EncPubkey{}) {
+		t.deliverRaw(fromKey.id(), buf)
+	}
+	if err != nil {
+		log.Debug("Bad discv4 packet", "addr", from, "size", len(buf), "err", err)
+		return err
+	}
+	// drop our own packets reflected back to us (e.g. by hairpin NAT), answering
+	// them would make us bond with ourselves
+	if fromKey == EncodePubkey(&t.priv.PublicKey) {
+		log.Debug("Dropping own discv4 packet", "addr", from, "type", inpacket.name())
+		return ErrSelfPacket
+	}
+	if len(buf) > maxPacketSize {
+		log.Debug("Oversized discv4 packet", "addr", from, "type", inpacket.name(), "size", len(buf))
+		t.deliverReply(fromKey.id(), oversizedPacket, incomingPacket{packet: inpacket, recoveredID: fromKey, source: from, size: len(buf)})
+		return ErrPacketTooLarge
+	}
+	err = inpacket.handle(t, from, fromKey, hash)
+	log.Trace("<< "+inpacket.name(), "addr", from, "size", len(buf), "err", err)
+	return err
+}
+
+// decodePacket checks the packet hash, recovers the sender's key and decodes the payload.
+//
+// The two Keccak256 digests cover different spans, the hash everything after itself and the
+// signature only what follows the signature, so neither can be derived from the other. Recovery
+// is not deferred either: the recovered ID is what replies are matched to pendings by, and
+// requests need it to be answered, so every packet that passes the hash check needs it.
+func decodePacket(buf []byte) (packet, EncPubkey, []byte, error) {
+	if len(buf) < headSize+1 {
+		return nil, EncPubkey{}, nil, ErrPacketTooSmall
+	}
+	hash, sig, sigdata := buf[:macSize], buf[macSize:headSize], buf[headSize:]
+	// hashing into fixed size digests saves allocating a slice for each
+	shouldhash := crypto.Keccak256Hash(buf[macSize:])
+	if !bytes.Equal(hash, shouldhash[:]) {
+		return nil, EncPubkey{}, nil, ErrBadHash
+	}
+	digest := crypto.Keccak256Hash(sigdata)
+	fromKey, err := recoverNodeKey(digest[:], sig)
+	if err != nil {
+		return nil, fromKey, hash, err
+	}
+
+	var req packet
+	switch ptype := sigdata[0]; ptype {
+	case PingPacket:
+		req = new(ping)
+	case PongPacket:
+		req = new(pong)
+	case FindnodePacket:
+		req = new(findnode)
+	case NeighborsPacket:
+		req = new(neighbors)
+	case ENRRequestPacket:
+		req = new(enrRequest)
+	case ENRResponsePacket:
+		req = new(enrResponse)
+	default:
+		return req, fromKey, hash, fmt.Errorf("%v: %d", ErrUnknownPacketType, ptype)
+	}
+	s := rlp.NewStream(bytes.NewReader(sigdata[1:]), 0)
+	// integers too large for their field, such as a port above 65535, fail to decode
+	if err = s.Decode(req); err != nil {
+		return req, fromKey, hash, err
+	}
+	return req, fromKey, hash, checkEndpoints(req)
+}
+
+// checkEndpoints verifies the IP length of the endpoints we use from a decoded packet, the
+// sender's in a ping and ours as seen by the sender in a pong. An empty IP is allowed, as
+// go-ethereum sends one for an address it doesn't know yet. The 'to' of a ping is not
+// checked: we answer to the packet's source address, whatever it says.
+func checkEndpoints(p packet) error {
+	var (
+		field string
+		ip    net.IP
+	)
+	switch p := p.(type) {
+	case *ping:
+		field, ip = "ping 'from'", p.From.IP
+	case *pong:
+		field, ip = "pong 'to'", p.To.IP
+	default:
+		return nil
+	}
+	if len(ip) == 0 {
+		return nil
+	}
+	if err := checkIPLength(ip); err != nil {
+		return fmt.Errorf("%v: %s IP of %d bytes", err, field, len(ip))
+	}
+	return nil
+}
+
+func (req *ping) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	if expired(req.Expiration) {
+		return ErrExpired
+	}
+	received := time.Now()
+	key, err := decodePubkey(fromKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	// mac points into the read buffer, which is reused before a delayed pong is sent
+	resp := &pong{
+		To:         makeEndpoint(from, req.From.TCP),
+		ReplyTok:   append([]byte{}, mac...),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	t.respond(func() { t.send(from, PongPacket, resp) })
+	n := wrapNode(enode.NewV4(key, from.IP, int(req.From.TCP), from.Port))
+	t.reversePing(n.ID(), from)
+	t.bondMu.Lock()
+	if t.pingedAt == nil {
+		t.pingedAt = make(map[enode.ID]time.Time)
+	}
+	t.pingedAt[n.ID()] = received
+	t.bondMu.Unlock()
+	// The ping is answered either way, but one no pending was waiting for is reported as
+	// unsolicited, as pongs and the other replies are.
+	return t.deliverReply(n.ID(), PingPacket, incomingPacket{packet: req, recoveredID: fromKey, received: received, source: from})
+}
+
+func (req *ping) name() string { return "PING/v4" }
+
+func (req *pong) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	if expired(req.Expiration) {
+		return ErrExpired
+	}
+	fromID := fromKey.id()
+	// The spec bounds expirations only from below, so a pong expiring years ahead is valid,
+	// but it hints at a broken clock and is rejected if a limit is configured.
+	if t.maxPongExpiration > 0 && req.Expiration > uint64(time.Now().Add(t.maxPongExpiration).Unix()) {
+		t.deliverReply(fromID, farFuturePong, incomingPacket{packet: req, recoveredID: fromKey, source: from})
+		return ErrFarFuture
+	}
+	// A pong arriving after its pending timed out matches nothing and is unsolicited.
+	return t.deliverReply(fromID, PongPacket, incomingPacket{packet: req, recoveredID: fromKey, source: from})
+}
+
+func (req *pong) name() string { return "PONG/v4" }
+
+func (req *findnode) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	if expired(req.Expiration) {
+		return ErrExpired
+	}
+	if t.neighbours == nil {
+		//we only answer findnode when configured with neighbours to return
+		return nil
+	}
+	if !t.bonded(fromKey.id()) {
+		// No endpoint proof pong exists, we don't process the packet. This prevents an
+		// attack vector where the discovery protocol could be used to amplify traffic in a
+		// DDOS attack. A malicious actor would send a findnode request with the IP address
+		// and UDP port of the target as the source address. The recipient of the findnode
+		// packet would then send a neighbors packet (which is a much bigger packet than
+		// findnode) to the victim.
+		return ErrUnknownNode
+	}
+	// Send neighbors in chunks with at most maxNeighbors per packet
+	// to stay below the 1280 byte limit.
+	chunks := chunkNeighbours(t.closestNeighbours(from, req.Target.id()))
+	if t.responder != nil && t.responder.reorder {
+		for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+			chunks[i], chunks[j] = chunks[j], chunks[i]
+		}
+	}
+	t.respond(func() {
+		for _, chunk := range chunks {
+			t.send(from, NeighborsPacket, &neighbors{Nodes: chunk, Expiration: uint64(time.Now().Add(expiration).Unix())})
+		}
+	})
+	return nil
+}
+
+func (req *findnode) name() string { return "FINDNODE/v4" }
+
+func (req *neighbors) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	if expired(req.Expiration) {
+		return ErrExpired
+	}
+	return t.deliverReply(fromKey.id(), NeighborsPacket, incomingPacket{packet: req, recoveredID: fromKey, source: from})
+}
+
+func (req *neighbors) name() string { return "NEIGHBORS/v4" }
+
+func (req *enrRequest) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	if expired(req.Expiration) {
+		return ErrExpired
+	}
+	if t.responder == nil || t.responder.record == nil {
+		// we don't serve our own record
+		return nil
+	}
+	if !t.bonded(fromKey.id()) {
+		return ErrUnknownNode
+	}
+	// the record may be above the size limit, so it is sent as is rather than as an enr.Record
+	resp := &struct {
+		ReplyTok []byte
+		Record   rlp.RawValue
+	}{append([]byte{}, mac...), t.responder.record}
+	packet, _, err := encodePacket(t.priv, ENRResponsePacket, resp)
+	if err != nil {
+		return err
+	}
+	t.respond(func() { t.write(from, "ENRRESPONSE/v4", packet) })
+	return nil
+}
+
+func (req *enrRequest) name() string { return "ENRREQUEST/v4" }
+
+func (req *enrResponse) handle(t *V4Udp, from *net.UDPAddr, fromKey EncPubkey, mac []byte) error {
+	return t.deliverReply(fromKey.id(), ENRResponsePacket, incomingPacket{packet: req, recoveredID: fromKey, source: from})
+}
+
+func (req *enrResponse) name() string { return "ENRRESPONSE/v4" }
+
+// expired reports whether the timestamp ts is in the past. The comparison is done on unsigned
+// seconds, as converting ts to a time.Time wraps values near and beyond the int64 range into
+// the past.
+func expired(ts uint64) bool {
+	return ts <= uint64(time.Now().Unix())
+}
@@ -0,0 +1,2490 @@
+package discv4test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// TestSeedReproducible checks that the same seed produces identical packet bytes, so that
+// a failing run can be replayed with the seed printed at start.
+func TestSeedReproducible(t *testing.T) {
+	encode := func(seed int64) []byte {
+		udp := &V4Udp{rand: rand.New(rand.NewSource(seed))}
+		signer, err := GenerateKey(udp.rand)
+		if err != nil {
+			t.Fatalf("could not generate key: %v", err)
+		}
+		packet, _, err := udp.fakeNeighbourPacket(signer, 1000)
+		if err != nil {
+			t.Fatalf("could not encode packet: %v", err)
+		}
+		return packet
+	}
+
+	if a, b := encode(42), encode(42); !bytes.Equal(a, b) {
+		t.Fatalf("same seed produced different packets:\n%x\n%x", a, b)
+	}
+	if a, b := encode(42), encode(43); bytes.Equal(a, b) {
+		t.Fatal("different seeds produced identical packets")
+	}
+}
+
+// TestReplyTokLength checks that pong reply tokens padded or truncated around the ping hash are
+// rejected as the wrong length rather than matched or treated as a plain mismatch.
+func TestReplyTokLength(t *testing.T) {
+	hash := crypto.Keccak256([]byte("ping"))
+	tests := []struct {
+		tok  []byte
+		want error
+	}{
+		{hash, nil},
+		{append(append([]byte{}, hash...), 0), ErrBadReplyTokLength},
+		{hash[:macSize-1], ErrBadReplyTokLength},
+		{make([]byte, macSize), ErrUnsolicitedReply},
+	}
+	for _, test := range tests {
+		if err := checkReplyTok(test.tok, hash); err != test.want {
+			t.Errorf("token %x: got %v, want %v", test.tok, err, test.want)
+		}
+	}
+}
+
+// TestCallbackPanic checks that a panicking reply callback fails its own pending with
+// ErrHandlerPanic and leaves the loop running for later replies.
+func TestCallbackPanic(t *testing.T) {
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	id := enode.ID{1}
+	errc := udp.pending(id, func(reply) error { panic("test panic") })
+	udp.handleReply(id, PongPacket, incomingPacket{})
+	if err := <-errc; err != ErrHandlerPanic {
+		t.Fatalf("got %v, want %v", err, ErrHandlerPanic)
+	}
+
+	errc = udp.pending(id, func(reply) error { return nil })
+	if !udp.handleReply(id, PongPacket, incomingPacket{}) {
+		t.Fatal("reply not matched after callback panic")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+// TestReplyTypeRouting registers two pendings for the same node, one expecting a pong and one
+// expecting neighbours. A neighbours packet must complete only the neighbours pending, leaving
+// the pong pending waiting for its own reply.
+func TestReplyTypeRouting(t *testing.T) {
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	expect := func(ptype byte) func(reply) error {
+		return func(p reply) error {
+			if p.ptype != ptype {
+				return ErrPacketMismatch
+			}
+			return nil
+		}
+	}
+	id := enode.ID{1}
+	pongc := udp.pending(id, expect(PongPacket))
+	neighboursc := udp.pending(id, expect(NeighborsPacket))
+
+	if !udp.handleReply(id, NeighborsPacket, incomingPacket{}) {
+		t.Fatal("neighbours did not match")
+	}
+	if err := <-neighboursc; err != nil {
+		t.Fatalf("neighbours pending: got %v, want nil", err)
+	}
+	select {
+	case err := <-pongc:
+		t.Fatalf("pong pending completed by neighbours: %v", err)
+	default:
+	}
+
+	if !udp.handleReply(id, PongPacket, incomingPacket{}) {
+		t.Fatal("pong did not match")
+	}
+	if err := <-pongc; err != nil {
+		t.Fatalf("pong pending: got %v, want nil", err)
+	}
+	if udp.handleReply(id, NeighborsPacket, incomingPacket{}) {
+		t.Fatal("second neighbours matched with no pending left")
+	}
+}
+
+// TestLatePong checks that a pong arriving after its pending timed out is reported as
+// unsolicited, does not reach the expired callback and does not send on errc again.
+func TestLatePong(t *testing.T) {
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	fromKey := EncodePubkey(&key.PublicKey)
+	calls := 0
+	errc := udp.pending(fromKey.id(), func(reply) error {
+		calls++
+		return nil
+	})
+	if err := <-errc; err != ErrTimeout {
+		t.Fatalf("got %v, want %v", err, ErrTimeout)
+	}
+
+	late := &pong{Expiration: uint64(time.Now().Add(expiration).Unix())}
+	if err := late.handle(udp, &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}, fromKey, nil); err != ErrUnsolicitedReply {
+		t.Fatalf("late pong: got %v, want %v", err, ErrUnsolicitedReply)
+	}
+	if calls != 0 {
+		t.Fatalf("expired callback invoked %d times", calls)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("second result sent on errc: %v", err)
+	default:
+	}
+	// The loop must still be serving replies.
+	if udp.handleReply(fromKey.id(), PongPacket, incomingPacket{}) {
+		t.Fatal("reply matched with no pending")
+	}
+}
+
+// TestReplyTimeoutRace delivers replies around the deadline of their pending, so that some
+// arrive just before the timeout fires and some just after. Each pending must get exactly one
+// result on errc, nil if its reply matched and ErrTimeout if not, and no reply may be left
+// blocked in the loop.
+func TestReplyTimeoutRace(t *testing.T) {
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	const n = 50
+	var (
+		calls   [n]int32
+		matched [n]bool
+		errcs   [n]<-chan error
+		wg      sync.WaitGroup
+	)
+	for i := range errcs {
+		i := i
+		errcs[i] = udp.pending(enode.ID{byte(i)}, func(reply) error {
+			atomic.AddInt32(&calls[i], 1)
+			return nil
+		})
+	}
+	for i := range errcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(respTimeout - 10*time.Millisecond + time.Duration(i)*400*time.Microsecond)
+			matched[i] = udp.handleReply(enode.ID{byte(i)}, PongPacket, incomingPacket{})
+		}(i)
+	}
+	replied := make(chan struct{})
+	go func() { wg.Wait(); close(replied) }()
+	select {
+	case <-replied:
+	case <-time.After(2 * time.Second):
+		t.Fatal("replies still blocked in the loop")
+	}
+
+	for i, errc := range errcs {
+		var err error
+		select {
+		case err = <-errc:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("pending %d got no result", i)
+		}
+		switch {
+		case matched[i] && err != nil:
+			t.Errorf("pending %d: reply matched but got %v", i, err)
+		case !matched[i] && err != ErrTimeout:
+			t.Errorf("pending %d: reply unmatched but got %v, want %v", i, err, ErrTimeout)
+		}
+		if c := atomic.LoadInt32(&calls[i]); (c == 1) != matched[i] || c > 1 {
+			t.Errorf("pending %d: callback invoked %d times, matched %t", i, c, matched[i])
+		}
+	}
+	time.Sleep(respTimeout)
+	for i, errc := range errcs {
+		select {
+		case err := <-errc:
+			t.Errorf("pending %d: second result sent on errc: %v", i, err)
+		default:
+		}
+	}
+}
+
+// TestCancelPendings checks that a pending which would never complete is drained by
+// CancelPendings, and does not match replies afterwards.
+func TestCancelPendings(t *testing.T) {
+	udp := &V4Udp{
+		closing:        make(chan struct{}),
+		gotreply:       make(chan reply),
+		addpending:     make(chan *pending),
+		cancelpendings: make(chan chan struct{}),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	id := enode.ID{1}
+	errc := udp.pending(id, func(reply) error { return ErrPacketMismatch })
+	udp.CancelPendings()
+	select {
+	case err := <-errc:
+		if err != ErrCancelled {
+			t.Fatalf("got %v, want %v", err, ErrCancelled)
+		}
+	default:
+		t.Fatal("pending not cancelled")
+	}
+	if udp.handleReply(id, PongPacket, incomingPacket{}) {
+		t.Fatal("reply matched a cancelled pending")
+	}
+
+	errc = udp.pending(id, func(reply) error { return nil })
+	if !udp.handleReply(id, PongPacket, incomingPacket{}) {
+		t.Fatal("reply not matched after cancelling")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+// fakeClock is a settable time source for the reply loop.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// TestClockJumpForward checks both eviction paths of the reply loop when the clock jumps
+// forward past a pending's deadline and a second pending is added after the jump. Its deadline
+// is far beyond 2*respTimeout from the time before the jump, but it must not be evicted as a
+// clock warp: the first pending times out and the second only once its own deadline passes.
+func TestClockJumpForward(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+		clock:      clock.Now,
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	mismatch := func(reply) error { return ErrPacketMismatch }
+	first := udp.pending(enode.ID{1}, mismatch)
+	clock.Add(10 * time.Second)
+	second := udp.pending(enode.ID{2}, mismatch)
+
+	select {
+	case err := <-first:
+		if err != ErrTimeout {
+			t.Fatalf("first pending: got %v, want %v", err, ErrTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first pending did not time out")
+	}
+	select {
+	case err := <-second:
+		t.Fatalf("second pending evicted before its deadline: %v", err)
+	case <-time.After(2 * respTimeout):
+	}
+
+	clock.Add(respTimeout)
+	select {
+	case err := <-second:
+		if err != ErrTimeout {
+			t.Fatalf("second pending: got %v, want %v", err, ErrTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second pending did not time out")
+	}
+}
+
+// TestStrictReplySource checks that with StrictReplySource set, a pong signed by the pinged
+// node but sent from another IP is rejected, and that it is accepted otherwise.
+func TestStrictReplySource(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key, _ := GenerateKey(rnd)
+	responderKey, _ := GenerateKey(rnd)
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	toaddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}
+	otherAddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 3}, Port: 30303}
+
+	for _, strict := range []bool{true, false} {
+		udp := &V4Udp{
+			conn:              new(recordConn),
+			priv:              key,
+			closing:           make(chan struct{}),
+			gotreply:          make(chan reply),
+			addpending:        make(chan *pending),
+			strictReplySource: strict,
+		}
+		go udp.loop()
+
+		req := udp.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+		packet, hash, err := encodePacket(key, PingPacket, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := udp.sendPacket(toid, toaddr, req, packet, func(p reply) error {
+			if p.ptype == PongPacket {
+				return nil
+			}
+			return ErrPacketMismatch
+		})
+		pongPacket, _, err := encodePacket(responderKey, PongPacket, &pong{ReplyTok: hash, Expiration: uint64(time.Now().Add(expiration).Unix())})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = udp.handlePacket(otherAddr, pongPacket)
+		if strict {
+			if err != ErrReplyFromWrongIP {
+				t.Fatalf("strict: got %v, want %v", err, ErrReplyFromWrongIP)
+			}
+			if err := udp.handlePacket(toaddr, pongPacket); err != nil {
+				t.Fatalf("strict, pong from the pinged IP: %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("not strict: got %v, want nil", err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("strict %t: ping got %v", strict, err)
+		}
+		close(udp.closing)
+	}
+}
+
+// TestCheckNeighbours checks that a private IP neighbour relayed by a public sender is filtered.
+func TestCheckNeighbours(t *testing.T) {
+	udp := &V4Udp{}
+	rnd := rand.New(rand.NewSource(1))
+	var nodes []rpcNode
+	for _, ip := range []net.IP{{1, 2, 3, 4}, {192, 168, 0, 1}} {
+		key, err := GenerateKey(rnd)
+		if err != nil {
+			t.Fatalf("could not generate key: %v", err)
+		}
+		nodes = append(nodes, rpcNode{IP: ip, UDP: 30303, TCP: 30303, ID: EncodePubkey(&key.PublicKey)})
+	}
+	sender := &net.UDPAddr{IP: net.IP{8, 8, 8, 8}, Port: 30303}
+
+	if err := udp.checkNeighbours(sender, nodes[:1]); err != nil {
+		t.Fatalf("valid neighbour filtered: %v", err)
+	}
+	err := udp.checkNeighbours(sender, nodes)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 filtered") {
+		t.Fatalf("got %v, want private neighbour filtered", err)
+	}
+}
+
+// TestFindnodeExactMaxNeighbours checks that a result of exactly maxNeighbors nodes is sent in
+// a single full packet with no trailing empty packet.
+func TestFindnodeExactMaxNeighbours(t *testing.T) {
+	nodes := make([]rpcNode, maxNeighbors)
+	chunks := chunkNeighbours(nodes)
+	if len(chunks) != 1 || len(chunks[0]) != maxNeighbors {
+		t.Fatalf("got %d packets, want 1 full packet", len(chunks))
+	}
+	if err := checkChunking(chunks); err != nil {
+		t.Fatalf("reference chunking rejected: %v", err)
+	}
+
+	tests := []struct {
+		chunks [][]rpcNode
+		ok     bool
+	}{
+		{chunkNeighbours(nil), true},
+		{chunkNeighbours(make([]rpcNode, maxNeighbors+1)), true},
+		{[][]rpcNode{nodes, {}}, false},            // spurious trailing empty packet
+		{[][]rpcNode{nodes[:1], nodes[1:]}, false}, // over-fragmented
+	}
+	for i, test := range tests {
+		if err := checkChunking(test.chunks); (err == nil) != test.ok {
+			t.Errorf("test %d: got %v, want ok=%v", i, err, test.ok)
+		}
+	}
+}
+
+// TestWatchdog checks that the watchdog stays quiet on a healthy loop and fires when a
+// callback blocks it.
+func TestWatchdog(t *testing.T) {
+	fired := make(chan struct{})
+	udp := &V4Udp{
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+		onStuck:    func() { close(fired) },
+	}
+	go udp.loop()
+	go udp.watchdog(50 * time.Millisecond)
+
+	select {
+	case <-fired:
+		t.Fatal("watchdog fired on a healthy loop")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	block := make(chan struct{})
+	defer close(udp.closing)
+	defer close(block)
+
+	id := enode.ID{1}
+	udp.pending(id, func(reply) error {
+		<-block
+		return nil
+	})
+	go udp.handleReply(id, PongPacket, incomingPacket{})
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not fire on a blocked loop")
+	}
+}
+
+func TestParseForkID(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ForkID
+		ok    bool
+	}{
+		{"0xfc64ec04", ForkID{Hash: [4]byte{0xfc, 0x64, 0xec, 0x04}}, true},
+		{"fc64ec04:1150000", ForkID{Hash: [4]byte{0xfc, 0x64, 0xec, 0x04}, Next: 1150000}, true},
+		{"0xfc64ec", ForkID{}, false},
+		{"0xfc64ec04:next", ForkID{}, false},
+	}
+	for _, test := range tests {
+		id, err := ParseForkID(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got error %v, want ok=%v", test.input, err, test.ok)
+			continue
+		}
+		if test.ok && id != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.input, id, test.want)
+		}
+	}
+}
+
+// TestDecodeNeighboursPortOverflow checks that a neighbours packet whose node port does not fit
+// in a uint16 fails to decode, rather than yielding a wrapped or truncated port.
+func TestDecodeNeighboursPortOverflow(t *testing.T) {
+	type wideNode struct {
+		IP       net.IP
+		UDP, TCP uint32
+		ID       EncPubkey
+	}
+	type wideNeighbors struct {
+		Nodes      []wideNode
+		Expiration uint64
+	}
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	for _, port := range []uint32{30303, 70000} {
+		req := &wideNeighbors{Nodes: []wideNode{{IP: net.IP{1, 2, 3, 4}, UDP: port, TCP: 30303}}, Expiration: 1}
+		packet, _, err := encodePacket(key, NeighborsPacket, req)
+		if err != nil {
+			t.Fatalf("could not encode packet: %v", err)
+		}
+		p, _, _, err := decodePacket(packet)
+		switch {
+		case port <= 0xffff && err != nil:
+			t.Errorf("port %d: unexpected decode error: %v", port, err)
+		case port <= 0xffff && uint32(p.(*neighbors).Nodes[0].UDP) != port:
+			t.Errorf("port %d: decoded as %d", port, p.(*neighbors).Nodes[0].UDP)
+		case port > 0xffff && err == nil:
+			t.Errorf("port %d: decoded without error as %d", port, p.(*neighbors).Nodes[0].UDP)
+		}
+	}
+}
+
+// TestDecodeEndpointIPLength checks that IPs of a length other than 4 or 16 bytes are rejected
+// in neighbour nodes, and in the endpoints we use from pings and pongs, where an empty IP is
+// also allowed. The 'to' of a ping is not used, so any length decodes.
+func TestDecodeEndpointIPLength(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	exp := uint64(time.Now().Add(expiration).Unix())
+	valid := RPCEndpoint{IP: net.IP{127, 0, 0, 1}, UDP: 30303}
+	tests := []struct {
+		len              int
+		nodeOK, endpoint bool
+	}{
+		{0, false, true},
+		{3, false, false},
+		{4, true, true},
+		{5, false, false},
+		{16, true, true},
+		{17, false, false},
+	}
+	for _, test := range tests {
+		ip := make(net.IP, test.len)
+		for i := range ip {
+			ip[i] = byte(i + 1)
+		}
+		if err := checkIPLength(ip); (err == nil) != test.nodeOK {
+			t.Errorf("%d byte node IP: got %v", test.len, err)
+		}
+		e := RPCEndpoint{IP: ip, UDP: 30303}
+		packets := []struct {
+			name  string
+			ptype byte
+			req   interface{}
+			ok    bool
+		}{
+			{"ping 'from'", PingPacket, &ping{Version: 4, From: e, To: valid, Expiration: exp}, test.endpoint},
+			{"ping 'to'", PingPacket, &ping{Version: 4, From: valid, To: e, Expiration: exp}, true},
+			{"pong 'to'", PongPacket, &pong{To: e, ReplyTok: make([]byte, macSize), Expiration: exp}, test.endpoint},
+		}
+		for _, p := range packets {
+			packet, _, err := encodePacket(key, p.ptype, p.req)
+			if err != nil {
+				t.Fatalf("could not encode packet: %v", err)
+			}
+			_, _, _, err = decodePacket(packet)
+			switch {
+			case p.ok && err != nil:
+				t.Errorf("%d byte %s IP: unexpected decode error: %v", test.len, p.name, err)
+			case !p.ok && (err == nil || !strings.HasPrefix(err.Error(), ErrBadIPLength.Error())):
+				t.Errorf("%d byte %s IP: got %v, want %v", test.len, p.name, err, ErrBadIPLength)
+			}
+		}
+	}
+}
+
+// TestDecodeEmptyPacket checks that a zero-length datagram is rejected as too small.
+func TestDecodeEmptyPacket(t *testing.T) {
+	if _, _, _, err := decodePacket([]byte{}); err != ErrPacketTooSmall {
+		t.Fatalf("got %v, want %v", err, ErrPacketTooSmall)
+	}
+}
+
+// TestDecodeType0Packet checks that the reserved packet type 0 is rejected as unknown.
+func TestDecodeType0Packet(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	packet, _, err := encodePacket(key, 0, &ping{Version: 4, Expiration: uint64(time.Now().Add(expiration).Unix())})
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	if _, _, _, err := decodePacket(packet); err == nil || !strings.HasPrefix(err.Error(), ErrUnknownPacketType.Error()) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownPacketType)
+	}
+}
+
+// TestDecodeWrongStructure checks that payloads of the wrong RLP structure for their packet
+// type, such as a string where a list is expected or a list nested one level too deep or too
+// shallow, are rejected with an error rather than a panic.
+func TestDecodeWrongStructure(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	var (
+		exp      = uint64(time.Now().Add(expiration).Unix())
+		endpoint = []interface{}{net.IP{1, 2, 3, 4}, uint16(30303), uint16(30303)}
+		pubkey   = EncodePubkey(&key.PublicKey)
+		tok      = make([]byte, 32)
+	)
+	wrong := map[byte][]interface{}{
+		PingPacket: {
+			[]interface{}{uint(4), []byte("from"), []byte("to"), exp},
+			[]interface{}{uint(4), []interface{}{endpoint}, endpoint, exp},
+		},
+		PongPacket: {
+			[]interface{}{[]byte("to"), tok, exp},
+			[]interface{}{endpoint, []interface{}{tok}, exp},
+		},
+		FindnodePacket: {
+			[]interface{}{[]interface{}{pubkey[:]}, exp},
+			[]interface{}{pubkey[:], []interface{}{exp}},
+		},
+		NeighborsPacket: {
+			[]interface{}{[]interface{}{net.IP{1, 2, 3, 4}, uint16(30303), uint16(30303), pubkey[:]}, exp},
+			[]interface{}{[]byte("nodes"), exp},
+		},
+		ENRRequestPacket: {
+			[]interface{}{[]interface{}{exp}},
+		},
+		ENRResponsePacket: {
+			[]interface{}{[]interface{}{tok}, []interface{}{}},
+		},
+	}
+	for ptype, payloads := range wrong {
+		//a string or an empty list in place of the whole packet is wrong for every type
+		payloads = append(payloads, []byte("packet"), []interface{}{})
+		for i, payload := range payloads {
+			packet, _, err := encodePacket(key, ptype, payload)
+			if err != nil {
+				t.Fatalf("type %d, payload %d: could not encode packet: %v", ptype, i, err)
+			}
+			if panicked := catchDecodePanic(packet); panicked != nil {
+				t.Errorf("type %d, payload %d: decode panicked: %v", ptype, i, panicked)
+			} else if p, _, _, err := decodePacket(packet); err == nil {
+				t.Errorf("type %d, payload %d: decoded without error as %+v", ptype, i, p)
+			}
+		}
+	}
+}
+
+// catchDecodePanic decodes packet and returns the value of a panic in decodePacket, if any.
+func catchDecodePanic(packet []byte) (panicked interface{}) {
+	defer func() { panicked = recover() }()
+	decodePacket(packet)
+	return nil
+}
+
+// TestSignatureScope checks that encodePacket signs exactly the type byte and RLP payload,
+// packet[headSize:], and that decodePacket recovers the signer's key from that range.
+func TestSignatureScope(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	req := &ping{Version: 4, Expiration: uint64(time.Now().Add(expiration).Unix())}
+	packet, hash, err := encodePacket(key, PingPacket, req)
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	payload, err := rlp.EncodeToBytes(req)
+	if err != nil {
+		t.Fatalf("could not encode ping: %v", err)
+	}
+	if packet[headSize] != PingPacket || !bytes.Equal(packet[headSize+1:], payload) {
+		t.Fatalf("packet[headSize:] is %x, want type byte %x followed by %x", packet[headSize:], PingPacket, payload)
+	}
+	if !bytes.Equal(hash, packet[:macSize]) || !bytes.Equal(hash, crypto.Keccak256(packet[macSize:])) {
+		t.Fatalf("hash %x does not cover packet[macSize:]", hash)
+	}
+
+	want := EncodePubkey(&key.PublicKey)
+	sig := packet[macSize:headSize]
+	if got, err := recoverNodeKey(crypto.Keccak256(packet[headSize:]), sig); err != nil || got != want {
+		t.Fatalf("recovering over packet[headSize:]: got %x (err %v), want %x", got, err, want)
+	}
+	if got, _ := recoverNodeKey(crypto.Keccak256(packet[headSize+1:]), sig); got == want {
+		t.Fatal("signature also verifies without the type byte")
+	}
+	if _, got, _, err := decodePacket(packet); err != nil || got != want {
+		t.Fatalf("decodePacket: got %x (err %v), want %x", got, err, want)
+	}
+}
+
+// TestPingWithTail checks that pings padded by pingWithTail encode to the requested size,
+// give or take a byte of length prefix, and still decode with the tail kept.
+func TestPingWithTail(t *testing.T) {
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	udp := &V4Udp{priv: key}
+	toaddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+	for _, size := range []int{200, 256, 1000, largeTailSize, maxPacketSize} {
+		req, err := udp.pingWithTail(toaddr, size)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		packet, _, err := encodePacket(key, PingPacket, req)
+		if err != nil {
+			t.Fatalf("size %d: could not encode packet: %v", size, err)
+		}
+		if len(packet) > size || len(packet) < size-1 {
+			t.Errorf("size %d: got %d byte packet", size, len(packet))
+		}
+		p, _, _, err := decodePacket(packet)
+		if err != nil {
+			t.Fatalf("size %d: could not decode packet: %v", size, err)
+		}
+		if rest := p.(*ping).Rest; len(rest) != 1 {
+			t.Errorf("size %d: decoded %d tail values, want 1", size, len(rest))
+		}
+	}
+	if _, err := udp.pingWithTail(toaddr, headSize); err == nil {
+		t.Error("no error for a size too small to hold a tail")
+	}
+}
+
+// TestPingWeirdTail checks that the byte strings of weirdTail decode back into the ping's
+// tail unchanged, and that our own listener pongs the ping.
+func TestPingWeirdTail(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+	toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+
+	req := source.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))
+	req.Rest = weirdTail
+	packet, _, err := encodePacket(source.priv, PingPacket, req)
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	p, _, _, err := decodePacket(packet)
+	if err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	rest := p.(*ping).Rest
+	if len(rest) != len(weirdTail) {
+		t.Fatalf("decoded %d tail values, want %d", len(rest), len(weirdTail))
+	}
+	for i := range rest {
+		if !bytes.Equal(rest[i], weirdTail[i]) {
+			t.Errorf("tail value %d: got %x, want %x", i, rest[i], weirdTail[i])
+		}
+	}
+
+	if err := source.PingWeirdTail(EncodePubkey(&target.priv.PublicKey).id(), toaddr); err != nil {
+		t.Fatalf("our listener did not pong: %v", err)
+	}
+}
+
+// servePongs answers every ping arriving on c with a pong whose expiration is given by exp.
+func servePongs(c *net.UDPConn, key *ecdsa.PrivateKey, exp func() uint64) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := c.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p, _, hash, err := decodePacket(buf[:n])
+		if _, ok := p.(*ping); err != nil || !ok {
+			continue
+		}
+		resp := &pong{To: makeEndpoint(from, 0), ReplyTok: hash, Expiration: exp()}
+		if packet, _, err := encodePacket(key, PongPacket, resp); err == nil {
+			c.WriteToUDP(packet, from)
+		}
+	}
+}
+
+// expiresIn returns an expiration d from the time it is called, for servePongs.
+func expiresIn(d time.Duration) func() uint64 {
+	return func() uint64 { return uint64(time.Now().Add(d).Unix()) }
+}
+
+// TestPongExpiration checks that the expiration of a pong is measured, and that one beyond
+// MaxPongExpiration is reported by PongExpiration and dropped for Ping.
+func TestPongExpiration(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const year = 365 * 24 * time.Hour
+	tests := []struct {
+		ahead, limit time.Duration
+		want         error
+	}{
+		{20 * time.Second, 0, nil},
+		{year, 0, nil},
+		{20 * time.Second, time.Hour, nil},
+		{year, time.Hour, ErrFarFuture},
+	}
+	for i, test := range tests {
+		targetKey, _ := GenerateKey(rnd)
+		tc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		go servePongs(tc, targetKey, expiresIn(test.ahead))
+		key, _ := GenerateKey(rnd)
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		udp, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, MaxPongExpiration: test.limit})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+		toid, toaddr := EncodePubkey(&targetKey.PublicKey).id(), tc.LocalAddr().(*net.UDPAddr)
+
+		ahead, err := udp.PongExpiration(toid, toaddr)
+		if test.want == nil && err != nil || test.want != nil && (err == nil || !strings.HasPrefix(err.Error(), test.want.Error())) {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+		if ahead < test.ahead-2*time.Second || ahead > test.ahead {
+			t.Errorf("test %d: pong expires in %v, want %v", i, ahead, test.ahead)
+		}
+		if err := udp.Ping(toid, toaddr, true, nil); (err == nil) != (test.want == nil) {
+			t.Errorf("test %d: ping got %v", i, err)
+		}
+		udp.Close()
+		tc.Close()
+	}
+	if got := untilUnix(math.MaxUint64); got != time.Duration(math.MaxInt64) {
+		t.Errorf("largest expiration: got %v", got)
+	}
+}
+
+// TestPongExpirationFreshness checks that pongs expiring later as time passes are fresh, and
+// that pongs all carrying the same expiration are reported.
+func TestPongExpirationFreshness(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	fixed := uint64(time.Now().Add(time.Minute).Unix())
+	tests := []struct {
+		exp  func() uint64
+		want error
+	}{
+		{expiresIn(20 * time.Second), nil},
+		{func() uint64 { return fixed }, ErrStaleExpiration},
+	}
+	for i, test := range tests {
+		targetKey, _ := GenerateKey(rnd)
+		tc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		go servePongs(tc, targetKey, test.exp)
+		udp := newLoopbackUDP(t, rnd, 0, 0)
+		toid, toaddr := EncodePubkey(&targetKey.PublicKey).id(), tc.LocalAddr().(*net.UDPAddr)
+
+		delta, err := udp.PongExpirationFreshness(toid, toaddr, time.Second)
+		if test.want == nil && (err != nil || delta < time.Second) {
+			t.Errorf("test %d: got %v after %v, want a fresh expiration", i, err, delta)
+		}
+		if test.want != nil && (err == nil || !strings.HasPrefix(err.Error(), test.want.Error())) {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+		udp.Close()
+		tc.Close()
+	}
+}
+
+// TestDecodeNonCanonicalRLP checks that a ping whose expiration has a leading zero byte is
+// rejected, while the same value encoded canonically decodes.
+func TestDecodeNonCanonicalRLP(t *testing.T) {
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	exp := uint64(time.Now().Add(expiration).Unix())
+	req := &pingNonCanonical{Version: 4, Expiration: nonCanonicalUint(exp)}
+
+	packet, _, err := encodePacket(key, PingPacket, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := decodePacket(packet); err == nil || !strings.Contains(err.Error(), rlp.ErrCanonInt.Error()) {
+		t.Fatalf("got %v, want %v", err, rlp.ErrCanonInt)
+	}
+
+	req.Expiration, _ = rlp.EncodeToBytes(exp)
+	if packet, _, err = encodePacket(key, PingPacket, req); err != nil {
+		t.Fatal(err)
+	}
+	p, _, _, err := decodePacket(packet)
+	if err != nil {
+		t.Fatalf("canonical expiration rejected: %v", err)
+	}
+	if got := p.(*ping).Expiration; got != exp {
+		t.Fatalf("got expiration %d, want %d", got, exp)
+	}
+}
+
+// TestDecodeENRResponseOversizedRecord checks that an ENR response whose record claims to be
+// larger than the packet fails to decode.
+func TestDecodeENRResponseOversizedRecord(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	// list of a 32 byte reply token and a record whose header claims 2000 bytes, of which 10 follow
+	payload := []byte{0xc0 + 33 + 3 + 10, 0xa0}
+	payload = append(payload, make([]byte, 32)...)
+	payload = append(payload, 0xf9, 0x07, 0xd0)
+	payload = append(payload, make([]byte, 10)...)
+
+	packet, _, err := encodePacket(key, ENRResponsePacket, rlp.RawValue(payload))
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	if _, _, _, err := decodePacket(packet); err == nil {
+		t.Fatal("oversized record decoded without error")
+	}
+}
+
+// TestExpired checks expired at the int64 boundary, where converting to a signed time wraps.
+func TestExpired(t *testing.T) {
+	now := uint64(time.Now().Unix())
+	tests := []struct {
+		ts   uint64
+		want bool
+	}{
+		{0, true},
+		{now - 10, true},
+		{now + 10, false},
+		{math.MaxInt64, false},
+		{math.MaxInt64 + 1, false},
+		{math.MaxUint64, false},
+	}
+	for _, test := range tests {
+		if got := expired(test.ts); got != test.want {
+			t.Errorf("expired(%d) = %v, want %v", test.ts, got, test.want)
+		}
+	}
+}
+
+// TestProtocolSupportString checks the strictness wording of the protocol summary.
+func TestProtocolSupportString(t *testing.T) {
+	tests := []struct {
+		s    ProtocolSupport
+		want string
+	}{
+		{ProtocolSupport{}, "discovery v4: no, target does not answer pings"},
+		{ProtocolSupport{V4: true, Rejected: probedVersions}, "discovery v4: yes, EIP-868 ENR: no, accepts only ping version 4"},
+		{ProtocolSupport{V4: true, ENR: true, Accepted: probedVersions}, "discovery v4: yes, EIP-868 ENR: yes, ignores the ping version"},
+		{ProtocolSupport{V4: true, Accepted: []uint{5}, Rejected: []uint{0}}, "discovery v4: yes, EIP-868 ENR: no, accepts ping versions [5], rejects [0]"},
+	}
+	for _, test := range tests {
+		if got := test.s.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+// TestPrivateLeaks checks which internal neighbour addresses are leaks for each kind of sender.
+func TestPrivateLeaks(t *testing.T) {
+	var (
+		public    = net.IP{8, 8, 8, 8}
+		private   = net.IP{192, 168, 1, 1}
+		loopback  = net.IP{127, 0, 0, 1}
+		linkLocal = net.IP{169, 254, 1, 1}
+	)
+	nodes := []rpcNode{
+		{IP: net.IP{1, 2, 3, 4}},
+		{IP: net.IP{10, 0, 0, 1}},
+		{IP: loopback},
+		{IP: linkLocal},
+		{IP: net.IPv4zero},
+	}
+	tests := []struct {
+		sender net.IP
+		want   int
+	}{
+		{public, 4},
+		{private, 2},
+		{loopback, 1},
+	}
+	for _, test := range tests {
+		if leaks := privateLeaks(test.sender, nodes); len(leaks) != test.want {
+			t.Errorf("sender %v: got %d leaks %v, want %d", test.sender, len(leaks), leaks, test.want)
+		}
+	}
+	if leaks := privateLeaks(public, nodes[:1]); len(leaks) != 0 {
+		t.Errorf("public neighbour reported as leak: %v", leaks)
+	}
+}
+
+// TestNeighbourSetDiff checks that missing and unexpected nodes are reported separately,
+// independent of order and duplicates.
+func TestNeighbourSetDiff(t *testing.T) {
+	a, b, c, d := enode.ID{1}, enode.ID{2}, enode.ID{3}, enode.ID{4}
+
+	missing, unexpected := neighbourSetDiff([]enode.ID{a, b, c}, []enode.ID{c, a, b, a})
+	if len(missing) != 0 || len(unexpected) != 0 {
+		t.Errorf("equal sets: got missing %v, unexpected %v", missing, unexpected)
+	}
+	missing, unexpected = neighbourSetDiff([]enode.ID{a, b, c}, []enode.ID{a, d, d})
+	if len(missing) != 2 || missing[0] != b || missing[1] != c {
+		t.Errorf("got missing %v, want [%v %v]", missing, b, c)
+	}
+	if len(unexpected) != 1 || unexpected[0] != d {
+		t.Errorf("got unexpected %v, want [%v]", unexpected, d)
+	}
+}
+
+// TestPongENRSeq checks decoding of the EIP-868 sequence number from the pong tail.
+func TestPongENRSeq(t *testing.T) {
+	seq, _ := rlp.EncodeToBytes(uint64(7))
+	list, _ := rlp.EncodeToBytes([]uint{1, 2})
+	tests := []struct {
+		rest        []rlp.RawValue
+		seq         uint64
+		present, ok bool
+	}{
+		{nil, 0, false, true},
+		{[]rlp.RawValue{seq}, 7, true, true},
+		{[]rlp.RawValue{seq, list}, 7, true, true},
+		{[]rlp.RawValue{list}, 0, true, false},
+	}
+	for i, test := range tests {
+		seq, present, err := pongENRSeq(&pong{Rest: test.rest})
+		if seq != test.seq || present != test.present || (err == nil) != test.ok {
+			t.Errorf("test %d: got %d, %v, %v; want %d, %v, ok %v", i, seq, present, err, test.seq, test.present, test.ok)
+		}
+	}
+}
+
+// recordConn is a conn that records written packets and never receives any.
+type recordConn struct {
+	written [][]byte
+}
+
+func (c *recordConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) { select {} }
+func (c *recordConn) Close() error                                    { return nil }
+func (c *recordConn) LocalAddr() net.Addr                             { return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303} }
+
+func (c *recordConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.written = append(c.written, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// temporaryError is a write error that netutil.IsTemporaryError accepts, like ENOBUFS.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "no buffer space available" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyConn fails its first failures writes with a temporary error.
+type flakyConn struct {
+	recordConn
+	failures, attempts int
+}
+
+func (c *flakyConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return 0, temporaryError{}
+	}
+	return c.recordConn.WriteToUDP(b, addr)
+}
+
+// TestWriteRetry checks that a write failing with a temporary error is retried until it is
+// sent, and given up on once the retries run out.
+func TestWriteRetry(t *testing.T) {
+	to := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+	tests := []struct {
+		failures, retries, attempts int
+		sent                        bool
+	}{
+		{failures: 1, retries: 3, attempts: 2, sent: true},
+		{failures: 3, retries: 3, attempts: 4, sent: true},
+		{failures: 4, retries: 3, attempts: 4, sent: false},
+		{failures: 1, retries: 0, attempts: 1, sent: false},
+	}
+	for i, test := range tests {
+		conn := &flakyConn{failures: test.failures}
+		udp := &V4Udp{conn: conn, writeRetries: test.retries}
+		err := udp.write(to, "PING/v4", []byte{1})
+		if conn.attempts != test.attempts || (err == nil) != test.sent || len(conn.written) == 1 != test.sent {
+			t.Errorf("test %d: %d attempts, err %v, want %d attempts, sent %t", i, conn.attempts, err, test.attempts, test.sent)
+		}
+	}
+}
+
+// TestPinnedPubkey checks that a pong signed by a key other than the one pinned for the
+// target's address is reported, and that the pin leaves pongs from other addresses alone.
+func TestPinnedPubkey(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+
+	other, _ := GenerateKey(rnd)
+	right, wrong := EncodePubkey(&target.priv.PublicKey), EncodePubkey(&other.PublicKey)
+	tests := []struct {
+		pinned EncPubkey
+		addr   *net.UDPAddr
+		want   error
+	}{
+		{right, toaddr, nil},
+		{right, nil, nil},
+		{wrong, toaddr, ErrPubkeyMismatch},
+		{wrong, nil, ErrPubkeyMismatch},
+		{wrong, &net.UDPAddr{IP: toaddr.IP, Port: toaddr.Port + 1}, nil},
+	}
+	for i, test := range tests {
+		key, _ := GenerateKey(rnd)
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		pinned := test.pinned
+		source, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, PinnedPubkey: &pinned, PinnedAddr: test.addr})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+		err = source.Ping(toid, toaddr, true, nil)
+		source.Close()
+		if test.want == nil && err != nil || test.want != nil && (err == nil || !strings.HasPrefix(err.Error(), test.want.Error())) {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+	}
+}
+
+// TestConnFactory checks that tests opening extra sockets do so through Config.ConnFactory.
+func TestConnFactory(t *testing.T) {
+	errRefused := errors.New("refused by test factory")
+	var opened []*net.UDPAddr
+	udp := &V4Udp{
+		conn: new(recordConn),
+		rand: rand.New(rand.NewSource(1)),
+		connFactory: func(laddr *net.UDPAddr) (Conn, error) {
+			opened = append(opened, laddr)
+			return nil, errRefused
+		},
+	}
+	toaddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}
+	if _, err := udp.BondLatency(enode.ID{1}, toaddr); err != errRefused {
+		t.Errorf("BondLatency: got %v, want %v", err, errRefused)
+	}
+	if err := udp.ReversePingHonorsFromPort(enode.ID{1}, toaddr); err != errRefused {
+		t.Errorf("ReversePingHonorsFromPort: got %v, want %v", err, errRefused)
+	}
+	if len(opened) != 2 {
+		t.Fatalf("factory opened %d sockets, want 2", len(opened))
+	}
+	for _, laddr := range opened {
+		if !laddr.IP.Equal(net.IP{127, 0, 0, 1}) {
+			t.Errorf("socket opened on %v, want the IP of the suite's conn", laddr)
+		}
+	}
+}
+
+// unixConn reports a local address that is not a UDP address, as a custom conn relaying
+// packets over another transport might.
+type unixConn struct{ recordConn }
+
+func (c *unixConn) LocalAddr() net.Addr { return &net.UnixAddr{Name: "/tmp/discv4", Net: "unixgram"} }
+
+// TestNonUDPLocalAddr checks that a conn whose local address is not a UDP address is rejected
+// with an error unless AnnounceAddr says what to announce, rather than causing a panic.
+func TestNonUDPLocalAddr(t *testing.T) {
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	_, err := newUDP(new(unixConn), Config{PrivateKey: key})
+	if err == nil || !strings.HasPrefix(err.Error(), ErrInvalidConfig.Error()) || !strings.Contains(err.Error(), "AnnounceAddr is required") {
+		t.Fatalf("got %v, want %v asking for AnnounceAddr", err, ErrInvalidConfig)
+	}
+
+	announce := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+	udp, err := newUDP(new(unixConn), Config{PrivateKey: key, AnnounceAddr: announce})
+	if err != nil {
+		t.Fatalf("with AnnounceAddr: %v", err)
+	}
+	defer udp.Close()
+	if !udp.ourEndpoint.IP.Equal(announce.IP) || udp.ourEndpoint.UDP != uint16(announce.Port) {
+		t.Fatalf("announced %v:%d, want %v", udp.ourEndpoint.IP, udp.ourEndpoint.UDP, announce)
+	}
+	if _, err := udp.localSourceAddr(announce); err == nil {
+		t.Fatal("localSourceAddr accepted a non-UDP local address")
+	}
+}
+
+// TestSelfPacketDropped checks that a ping signed with our own key, as reflected back by a
+// hairpin NAT, is dropped rather than answered.
+func TestSelfPacketDropped(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	conn := new(recordConn)
+	udp := &V4Udp{conn: conn, priv: key, closing: make(chan struct{})}
+	close(udp.closing)
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	req := &ping{Version: 4, From: makeEndpoint(addr, 30303), To: makeEndpoint(addr, 30303), Expiration: uint64(time.Now().Add(expiration).Unix())}
+	packet, _, err := encodePacket(key, PingPacket, req)
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	if err := udp.handlePacket(addr, packet); err != ErrSelfPacket {
+		t.Fatalf("got %v, want %v", err, ErrSelfPacket)
+	}
+	if len(conn.written) != 0 {
+		t.Fatalf("own ping was answered with %d packets", len(conn.written))
+	}
+}
+
+// newLoopbackUDP starts a listener on a loopback port with a key drawn from rnd.
+func newLoopbackUDP(t *testing.T, rnd *rand.Rand, loss float64, jitter time.Duration) *V4Udp {
+	key, err := GenerateKey(rnd)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	udp, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, Loss: loss, Jitter: jitter})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	return udp
+}
+
+// TestPingLossyConn drives pings between two loopback listeners through a lossy conn.
+func TestPingLossyConn(t *testing.T) {
+	tests := []struct {
+		loss     float64
+		attempts int
+		want     error
+	}{
+		{0, 1, nil},
+		{0.3, 10, nil},
+		{1, 2, ErrTimeout},
+	}
+	for _, test := range tests {
+		rnd := rand.New(rand.NewSource(1))
+		target := newLoopbackUDP(t, rnd, 0, 0)
+		source := newLoopbackUDP(t, rnd, test.loss, 50*time.Millisecond)
+
+		toid := EncodePubkey(&target.priv.PublicKey).id()
+		toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+		if err := source.PingWithRetry(toid, toaddr, true, nil, test.attempts); err != test.want {
+			t.Errorf("loss %.1f: got %v, want %v", test.loss, err, test.want)
+		}
+		source.Close()
+		target.Close()
+	}
+}
+
+// sizeConn is a UDP conn that records the size of the largest packet written.
+type sizeConn struct {
+	*net.UDPConn
+	mu  sync.Mutex
+	max int
+}
+
+func (c *sizeConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	if len(b) > c.max {
+		c.max = len(b)
+	}
+	c.mu.Unlock()
+	return c.UDPConn.WriteToUDP(b, addr)
+}
+
+// TestFindnodeResponder checks that a listener configured with neighbours answers findnode
+// from a bonded peer only, with every relayable neighbour and in packets below the size limit.
+func TestFindnodeResponder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	var (
+		nodes    []*enode.Node
+		expected []enode.ID
+	)
+	for i := 0; i < bucketSize; i++ {
+		key, _ := GenerateKey(rnd)
+		n := enode.NewV4(&key.PublicKey, net.IP{10, 0, 0, byte(i + 1)}, 30303, 30303)
+		nodes = append(nodes, n)
+		expected = append(expected, n.ID())
+	}
+	//an unspecified address must never be relayed
+	key, _ := GenerateKey(rnd)
+	nodes = append(nodes, enode.NewV4(&key.PublicKey, net.IPv4zero, 30303, 30303))
+
+	responderKey, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	conn := &sizeConn{UDPConn: c}
+	responder, err := ListenUDP(conn, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: nodes})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer responder.Close()
+
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	toaddr := c.LocalAddr().(*net.UDPAddr)
+	target := EncodePubkey(&key.PublicKey)
+	//cache the bonds rather than wait out the bonding delay
+	initiator.bondMu.Lock()
+	initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	initiator.bondMu.Unlock()
+
+	if err := initiator.FindnodeExpectExactly(toid, toaddr, target, expected); err != ErrTimeout {
+		t.Fatalf("unbonded: got %v, want %v", err, ErrTimeout)
+	}
+
+	responder.bondMu.Lock()
+	responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+	responder.bondMu.Unlock()
+
+	if err := initiator.FindnodeExpectExactly(toid, toaddr, target, expected); err != nil {
+		t.Fatalf("bonded: %v", err)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.max > 1280 {
+		t.Fatalf("sent a %d byte packet, above the 1280 byte limit", conn.max)
+	}
+}
+
+// TestDoubleFindnode checks that the responses to two back-to-back findnode requests for
+// opposite targets are each attributed to their own request.
+func TestDoubleFindnode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	var nodes []*enode.Node
+	for i := 0; i < 2*bucketSize; i++ {
+		key, _ := GenerateKey(rnd)
+		nodes = append(nodes, enode.NewV4(&key.PublicKey, net.IP{10, 0, 0, byte(i + 1)}, 30303, 30303))
+	}
+	responderKey, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	responder, err := ListenUDP(c, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: nodes})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer responder.Close()
+
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	//cache the bonds rather than wait out the bonding delay
+	initiator.bondMu.Lock()
+	initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	initiator.bondMu.Unlock()
+	responder.bondMu.Lock()
+	responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+	responder.bondMu.Unlock()
+
+	first, second, err := initiator.DoubleFindnode(toid, c.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("got %v (%d and %d nodes)", err, first, second)
+	}
+	if first+second != 2*bucketSize {
+		t.Fatalf("got %d and %d nodes, want %d in total", first, second, 2*bucketSize)
+	}
+}
+
+// TestPoisonSelfNeighbour runs PoisonSelfNeighbour against responders listing our node at
+// the endpoint we bonded from, at the poisoned endpoint, and not at all.
+func TestPoisonSelfNeighbour(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	laddr := initiator.conn.LocalAddr().(*net.UDPAddr)
+
+	otherKey, _ := GenerateKey(rnd)
+	other := enode.NewV4(&otherKey.PublicKey, net.IP{10, 0, 0, 1}, 30303, 30303)
+	tests := []struct {
+		listed *enode.Node
+		found  bool
+		want   error
+	}{
+		{enode.NewV4(&initiator.priv.PublicKey, laddr.IP, laddr.Port, laddr.Port), true, nil},
+		{enode.NewV4(&initiator.priv.PublicKey, poisonedEndpoint.IP, int(poisonedEndpoint.TCP), int(poisonedEndpoint.UDP)), true, ErrPoisonedEndpoint},
+		{nil, false, nil},
+	}
+	for i, test := range tests {
+		neighbours := []*enode.Node{other}
+		if test.listed != nil {
+			neighbours = append(neighbours, test.listed)
+		}
+		responderKey, _ := GenerateKey(rnd)
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		responder, err := ListenUDP(c, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: neighbours})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+		toid := EncodePubkey(&responderKey.PublicKey).id()
+		//cache the bonds rather than wait out the bonding delay
+		initiator.bondMu.Lock()
+		initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+		initiator.bondMu.Unlock()
+		responder.bondMu.Lock()
+		responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+		responder.bondMu.Unlock()
+
+		found, err := initiator.PoisonSelfNeighbour(toid, c.LocalAddr().(*net.UDPAddr))
+		matched := err == test.want || err != nil && test.want != nil && strings.HasPrefix(err.Error(), test.want.Error())
+		if found != test.found || !matched {
+			t.Errorf("test %d: got found %t, err %v, want %t, %v", i, found, err, test.found, test.want)
+		}
+		responder.Close()
+	}
+}
+
+// endpointTarget is a minimal target for TestRePingUpdatesEndpoint. It pongs every ping, pings
+// back each identity the first time it hears from it, and answers findnode with every identity
+// it has heard from, at the endpoint last pinged from, or the first one if sticky is set.
+type endpointTarget struct {
+	key    *ecdsa.PrivateKey
+	conn   *net.UDPConn
+	sticky bool
+	seen   map[EncPubkey]*net.UDPAddr
+}
+
+func (e *endpointTarget) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := e.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p, fromKey, hash, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		exp := uint64(time.Now().Add(expiration).Unix())
+		switch p.(type) {
+		case *ping:
+			e.send(from, PongPacket, &pong{To: makeEndpoint(from, 0), ReplyTok: hash, Expiration: exp})
+			if _, ok := e.seen[fromKey]; !ok {
+				self := makeEndpoint(e.conn.LocalAddr().(*net.UDPAddr), 0)
+				e.send(from, PingPacket, &ping{Version: 4, From: self, To: makeEndpoint(from, 0), Expiration: exp})
+			}
+			if _, ok := e.seen[fromKey]; !ok || !e.sticky {
+				e.seen[fromKey] = from
+			}
+		case *findnode:
+			var nodes []rpcNode
+			for key, addr := range e.seen {
+				nodes = append(nodes, rpcNode{ID: key, IP: addr.IP, UDP: uint16(addr.Port), TCP: uint16(addr.Port)})
+			}
+			e.send(from, NeighborsPacket, &neighbors{Nodes: nodes, Expiration: exp})
+		}
+	}
+}
+
+func (e *endpointTarget) send(to *net.UDPAddr, ptype byte, req interface{}) {
+	if packet, _, err := encodePacket(e.key, ptype, req); err == nil {
+		e.conn.WriteToUDP(packet, to)
+	}
+}
+
+// TestRePingUpdatesEndpoint checks that a target taking the endpoint of our re-ping passes,
+// and that one keeping the endpoint we first bonded from is reported.
+func TestRePingUpdatesEndpoint(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, sticky := range []bool{false, true} {
+		initiator := newLoopbackUDP(t, rnd, 0, 0)
+		key, _ := GenerateKey(rnd)
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		target := &endpointTarget{key: key, conn: c, sticky: sticky, seen: make(map[EncPubkey]*net.UDPAddr)}
+		go target.serve()
+
+		found, err := initiator.RePingUpdatesEndpoint(EncodePubkey(&key.PublicKey).id(), c.LocalAddr().(*net.UDPAddr))
+		switch {
+		case !found:
+			t.Errorf("sticky %t: target did not list us (err %v)", sticky, err)
+		case !sticky && err != nil:
+			t.Errorf("updating target: got %v", err)
+		case sticky && (err == nil || !strings.HasPrefix(err.Error(), ErrStaleEndpoint.Error())):
+			t.Errorf("sticky target: got %v, want %v", err, ErrStaleEndpoint)
+		}
+		c.Close()
+		initiator.Close()
+	}
+}
+
+// TestDetectOneWayBonding checks that a target completing the bond passes, and that one
+// that pongs without pinging back is reported as one-way.
+func TestDetectOneWayBonding(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	tests := []struct {
+		opts []ResponderOption
+		want error
+	}{
+		{nil, nil},
+		{[]ResponderOption{WithSkipReversePing()}, ErrOneWayBond},
+	}
+	for i, test := range tests {
+		r, toid, toaddr := newResponder(t, rnd, test.opts...)
+		err := initiator.DetectOneWayBonding(toid, toaddr)
+		r.Close()
+		if test.want == nil && err != nil || test.want != nil && (err == nil || !strings.HasPrefix(err.Error(), test.want.Error())) {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+	}
+}
+
+// TestDualIdentityPing checks that a target pinging back each identity passes, and that one
+// that answers both pings but checks neither endpoint is reported.
+func TestDualIdentityPing(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+
+	key, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer c.Close()
+	go (&endpointTarget{key: key, conn: c, seen: make(map[EncPubkey]*net.UDPAddr)}).serve()
+	if err := initiator.DualIdentityPing(EncodePubkey(&key.PublicKey).id(), c.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Errorf("target pinging back each identity: got %v", err)
+	}
+
+	//our own listener pongs but never pings back
+	responder := newLoopbackUDP(t, rnd, 0, 0)
+	defer responder.Close()
+	toid := EncodePubkey(&responder.priv.PublicKey).id()
+	err = initiator.DualIdentityPing(toid, responder.conn.LocalAddr().(*net.UDPAddr))
+	if err == nil || !strings.HasPrefix(err.Error(), ErrIdentityConfused.Error()) {
+		t.Errorf("target not pinging back: got %v, want %v", err, ErrIdentityConfused)
+	}
+}
+
+// TestFindnodeNeighbourLiveness checks that of the neighbours returned, live nodes are counted,
+// dead ones are not, and our own node is left out.
+func TestFindnodeNeighbourLiveness(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	alive := newLoopbackUDP(t, rnd, 0, 0)
+	defer alive.Close()
+
+	//a port nothing listens on once the socket is closed
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+	dead.Close()
+	deadKey, _ := GenerateKey(rnd)
+
+	laddr := initiator.conn.LocalAddr().(*net.UDPAddr)
+	aliveAddr := alive.conn.LocalAddr().(*net.UDPAddr)
+	neighbours := []*enode.Node{
+		enode.NewV4(&initiator.priv.PublicKey, laddr.IP, laddr.Port, laddr.Port),
+		enode.NewV4(&alive.priv.PublicKey, aliveAddr.IP, aliveAddr.Port, aliveAddr.Port),
+		enode.NewV4(&deadKey.PublicKey, deadAddr.IP, deadAddr.Port, deadAddr.Port),
+	}
+	responderKey, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	responder, err := ListenUDP(c, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: neighbours})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer responder.Close()
+
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	//cache the bonds rather than wait out the bonding delay
+	initiator.bondMu.Lock()
+	initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	initiator.bondMu.Unlock()
+	responder.bondMu.Lock()
+	responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+	responder.bondMu.Unlock()
+
+	live, pinged, err := initiator.FindnodeNeighbourLiveness(toid, c.LocalAddr().(*net.UDPAddr), EncodePubkey(&initiator.priv.PublicKey))
+	if err != nil || live != 1 || pinged != 2 {
+		t.Errorf("got %d of %d live, err %v, want 1 of 2", live, pinged, err)
+	}
+}
+
+// TestPingAsIdentity checks that pings signed by another identity are answered over our socket,
+// and that packets sent without a key override are signed by our own key.
+func TestPingAsIdentity(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < 3; i++ {
+		key, _ := GenerateKey(rnd)
+		if err := source.PingAsIdentity(key, toid, toaddr); err != nil {
+			t.Fatalf("identity %d: %v", i, err)
+		}
+	}
+
+	conn := new(recordConn)
+	udp := &V4Udp{conn: conn, priv: source.priv}
+	key, _ := GenerateKey(rnd)
+	for _, priv := range []*ecdsa.PrivateKey{key, nil} {
+		if _, err := udp.sendAs(priv, toaddr, PingPacket, udp.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix()))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range []*ecdsa.PrivateKey{key, source.priv} {
+		_, fromKey, _, err := decodePacket(conn.written[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fromKey != EncodePubkey(&want.PublicKey) {
+			t.Errorf("packet %d signed by the wrong key", i)
+		}
+	}
+}
+
+// TestPingVerifyTransport checks that a pong from the pinged address is accepted and one from
+// any other IP or port is not.
+func TestPingVerifyTransport(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+	if err := source.PingVerifyTransport(EncodePubkey(&target.priv.PublicKey).id(), toaddr); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+
+	tests := []struct {
+		source *net.UDPAddr
+		ok     bool
+	}{
+		{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: toaddr.Port}, true},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: toaddr.Port}, true},
+		{&net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: toaddr.Port}, false},
+		{&net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: toaddr.Port + 1}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if err := checkPongSource(toaddr, test.source); (err == nil) != test.ok {
+			t.Errorf("source %v: got %v", test.source, err)
+		}
+	}
+}
+
+// TestRawExchange scripts a ping and pong between two loopback listeners with SendRaw and
+// ExpectRaw.
+func TestRawExchange(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	toid := EncodePubkey(&target.priv.PublicKey).id()
+	toaddr := target.conn.LocalAddr().(*net.UDPAddr)
+	raw, hash, err := encodePacket(source.priv, PingPacket, source.makePing(toaddr, 4, uint64(time.Now().Add(expiration).Unix())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		raw []byte
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		raw, err := source.ExpectRaw(toid, time.Second)
+		resc <- result{raw, err}
+	}()
+	//wait until ExpectRaw is registered, so the pong can't arrive before it
+	for {
+		source.rawMu.Lock()
+		n := len(source.rawWaiters[toid])
+		source.rawMu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := source.SendRaw(toaddr, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-resc
+	if res.err != nil {
+		t.Fatalf("no pong: %v", res.err)
+	}
+	p, fromKey, _, err := decodePacket(res.raw)
+	if err != nil {
+		t.Fatalf("could not decode pong: %v", err)
+	}
+	if fromKey.id() != toid {
+		t.Fatal("pong not signed by the target")
+	}
+	if err := checkReplyTok(p.(*pong).ReplyTok, hash); err != nil {
+		t.Fatal(err)
+	}
+	source.rawMu.Lock()
+	left := len(source.rawWaiters)
+	source.rawMu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d raw waiters left registered", left)
+	}
+
+	if _, err := source.ExpectRaw(toid, respTimeout); err != ErrTimeout {
+		t.Fatalf("got %v, want %v", err, ErrTimeout)
+	}
+}
+
+// TestPingDuplicateSuppression checks that every pong to a set of identical pings is counted,
+// against our own handler, which answers each ping.
+func TestPingDuplicateSuppression(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	target := newLoopbackUDP(t, rnd, 0, 0)
+	defer target.Close()
+	source := newLoopbackUDP(t, rnd, 0, 0)
+	defer source.Close()
+
+	pongs, err := source.PingDuplicateSuppression(EncodePubkey(&target.priv.PublicKey).id(), target.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pongs != duplicatePings {
+		t.Fatalf("got %d pongs, want %d", pongs, duplicatePings)
+	}
+}
+
+// TestFindnodeIPv6Chunking checks that our responder keeps IPv6 neighbours within the packet
+// size limit, and that a responder packing them by the IPv4 count is reported.
+func TestFindnodeIPv6Chunking(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var (
+		nodes []*enode.Node
+		naive []rpcNode
+	)
+	for i := 0; i < bucketSize; i++ {
+		key, _ := GenerateKey(rnd)
+		n := enode.NewV4(&key.PublicKey, net.ParseIP(fmt.Sprintf("fd00::%x", i+1)), 65535, 65535)
+		nodes = append(nodes, n)
+		naive = append(naive, nodeToRPC(wrapNode(n)))
+	}
+	target := EncodePubkey(nodes[0].Pubkey())
+
+	//our own responder chunks by the IPv6 count
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	responderKey, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	responder, err := ListenUDP(c, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: nodes})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer responder.Close()
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	initiator.bondMu.Lock()
+	initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	initiator.bondMu.Unlock()
+	responder.bondMu.Lock()
+	responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+	responder.bondMu.Unlock()
+
+	ipv6, err := initiator.FindnodeIPv6Chunking(toid, c.LocalAddr().(*net.UDPAddr), target)
+	if err != nil {
+		t.Fatalf("our responder: %v", err)
+	}
+	if ipv6 != bucketSize {
+		t.Fatalf("our responder: got %d IPv6 nodes, want %d", ipv6, bucketSize)
+	}
+
+	//a naive responder sends them all in one packet
+	key, _ := GenerateKey(rnd)
+	naiveKey, _ := GenerateKey(rnd)
+	conn := &instantConn{key: naiveKey, in: make(chan []byte, 1), nodes: naive}
+	udp, err := ListenUDP(conn, Config{PrivateKey: key, Rand: rnd, ReadBufferSize: maxDatagramSize})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer udp.Close()
+	toid = EncodePubkey(&naiveKey.PublicKey).id()
+	udp.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+
+	if _, err := udp.FindnodeIPv6Chunking(toid, &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}, target); err == nil || !strings.HasPrefix(err.Error(), ErrPacketTooLarge.Error()) {
+		t.Fatalf("naive responder: got %v, want %v", err, ErrPacketTooLarge)
+	}
+}
+
+// TestFindnodeMixedFamilyChunking checks that our responder keeps a mix of IPv4 and IPv6
+// neighbours within the packet size limit without dropping any, and that a responder sending
+// them in one packet, or leaving one out, is reported.
+func TestFindnodeMixedFamilyChunking(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var (
+		nodes    []*enode.Node
+		all      []rpcNode
+		expected []enode.ID
+	)
+	for i := 0; i < bucketSize; i++ {
+		ip := net.IP{10, 0, 0, byte(i + 1)}
+		if i%2 == 1 {
+			ip = net.ParseIP(fmt.Sprintf("fd00::%x", i+1))
+		}
+		key, _ := GenerateKey(rnd)
+		n := enode.NewV4(&key.PublicKey, ip, 65535, 65535)
+		nodes = append(nodes, n)
+		all = append(all, nodeToRPC(wrapNode(n)))
+		expected = append(expected, n.ID())
+	}
+	target := EncodePubkey(nodes[0].Pubkey())
+
+	//our own responder chunks by the worst-case node size
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	responderKey, _ := GenerateKey(rnd)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	responder, err := ListenUDP(c, Config{PrivateKey: responderKey, Rand: rnd, Neighbours: nodes})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer responder.Close()
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	initiator.bondMu.Lock()
+	initiator.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+	initiator.bondMu.Unlock()
+	responder.bondMu.Lock()
+	responder.bondCache = map[enode.ID]time.Time{EncodePubkey(&initiator.priv.PublicKey).id(): time.Now()}
+	responder.bondMu.Unlock()
+
+	ipv4, ipv6, err := initiator.FindnodeMixedFamilyChunking(toid, c.LocalAddr().(*net.UDPAddr), target, expected)
+	if err != nil {
+		t.Fatalf("our responder: %v", err)
+	}
+	if ipv4 != bucketSize/2 || ipv6 != bucketSize/2 {
+		t.Fatalf("our responder: got %d IPv4 and %d IPv6 nodes, want %d of each", ipv4, ipv6, bucketSize/2)
+	}
+
+	//naive responders send them all in one packet, or drop one to make them fit
+	tests := []struct {
+		nodes []rpcNode
+		want  error
+	}{
+		{all, ErrPacketTooLarge},
+		{all[1 : maxNeighbors+1], ErrMissingNeighbour},
+	}
+	for _, test := range tests {
+		key, _ := GenerateKey(rnd)
+		naiveKey, _ := GenerateKey(rnd)
+		conn := &instantConn{key: naiveKey, in: make(chan []byte, 1), nodes: test.nodes}
+		udp, err := ListenUDP(conn, Config{PrivateKey: key, Rand: rnd, ReadBufferSize: maxDatagramSize})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+		toid := EncodePubkey(&naiveKey.PublicKey).id()
+		udp.bondCache = map[enode.ID]time.Time{toid: time.Now()}
+
+		_, _, err = udp.FindnodeMixedFamilyChunking(toid, &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}, target, expected)
+		udp.Close()
+		if err == nil || !strings.HasPrefix(err.Error(), test.want.Error()) {
+			t.Fatalf("%d nodes in one packet: got %v, want %v", len(test.nodes), err, test.want)
+		}
+	}
+}
+
+// TestBondCache checks that a recent bond skips the ping round-trip and an expired one does not.
+func TestBondCache(t *testing.T) {
+	key, err := GenerateKey(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	conn := new(recordConn)
+	udp := &V4Udp{
+		conn:       conn,
+		priv:       key,
+		closing:    make(chan struct{}),
+		gotreply:   make(chan reply),
+		addpending: make(chan *pending),
+	}
+	go udp.loop()
+	defer close(udp.closing)
+
+	id := enode.ID{1}
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}
+	udp.bondCache = map[enode.ID]time.Time{id: time.Now()}
+	if err := udp.waitBonded(id, addr); err != nil {
+		t.Fatalf("cached bond: got %v, want nil", err)
+	}
+	if len(conn.written) != 0 {
+		t.Fatalf("cached bond sent %d packets", len(conn.written))
+	}
+
+	udp.bondCache[id] = time.Now().Add(-bondExpiration)
+	if err, ok := udp.waitBonded(id, addr).(*BondIncompleteError); !ok || err.Pong {
+		t.Fatalf("expired bond: got %v, want no pong", err)
+	}
+	if len(conn.written) != 1 {
+		t.Fatalf("expired bond sent %d packets, want 1 ping", len(conn.written))
+	}
+	if _, ok := udp.bondCache[id]; ok {
+		t.Fatal("expired bond still cached")
+	}
+}
+
+// TestWaitBondedWithin bonds with a responder that completes the handshake, one that pongs
+// but never pings back, and one that does neither, checking which half is reported stalled.
+func TestWaitBondedWithin(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	initiator := newLoopbackUDP(t, rnd, 0, 0)
+	defer initiator.Close()
+	initiatorID := EncodePubkey(&initiator.priv.PublicKey).id()
+	initiatorAddr := initiator.conn.LocalAddr().(*net.UDPAddr)
+
+	const deadline = time.Second
+	responder := newLoopbackUDP(t, rnd, 0, 0)
+	defer responder.Close()
+	responderID := EncodePubkey(&responder.priv.PublicKey).id()
+	responderAddr := responder.conn.LocalAddr().(*net.UDPAddr)
+
+	//pongs but never pings back
+	err := initiator.waitBondedWithin(responderID, responderAddr, deadline)
+	if bondErr, ok := err.(*BondIncompleteError); !ok || !bondErr.Pong {
+		t.Errorf("no reverse ping: got %v, want pong but no reverse ping", err)
+	}
+
+	//pongs and pings back
+	go responder.Ping(initiatorID, initiatorAddr, false, nil)
+	if err := initiator.waitBondedWithin(responderID, responderAddr, deadline); err != nil {
+		t.Errorf("full handshake: got %v, want nil", err)
+	}
+
+	//never answers
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer silent.Close()
+	err = initiator.waitBondedWithin(enode.ID{1}, silent.LocalAddr().(*net.UDPAddr), deadline)
+	if bondErr, ok := err.(*BondIncompleteError); !ok || bondErr.Pong {
+		t.Errorf("silent target: got %v, want no pong", err)
+	}
+}
+
+// TestConcurrentClose checks that Close can be called concurrently from several goroutines,
+// and that Done is closed once it has been.
+func TestConcurrentClose(t *testing.T) {
+	udp := &V4Udp{conn: new(recordConn), closing: make(chan struct{})}
+	select {
+	case <-udp.Done():
+		t.Fatal("done before Close")
+	default:
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			udp.Close()
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-udp.Done():
+	default:
+		t.Fatal("done channel not closed")
+	}
+}
+
+// instantConn is a conn that answers every findnode with a neighbours packet before the
+// write returns.
+type instantConn struct {
+	key   *ecdsa.PrivateKey
+	in    chan []byte
+	once  sync.Once
+	nodes []rpcNode // sent in a single neighbours packet, however many there are
+}
+
+func (c *instantConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+}
+
+func (c *instantConn) Close() error {
+	c.once.Do(func() { close(c.in) })
+	return nil
+}
+
+func (c *instantConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	packet, ok := <-c.in
+	if !ok {
+		return 0, nil, ErrClosed
+	}
+	return copy(b, packet), &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}, nil
+}
+
+func (c *instantConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if p, _, _, err := decodePacket(b); err == nil {
+		if _, ok := p.(*findnode); ok {
+			resp, _, err := encodePacket(c.key, NeighborsPacket, &neighbors{Nodes: c.nodes, Expiration: uint64(time.Now().Add(expiration).Unix())})
+			if err != nil {
+				return 0, err
+			}
+			c.in <- resp
+		}
+	}
+	return len(b), nil
+}
+
+// TestInstantReply checks that a reply delivered before the request write returns is still
+// matched to its pending, as the pending is registered before the write.
+func TestInstantReply(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key, _ := GenerateKey(rnd)
+	responderKey, _ := GenerateKey(rnd)
+	conn := &instantConn{key: responderKey, in: make(chan []byte, 1)}
+	udp, err := ListenUDP(conn, Config{PrivateKey: key, Rand: rnd})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer udp.Close()
+
+	toid := EncodePubkey(&responderKey.PublicKey).id()
+	toaddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}
+	for i := 0; i < 100; i++ {
+		req := &findnode{Expiration: uint64(time.Now().Add(expiration).Unix())}
+		packet, _, err := encodePacket(key, FindnodePacket, req)
+		if err != nil {
+			t.Fatalf("could not encode packet: %v", err)
+		}
+		callback := func(p reply) error {
+			if p.ptype == NeighborsPacket {
+				return nil
+			}
+			return ErrPacketMismatch
+		}
+		if err := <-udp.sendPacket(toid, toaddr, req, packet, callback); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+}
+
+// TestSendRateLimit checks that outbound packets are paced to the configured rate.
+func TestSendRateLimit(t *testing.T) {
+	const rate, packets = 100, 21
+	conn := new(recordConn)
+	udp := &V4Udp{conn: conn, limiter: newTokenBucket(rate)}
+
+	start := time.Now()
+	for i := 0; i < packets; i++ {
+		udp.write(&net.UDPAddr{IP: net.IP{127, 0, 0, 2}, Port: 30303}, "TEST", []byte{1})
+	}
+	// the first packet goes out at once, every further one waits for a token
+	min := time.Duration(packets-1) * time.Second / rate
+	if elapsed := time.Since(start); elapsed < min*95/100 {
+		t.Fatalf("sent %d packets in %v, want at least %v at %d packets/s", packets, elapsed, min, rate)
+	}
+	if len(conn.written) != packets {
+		t.Fatalf("wrote %d packets, want %d", len(conn.written), packets)
+	}
+}
+
+// errConn is a conn whose reads fail with err.
+type errConn struct {
+	err error
+}
+
+func (c errConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error)     { return 0, nil, c.err }
+func (c errConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) { return len(b), nil }
+func (c errConn) Close() error                                        { return nil }
+func (c errConn) LocalAddr() net.Addr                                 { return &net.UDPAddr{} }
+
+// TestReadLoopEOF checks that readLoop exits quietly when the conn reports io.EOF, but logs
+// other permanent read errors as errors.
+func TestReadLoopEOF(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	defer log.Root().SetHandler(log.Root().GetHandler())
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Lvl <= log.LvlError && r.Msg == "UDP read error" {
+			mu.Lock()
+			logs = append(logs, r.Msg)
+			mu.Unlock()
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		err     error
+		wantLog bool
+	}{
+		{io.EOF, false},
+		{errors.New("permanent read error"), true},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		logs = nil
+		mu.Unlock()
+
+		udp := &V4Udp{conn: errConn{test.err}, closing: make(chan struct{})}
+		done := make(chan struct{})
+		go func() {
+			udp.readLoop(nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: readLoop did not exit", test.err)
+		}
+
+		mu.Lock()
+		if logged := len(logs) > 0; logged != test.wantLog {
+			t.Errorf("%v: error logged %t, want %t", test.err, logged, test.wantLog)
+		}
+		mu.Unlock()
+	}
+}
+
+// TestReadBufferSize sends a 2000 byte ping, above the packet size limit. With a large
+// enough read buffer it is read in full and reported with its true size, while the default
+// buffer of maxPacketSize truncates it, failing its hash. Either way the packet goes unhandled.
+func TestReadBufferSize(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key, _ := GenerateKey(rnd)
+	senderKey, _ := GenerateKey(rnd)
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer sender.Close()
+
+	const size = 2000
+	req, err := new(V4Udp).pingWithTail(sender.LocalAddr().(*net.UDPAddr), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, _, err := encodePacket(senderKey, PingPacket, req)
+	if err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+
+	for _, bufsize := range []int{4096, 0} {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		unhandled := make(chan ReadPacket, 1)
+		udp, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, Unhandled: unhandled, ReadBufferSize: bufsize})
+		if err != nil {
+			t.Fatalf("could not start listener: %v", err)
+		}
+		var got int
+		errc := udp.pending(EncodePubkey(&senderKey.PublicKey).id(), func(p reply) error {
+			if p.ptype != oversizedPacket {
+				return ErrPacketMismatch
+			}
+			got = p.data.(incomingPacket).size
+			return nil
+		})
+		if _, err := sender.WriteToUDP(packet, c.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatalf("could not send packet: %v", err)
+		}
+		want := size
+		if bufsize < size {
+			want = maxPacketSize
+		}
+		select {
+		case p := <-unhandled:
+			if len(p.Data) != want {
+				t.Errorf("buffer %d: read %d bytes, want %d", bufsize, len(p.Data), want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("buffer %d: packet not reported as unhandled", bufsize)
+		}
+		err = <-errc
+		switch {
+		case bufsize > size && (err != nil || got != size):
+			t.Errorf("buffer %d: got size %d (err %v), want %d", bufsize, got, err, size)
+		case bufsize <= size && err != ErrTimeout:
+			t.Errorf("buffer %d: truncated packet delivered: %v", bufsize, err)
+		}
+		udp.Close()
+	}
+}
+
+// TestConfigValidate checks each config rule, and that all broken rules are reported together.
+func TestConfigValidate(t *testing.T) {
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	valid := Config{
+		PrivateKey:   key,
+		AnnounceAddr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303},
+		Bootnodes:    []*enode.Node{enode.NewV4(&key.PublicKey, net.IP{127, 0, 0, 1}, 30303, 30303)},
+		Loss:         0.5,
+		Jitter:       time.Second,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	tests := []struct {
+		modify func(c *Config)
+		want   string
+	}{
+		{func(c *Config) { c.PrivateKey = nil }, "PrivateKey is required"},
+		{func(c *Config) { c.AnnounceAddr = &net.UDPAddr{IP: net.IP{1, 2, 3}, Port: 30303} }, "AnnounceAddr IP"},
+		{func(c *Config) { c.AnnounceAddr = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}} }, "AnnounceAddr port"},
+		{func(c *Config) { c.Bootnodes = []*enode.Node{nil} }, "Bootnodes[0] is nil"},
+		{func(c *Config) { c.Bootnodes = []*enode.Node{enode.NewV4(&key.PublicKey, nil, 0, 0)} }, "Bootnodes[0] is invalid"},
+		{func(c *Config) { c.Loss = 1.5 }, "Loss"},
+		{func(c *Config) { c.Loss = math.NaN() }, "Loss"},
+		{func(c *Config) { c.Jitter = -time.Second }, "Jitter"},
+		{func(c *Config) { c.SendRateLimit = -1 }, "SendRateLimit"},
+		{func(c *Config) { c.ReadBufferSize = 512 }, "ReadBufferSize"},
+		{func(c *Config) { c.WriteRetries = -1 }, "WriteRetries"},
+		{func(c *Config) { c.MaxPongExpiration = -time.Second }, "MaxPongExpiration"},
+		{func(c *Config) { c.PinnedPubkey = new(EncPubkey) }, "PinnedPubkey is invalid"},
+		{func(c *Config) { c.PinnedAddr = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303} }, "PinnedAddr"},
+		{func(c *Config) { c.EnableWatchdog, c.WatchdogInterval = true, -time.Second }, "WatchdogInterval"},
+		{func(c *Config) { c.WatchdogInterval = time.Second }, "without EnableWatchdog"},
+	}
+	for i, test := range tests {
+		c := valid
+		test.modify(&c)
+		err := c.Validate()
+		if err == nil || !strings.HasPrefix(err.Error(), ErrInvalidConfig.Error()) || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("test %d: got %v, want error containing %q", i, err, test.want)
+		}
+	}
+
+	c := Config{Loss: -1}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "PrivateKey") || !strings.Contains(err.Error(), "Loss") {
+		t.Errorf("got %v, want both PrivateKey and Loss reported", err)
+	}
+	if _, err := newUDP(new(recordConn), c); err == nil {
+		t.Error("newUDP accepted an invalid config")
+	}
+
+	//the announced family must match the socket's, which only newUDP knows
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+	c = valid
+	c.AnnounceAddr = &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 30303}
+	if err := c.Validate(); err != nil {
+		t.Errorf("IPv6 announce without a socket: %v", err)
+	}
+	_, err = newUDP(conn, c)
+	if err == nil || !strings.HasPrefix(err.Error(), ErrInvalidConfig.Error()) || !strings.Contains(err.Error(), "family") {
+		t.Errorf("IPv6 announce on an IPv4 socket: got %v, want error about the family", err)
+	}
+	if err := c.validate(&net.UDPAddr{IP: net.IPv6unspecified, Port: 30303}); err != nil {
+		t.Errorf("IPv6 announce on a dual-stack socket: %v", err)
+	}
+}
+
+// TestUnsolicitedClassification sends each packet type to a listener that is waiting for
+// nothing. Every reply type, and the ping, must be reported on the unhandled channel as
+// unsolicited, while the findnode and ENR requests are handled. The ping is still answered.
+func TestUnsolicitedClassification(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	key, _ := GenerateKey(rnd)
+	senderKey, _ := GenerateKey(rnd)
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer sender.Close()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	unhandled := make(chan ReadPacket, 1)
+	udp, err := ListenUDP(c, Config{PrivateKey: key, Rand: rnd, Unhandled: unhandled})
+	if err != nil {
+		t.Fatalf("could not start listener: %v", err)
+	}
+	defer udp.Close()
+
+	exp := uint64(time.Now().Add(expiration).Unix())
+	from := makeEndpoint(sender.LocalAddr().(*net.UDPAddr), 0)
+	var record enr.Record
+	if err := enode.SignV4(&record, senderKey); err != nil {
+		t.Fatalf("could not sign record: %v", err)
+	}
+	tests := []struct {
+		ptype       byte
+		req         packet
+		unsolicited bool
+	}{
+		{PingPacket, &ping{Version: 4, From: from, To: from, Expiration: exp}, true},
+		{PongPacket, &pong{To: from, ReplyTok: make([]byte, macSize), Expiration: exp}, true},
+		{FindnodePacket, &findnode{Expiration: exp}, false},
+		{NeighborsPacket, &neighbors{Expiration: exp}, true},
+		{ENRRequestPacket, &enrRequest{Expiration: exp}, false},
+		{ENRResponsePacket, &enrResponse{ReplyTok: make([]byte, macSize), Record: record}, true},
+	}
+	buf := make([]byte, maxPacketSize)
+	for _, test := range tests {
+		raw, _, err := encodePacket(senderKey, test.ptype, test.req)
+		if err != nil {
+			t.Fatalf("%s: could not encode packet: %v", test.req.name(), err)
+		}
+		if _, err := sender.WriteToUDP(raw, c.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatalf("%s: could not send packet: %v", test.req.name(), err)
+		}
+		select {
+		case <-unhandled:
+			if !test.unsolicited {
+				t.Errorf("%s: handled request reported as unhandled", test.req.name())
+			}
+		case <-time.After(200 * time.Millisecond):
+			if test.unsolicited {
+				t.Errorf("%s: unsolicited packet not reported as unhandled", test.req.name())
+			}
+		}
+		if test.ptype != PingPacket {
+			continue
+		}
+		sender.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := sender.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("unsolicited ping not answered: %v", err)
+		}
+		if p, _, _, err := decodePacket(buf[:n]); err != nil || p.name() != "PONG/v4" {
+			t.Errorf("unsolicited ping answered with %v (err %v), want a pong", p, err)
+		}
+	}
+}
+
+// decodePacketReference is decodePacket as it was before its digests were made fixed size,
+// kept to check the two agree.
+func decodePacketReference(buf []byte) (packet, EncPubkey, []byte, error) {
+	if len(buf) < headSize+1 {
+		return nil, EncPubkey{}, nil, ErrPacketTooSmall
+	}
+	hash, sig, sigdata := buf[:macSize], buf[macSize:headSize], buf[headSize:]
+	if !bytes.Equal(hash, crypto.Keccak256(buf[macSize:])) {
+		return nil, EncPubkey{}, nil, ErrBadHash
+	}
+	fromKey, err := recoverNodeKey(crypto.Keccak256(buf[headSize:]), sig)
+	if err != nil {
+		return nil, fromKey, hash, err
+	}
+	var req packet
+	switch ptype := sigdata[0]; ptype {
+	case PingPacket:
+		req = new(ping)
+	case PongPacket:
+		req = new(pong)
+	case FindnodePacket:
+		req = new(findnode)
+	case NeighborsPacket:
+		req = new(neighbors)
+	case ENRRequestPacket:
+		req = new(enrRequest)
+	case ENRResponsePacket:
+		req = new(enrResponse)
+	default:
+		return req, fromKey, hash, fmt.Errorf("%v: %d", ErrUnknownPacketType, ptype)
+	}
+	err = rlp.NewStream(bytes.NewReader(sigdata[1:]), 0).Decode(req)
+	return req, fromKey, hash, err
+}
+
+// decodeCorpus returns packets of each type along with corrupted variants: a bad hash, a bad
+// signature, an unknown type and a truncated payload.
+func decodeCorpus(t testing.TB) [][]byte {
+	key, _ := GenerateKey(rand.New(rand.NewSource(1)))
+	exp := uint64(time.Now().Add(expiration).Unix())
+	to := RPCEndpoint{IP: net.IP{127, 0, 0, 1}, UDP: 30303, TCP: 30303}
+	reqs := []struct {
+		ptype byte
+		req   interface{}
+	}{
+		{PingPacket, &ping{Version: 4, From: to, To: to, Expiration: exp}},
+		{PongPacket, &pong{To: to, ReplyTok: make([]byte, macSize), Expiration: exp}},
+		{FindnodePacket, &findnode{Expiration: exp}},
+		{NeighborsPacket, &neighbors{Nodes: []rpcNode{{IP: to.IP, UDP: to.UDP, TCP: to.TCP}}, Expiration: exp}},
+		{ENRRequestPacket, &enrRequest{Expiration: exp}},
+		{0xff, &enrRequest{Expiration: exp}},
+	}
+	var corpus [][]byte
+	for _, r := range reqs {
+		packet, _, err := encodePacket(key, r.ptype, r.req)
+		if err != nil {
+			t.Fatalf("could not encode packet: %v", err)
+		}
+		corpus = append(corpus, packet)
+	}
+	// corrupt copies of the ping, rehashed where the hash is not what is being corrupted
+	rehash := func(p []byte) []byte {
+		copy(p, crypto.Keccak256(p[macSize:]))
+		return p
+	}
+	badHash := append([]byte{}, corpus[0]...)
+	badHash[0] ^= 1
+	badSig := append([]byte{}, corpus[0]...)
+	badSig[headSize-1] = 0xff
+	truncated := append([]byte{}, corpus[0][:len(corpus[0])-2]...)
+	return append(corpus, badHash, rehash(badSig), rehash(truncated), corpus[0][:headSize])
+}
+
+// TestDecodePacketReference checks that decodePacket agrees with the reference decoder on
+// every packet of the corpus.
+func TestDecodePacketReference(t *testing.T) {
+	for i, buf := range decodeCorpus(t) {
+		p, key, hash, err := decodePacket(buf)
+		wp, wkey, whash, werr := decodePacketReference(buf)
+		if fmt.Sprint(p) != fmt.Sprint(wp) || key != wkey || !bytes.Equal(hash, whash) || fmt.Sprint(err) != fmt.Sprint(werr) {
+			t.Errorf("packet %d: got %v %x %x %v, want %v %x %x %v", i, p, key, hash, err, wp, wkey, whash, werr)
+		}
+	}
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	packet := decodeCorpus(b)[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := decodePacket(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
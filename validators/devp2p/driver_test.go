@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/karalabe/hive/validators/devp2p/discv4test"
+)
+
+// TestReportRecordsPanic checks that a test panicking on a malformed reply, as a type
+// assertion on it would, is recorded as errored with its stack, and that the report is
+// still written with the tests around it.
+func TestReportRecordsPanic(t *testing.T) {
+	results := newTestResults()
+	results.record("before", runOutcome{passed: true})
+	var reply interface{} = []byte{0xc0}
+	panicked := catchPanic(func() {
+		_ = reply.(*net.UDPAddr)
+	})
+	if panicked == "" {
+		t.Fatal("panic not caught")
+	}
+	results.record("malformedReply", runOutcome{panicked: panicked})
+	results.record("after", runOutcome{})
+
+	var buf strings.Builder
+	if err := writeJSONReport(&buf, []targetReport{{Target: "test", Tests: results.entries()}}); err != nil {
+		t.Fatalf("could not write report: %v", err)
+	}
+	var got []targetReport
+	if err := json.Unmarshal([]byte(buf.String()), &got); err != nil {
+		t.Fatalf("could not decode report: %v\n%s", err, buf.String())
+	}
+	if len(got) != 1 || len(got[0].Tests) != 3 {
+		t.Fatalf("got report %s, want three tests", buf.String())
+	}
+	verdicts := []string{"pass", "error", "fail"}
+	for i, e := range got[0].Tests {
+		if e.Verdict != verdicts[i] {
+			t.Errorf("%s: got verdict %s, want %s", e.Name, e.Verdict, verdicts[i])
+		}
+	}
+	e := got[0].Tests[1]
+	if e.Errored != 1 || len(e.Panics) != 1 || !strings.Contains(e.Panics[0], "TestReportRecordsPanic") {
+		t.Errorf("panic not recorded with its stack: %+v", e)
+	}
+}
+
+// TestPostWebhook checks that the summary is retried past a failing attempt, arrives with its
+// counts, and that a webhook failing every attempt is reported after the last one.
+func TestPostWebhook(t *testing.T) {
+	var attempts, failing int
+	var got summary
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failing {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	results := newTestResults()
+	results.record("ping", runOutcome{passed: true})
+	results.record("findnode", runOutcome{})
+	results.record("enr", runOutcome{passed: true, skipped: true})
+	s := newSummary([]targetReport{{Target: "enode://test", Tests: results.entries()}})
+	failing = 1
+	if err := postWebhook(srv.URL, s, 3, time.Millisecond); err != nil {
+		t.Fatalf("could not post: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if got.Counts["pass"] != 1 || got.Counts["fail"] != 1 || got.Counts["skip"] != 1 || len(got.Targets) != 1 {
+		t.Errorf("got summary %+v", got)
+	}
+
+	attempts, failing = 0, 3
+	if err := postWebhook(srv.URL, s, 2, time.Millisecond); err == nil || attempts != 2 {
+		t.Errorf("failing webhook: got %v after %d attempts, want an error after 2", err, attempts)
+	}
+}
+
+// TestParseTarget checks that mistyped target flags are rejected with an error naming the flag
+// and the problem.
+func TestParseTarget(t *testing.T) {
+	id := strings.Repeat("ab", 64)
+	lookup := func(host string) ([]net.IP, error) { return nil, errors.New("no such host") }
+	tests := []struct {
+		enode, ip, want string
+	}{
+		{"", "", ""},
+		{"", "192.0.2.1", ""},
+		{"enode:/" + id + "@192.0.2.1:30303", "", "no //"},
+		{"http://" + id + "@192.0.2.1:30303", "", `scheme is "http"`},
+		{"enode://192.0.2.1:30303", "", "no node ID"},
+		{"enode://" + id[:100] + "@192.0.2.1:30303", "", "100 hex digits"},
+		{"enode://" + strings.Repeat("zz", 64) + "@192.0.2.1:30303", "", "not hex"},
+		{"enode://" + id + "@192.0.2.1", "", "no TCP port"},
+		{"", "no.such.host", "invalid -targetIP"},
+	}
+	for _, test := range tests {
+		_, _, err := parseTarget(test.enode, test.ip, lookup, false)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%q %q: unexpected error %v", test.enode, test.ip, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%q %q: got %v, want an error containing %q", test.enode, test.ip, err, test.want)
+		}
+	}
+}
+
+// TestExpectedFailures checks that a listed test failing is an expected failure that does not
+// fail the run, that a listed test passing is reported, and that unknown IDs are rejected.
+func TestExpectedFailures(t *testing.T) {
+	results := newTestResults()
+	results.expected = map[string]bool{"v4004": true, "v4010": true}
+	results.run(t, "Failing(v4004)", func(t *testing.T) { fail(t, "Test failed: %v", errors.New("known issue")) })
+	results.run(t, "Passing(v4010)", func(t *testing.T) {})
+	for name, want := range map[string]string{"Failing(v4004)": "expected failure", "Passing(v4010)": "unexpectedly passed"} {
+		if got := results.results[name].verdict(); got != want {
+			t.Errorf("%s: got verdict %q, want %q", name, got, want)
+		}
+	}
+	//a second run, as under -repeat, is named Failing(v4004)#01 and must still be recognised
+	results.run(t, "Failing(v4004)", func(t *testing.T) { fail(t, "Test failed: %v", errors.New("known issue")) })
+	if res := results.results["Failing(v4004)"]; res.xfailed != 2 || res.failed != 0 {
+		t.Errorf("repeated: got %d expected failures and %d failures, want 2 and 0", res.xfailed, res.failed)
+	}
+	//the failure is kept with the test, not carried over to the next one run under -continueOnFailure
+	defer func(k bool) { *keepGoing = k }(*keepGoing)
+	*keepGoing = true
+	results.run(t, "FailingOn(v4004)", func(t *testing.T) { fail(t, "Test failed: %v", errors.New("known issue")) })
+	results.run(t, "PassingAfter(v4010)", func(t *testing.T) {})
+	for name, want := range map[string]string{"FailingOn(v4004)": "expected failure", "PassingAfter(v4010)": "unexpectedly passed"} {
+		if got := results.results[name].verdict(); got != want {
+			t.Errorf("-continueOnFailure %s: got verdict %q, want %q", name, got, want)
+		}
+	}
+
+	if ids, err := parseExpectedFailures(" v4004,v4010"); err != nil || !ids["v4004"] || !ids["v4010"] {
+		t.Errorf("got %v, %v", ids, err)
+	}
+	if _, err := parseExpectedFailures("v4004,v4999"); err == nil || !strings.Contains(err.Error(), "v4999") {
+		t.Errorf("unknown ID: got %v", err)
+	}
+}
+
+// TestStreamResults checks that a result line is streamed for each test as it finishes, and
+// printed in the documented format.
+func TestStreamResults(t *testing.T) {
+	lines := make(chan resultLine, 4)
+	results := newTestResults()
+	results.expected = map[string]bool{"v4004": true}
+	results.stream = lines
+	results.run(t, "Failing(v4004)", func(t *testing.T) { fail(t, "Test failed: %v", errors.New("known issue")) })
+	results.run(t, "Passing(v4010)", func(t *testing.T) {})
+	results.run(t, "Skipped", func(t *testing.T) { t.Skip("not applicable") })
+	close(lines)
+
+	var buf bytes.Buffer
+	drainResults(&buf, lines)
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"RESULT v4004 XFAIL", "RESULT v4010 PASS", "RESULT Skipped SKIP"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %d lines", got, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]+" ") || !strings.HasSuffix(got[i], "s") {
+			t.Errorf("line %d: got %q, want %q and a duration", i, got[i], want[i])
+		}
+	}
+}
+
+// TestInterrupt checks that once a signal arrives the test in progress finishes, the rest are
+// skipped, and the outcomes of all of them still reach the report and the stream.
+func TestInterrupt(t *testing.T) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go interruptOn(sigs, done)
+
+	lines := make(chan resultLine, 4)
+	results := newTestResults()
+	results.stream = lines
+	results.shutdown = done
+	results.run(t, "Interrupted(v4010)", func(t *testing.T) {
+		sigs <- syscall.SIGTERM
+		<-done
+	})
+	ran := false
+	results.run(t, "Remaining(v4011)", func(t *testing.T) { ran = true })
+	close(lines)
+
+	if ran {
+		t.Error("test after the interrupt ran")
+	}
+	entries := results.entries()
+	if len(entries) != 2 || entries[0].Passed != 1 || entries[1].Skipped != 1 {
+		t.Errorf("got report %+v, want the first passed and the second skipped", entries)
+	}
+	var buf bytes.Buffer
+	drainResults(&buf, lines)
+	if got := buf.String(); !strings.Contains(got, "RESULT v4010 PASS") || !strings.Contains(got, "RESULT v4011 SKIP") {
+		t.Errorf("got stream %q", got)
+	}
+}
+
+// TestWriteStaticNodes checks that nodes are written as a JSON array of their enode URLs.
+func TestWriteStaticNodes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var nodes []*enode.Node
+	for _, port := range []int{30303, 30304} {
+		key, _ := discv4test.GenerateKey(rnd)
+		nodes = append(nodes, enode.NewV4(&key.PublicKey, net.IP{10, 0, 0, 1}, 30303, port))
+	}
+	var buf bytes.Buffer
+	if err := writeStaticNodes(&buf, nodes); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	var urls []string
+	if err := json.Unmarshal(buf.Bytes(), &urls); err != nil {
+		t.Fatalf("not a JSON array of strings: %v\n%s", err, buf.Bytes())
+	}
+	if len(urls) != len(nodes) {
+		t.Fatalf("got %d URLs, want %d", len(urls), len(nodes))
+	}
+	for i, n := range nodes {
+		if urls[i] != n.URLv4() {
+			t.Errorf("URL %d: got %q, want %q", i, urls[i], n.URLv4())
+		}
+	}
+	buf.Reset()
+	if err := writeStaticNodes(&buf, nil); err != nil || strings.TrimSpace(buf.String()) != "[]" {
+		t.Errorf("no nodes: got %q, %v, want an empty array", buf.String(), err)
+	}
+}
+
+// TestSentPayloads checks that only the packets to the first packet's destination are replayed.
+func TestSentPayloads(t *testing.T) {
+	harness := &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 30304}
+	target := &net.UDPAddr{IP: net.IP{10, 0, 0, 2}, Port: 30303}
+	other := &net.UDPAddr{IP: net.IP{10, 0, 0, 2}, Port: 30305}
+	captured := []discv4test.CapturedPacket{
+		{Src: harness, Dst: target, Payload: []byte("ping")},
+		{Src: target, Dst: harness, Payload: []byte("pong")},
+		{Src: harness, Dst: other, Payload: []byte("other")},
+		{Src: other, Dst: target, Payload: []byte("findnode")},
+	}
+	got := sentPayloads(captured)
+	if len(got) != 2 || string(got[0]) != "ping" || string(got[1]) != "findnode" {
+		t.Errorf("got %q, want the ping and the findnode", got)
+	}
+}
+
+// fakeNAT is a NAT device that gives ip as its external IP, or never answers if ip is nil.
+type fakeNAT struct{ ip net.IP }
+
+func (n fakeNAT) ExternalIP() (net.IP, error) {
+	if n.ip == nil {
+		select {}
+	}
+	return n.ip, nil
+}
+
+func (n fakeNAT) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	return errors.New("no mapping")
+}
+
+func (n fakeNAT) DeleteMapping(protocol string, extport, intport int) error { return nil }
+
+func (n fakeNAT) String() string { return "fake" }
+
+// TestAnnounceAddr checks that the external IP of a NAT device is announced, and that an
+// unreachable one is given up on after the timeout in favour of the local address.
+func TestAnnounceAddr(t *testing.T) {
+	laddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 30303}
+	if got := announceAddr(nil, laddr, time.Second); got != laddr {
+		t.Errorf("no NAT: got %v, want %v", got, laddr)
+	}
+	ext := net.IP{203, 0, 113, 1}
+	if got := announceAddr(fakeNAT{ext}, laddr, time.Second); !got.IP.Equal(ext) || got.Port != laddr.Port {
+		t.Errorf("NAT: got %v, want %v:%d", got, ext, laddr.Port)
+	}
+	start := time.Now()
+	if got := announceAddr(fakeNAT{}, laddr, 100*time.Millisecond); got != laddr {
+		t.Errorf("unreachable NAT: got %v, want %v", got, laddr)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("unreachable NAT: returned after %v, want soon after the timeout", d)
+	}
+}